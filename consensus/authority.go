@@ -0,0 +1,71 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+// ProofOfAuthority blocks are sealed with the signature of one of a fixed
+// set of signers. Without any authorities every signer is accepted. The
+// first valid block seen at a height wins and is final right away.
+type ProofOfAuthority struct {
+	authorities [][]byte
+}
+
+func NewProofOfAuthority(authorities [][]byte) *ProofOfAuthority {
+	return &ProofOfAuthority{
+		authorities: authorities,
+	}
+}
+
+func (e *ProofOfAuthority) Name() string {
+	return Authority
+}
+
+func (e *ProofOfAuthority) Prepare(chain ChainReader, header *proto.Header) error {
+	return nil
+}
+
+func (e *ProofOfAuthority) Seal(ctx context.Context, block *proto.Block, pk *crypto.PrivateKey) error {
+	if !e.isAuthority(pk.Public().Bytes()) {
+		return fmt.Errorf("%s is not an authority", hex.EncodeToString(pk.Public().Bytes()))
+	}
+	types.SignBlock(pk, block)
+	return nil
+}
+
+func (e *ProofOfAuthority) VerifySeal(chain ChainReader, block *proto.Block) error {
+	if !types.VerifyHeader(block.Header, block.PublicKey, block.Signature) {
+		return fmt.Errorf("invalid block signature")
+	}
+	if !e.isAuthority(block.PublicKey) {
+		return fmt.Errorf("block signer %s is not an authority", hex.EncodeToString(block.PublicKey))
+	}
+	return nil
+}
+
+func (e *ProofOfAuthority) ForkChoice(current, candidate []*proto.Header) bool {
+	return false
+}
+
+func (e *ProofOfAuthority) Finalize(chain ChainReader) int {
+	return chain.Height()
+}
+
+func (e *ProofOfAuthority) isAuthority(pubKey []byte) bool {
+	if len(e.authorities) == 0 {
+		return true
+	}
+	for _, authority := range e.authorities {
+		if bytes.Equal(authority, pubKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package consensus
+
+import (
+	"context"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+)
+
+const (
+	Authority = "authority"
+	PoS       = "pos"
+	PoW       = "pow"
+)
+
+// ChainReader is the part of the chain an engine needs to look at when
+// preparing or verifying blocks.
+type ChainReader interface {
+	Height() int
+	GetHeader(height int) (*proto.Header, error)
+	FinalizedHeight() int
+	IsValidator(pubKey []byte) bool
+}
+
+// Engine decides how blocks are sealed, which seals are valid, which of two
+// competing branches wins and when blocks become final.
+type Engine interface {
+	Name() string
+	// Prepare fills in the consensus fields of a header extending the chain.
+	Prepare(chain ChainReader, header *proto.Header) error
+	// Seal makes the block valid under the engine's rules, it blocks until
+	// the block is sealed or the context is cancelled.
+	Seal(ctx context.Context, block *proto.Block, pk *crypto.PrivateKey) error
+	// VerifySeal only looks at the header and its signature, so light clients
+	// can verify blocks without their transactions.
+	VerifySeal(chain ChainReader, block *proto.Block) error
+	// ForkChoice reports whether the candidate branch should replace the
+	// current one, both start right after their common ancestor.
+	ForkChoice(current, candidate []*proto.Header) bool
+	// Finalize returns the height up to which the chain can no longer be
+	// reorganized, it is called every time a block is added.
+	Finalize(chain ChainReader) int
+}
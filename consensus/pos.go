@@ -0,0 +1,52 @@
+package consensus
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+// ProofOfStake blocks are sealed with the signature of a member of the
+// validator set. Blocks are final once the validators committed to them, so
+// there is never a competing branch to choose.
+type ProofOfStake struct{}
+
+func NewProofOfStake() *ProofOfStake {
+	return &ProofOfStake{}
+}
+
+func (e *ProofOfStake) Name() string {
+	return PoS
+}
+
+func (e *ProofOfStake) Prepare(chain ChainReader, header *proto.Header) error {
+	return nil
+}
+
+func (e *ProofOfStake) Seal(ctx context.Context, block *proto.Block, pk *crypto.PrivateKey) error {
+	types.SignBlock(pk, block)
+	return nil
+}
+
+func (e *ProofOfStake) VerifySeal(chain ChainReader, block *proto.Block) error {
+	if !types.VerifyHeader(block.Header, block.PublicKey, block.Signature) {
+		return fmt.Errorf("invalid block signature")
+	}
+	if !chain.IsValidator(block.PublicKey) {
+		return fmt.Errorf("block signer %s is not a validator", hex.EncodeToString(block.PublicKey))
+	}
+	return nil
+}
+
+func (e *ProofOfStake) ForkChoice(current, candidate []*proto.Header) bool {
+	return false
+}
+
+// Finalize leaves finality to the commit certificates of the validators.
+func (e *ProofOfStake) Finalize(chain ChainReader) int {
+	return chain.FinalizedHeight()
+}
@@ -0,0 +1,186 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	pb "google.golang.org/protobuf/proto"
+)
+
+const (
+	// the difficulty can change by at most this factor per adjustment
+	maxAdjustment = 4
+	// blocks buried this deep are not reorganized anymore
+	confirmations = 6
+)
+
+var maxTarget = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// ProofOfWork requires the header hash to be below a target derived from the
+// header's difficulty, which is retargeted every interval blocks so that
+// blocks are found every blockTime on average.
+type ProofOfWork struct {
+	blockTime time.Duration
+	interval  int
+	// number of goroutines searching for a nonce
+	workers int
+}
+
+func NewProofOfWork(blockTime time.Duration, interval int) *ProofOfWork {
+	return &ProofOfWork{
+		blockTime: blockTime,
+		interval:  interval,
+		workers:   runtime.NumCPU(),
+	}
+}
+
+func (e *ProofOfWork) Name() string {
+	return PoW
+}
+
+func (e *ProofOfWork) Prepare(chain ChainReader, header *proto.Header) error {
+	difficulty, err := e.nextDifficulty(chain)
+	if err != nil {
+		return err
+	}
+	header.Difficulty = difficulty
+	header.Nonce = 0
+	return nil
+}
+
+// nextDifficulty returns the difficulty of the block following the tip.
+func (e *ProofOfWork) nextDifficulty(chain ChainReader) (uint64, error) {
+	height := chain.Height()
+	parent, err := chain.GetHeader(height)
+	if err != nil {
+		return 0, err
+	}
+	// the genesis block has no meaningful timestamp, keep it out of the window
+	if (height+1)%e.interval != 0 || height+1 <= e.interval {
+		return parent.Difficulty, nil
+	}
+	first, err := chain.GetHeader(height + 1 - e.interval)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		actual   = time.Duration(parent.Timestamp - first.Timestamp)
+		expected = e.blockTime * time.Duration(e.interval-1)
+	)
+	return adjustDifficulty(parent.Difficulty, actual, expected), nil
+}
+
+func adjustDifficulty(difficulty uint64, actual, expected time.Duration) uint64 {
+	if actual < expected/maxAdjustment {
+		actual = expected / maxAdjustment
+	}
+	if actual > expected*maxAdjustment {
+		actual = expected * maxAdjustment
+	}
+	next := new(big.Int).SetUint64(difficulty)
+	next.Mul(next, big.NewInt(int64(expected)))
+	next.Div(next, big.NewInt(int64(actual)))
+	if next.Sign() == 0 {
+		return 1
+	}
+	if !next.IsUint64() {
+		return ^uint64(0)
+	}
+	return next.Uint64()
+}
+
+// Seal searches for a nonce on all workers and signs the mined header.
+func (e *ProofOfWork) Seal(ctx context.Context, block *proto.Block, pk *crypto.PrivateKey) error {
+	if block.Header.Difficulty == 0 {
+		return fmt.Errorf("block has no difficulty")
+	}
+	// everything covered by the header hash has to be final before mining
+	types.FillHeader(pk.Public(), block)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		target = targetFor(block.Header.Difficulty)
+		found  = make(chan uint64, e.workers)
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < e.workers; i++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+			header := pb.Clone(block.Header).(*proto.Header)
+			for i := uint64(0); ; i++ {
+				if i%1024 == 0 && ctx.Err() != nil {
+					return
+				}
+				header.Nonce = start + i*uint64(e.workers)
+				if meetsTarget(header, target) {
+					found <- header.Nonce
+					cancel()
+					return
+				}
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	select {
+	case nonce := <-found:
+		block.Header.Nonce = nonce
+		types.SignBlock(pk, block)
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
+
+func (e *ProofOfWork) VerifySeal(chain ChainReader, block *proto.Block) error {
+	difficulty, err := e.nextDifficulty(chain)
+	if err != nil {
+		return err
+	}
+	if block.Header.Difficulty != difficulty {
+		return fmt.Errorf("invalid difficulty %d, expected %d", block.Header.Difficulty, difficulty)
+	}
+	if !meetsTarget(block.Header, targetFor(difficulty)) {
+		return fmt.Errorf("block hash does not meet the target")
+	}
+	if !types.VerifyHeader(block.Header, block.PublicKey, block.Signature) {
+		return fmt.Errorf("invalid block signature")
+	}
+	return nil
+}
+
+// ForkChoice follows the branch with the most accumulated work.
+func (e *ProofOfWork) ForkChoice(current, candidate []*proto.Header) bool {
+	return work(candidate).Cmp(work(current)) > 0
+}
+
+func (e *ProofOfWork) Finalize(chain ChainReader) int {
+	return chain.Height() - confirmations
+}
+
+func work(headers []*proto.Header) *big.Int {
+	total := new(big.Int)
+	for _, h := range headers {
+		total.Add(total, new(big.Int).SetUint64(h.Difficulty))
+	}
+	return total
+}
+
+// targetFor returns 2^256 / difficulty, a valid hash must not exceed it.
+func targetFor(difficulty uint64) *big.Int {
+	return new(big.Int).Div(maxTarget, new(big.Int).SetUint64(difficulty))
+}
+
+func meetsTarget(header *proto.Header, target *big.Int) bool {
+	hash := new(big.Int).SetBytes(types.HashHeader(header))
+	return hash.Cmp(target) <= 0
+}
@@ -0,0 +1,111 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type headerChain []*proto.Header
+
+func (c headerChain) Height() int {
+	return len(c) - 1
+}
+
+func (c headerChain) GetHeader(height int) (*proto.Header, error) {
+	if height < 0 || height >= len(c) {
+		return nil, fmt.Errorf("no header at height %d", height)
+	}
+	return c[height], nil
+}
+
+func (c headerChain) FinalizedHeight() int {
+	return 0
+}
+
+func (c headerChain) IsValidator(pubKey []byte) bool {
+	return false
+}
+
+func TestPoWForkChoice(t *testing.T) {
+	engine := NewProofOfWork(time.Second, 10)
+	current := []*proto.Header{{Difficulty: 100}, {Difficulty: 100}}
+	assert.False(t, engine.ForkChoice(current, []*proto.Header{{Difficulty: 200}}))
+	assert.True(t, engine.ForkChoice(current, []*proto.Header{{Difficulty: 201}}))
+}
+
+func TestAdjustDifficulty(t *testing.T) {
+	expected := time.Second * 10
+	assert.Equal(t, uint64(1000), adjustDifficulty(1000, expected, expected))
+	assert.Equal(t, uint64(2000), adjustDifficulty(1000, expected/2, expected))
+	assert.Equal(t, uint64(500), adjustDifficulty(1000, expected*2, expected))
+	// the change is clamped
+	assert.Equal(t, uint64(4000), adjustDifficulty(1000, time.Nanosecond, expected))
+	assert.Equal(t, uint64(250), adjustDifficulty(1000, expected*100, expected))
+	assert.Equal(t, uint64(1), adjustDifficulty(1, expected*4, expected))
+}
+
+func TestNextDifficulty(t *testing.T) {
+	var (
+		engine = NewProofOfWork(time.Second, 5)
+		chain  = headerChain{{Difficulty: 100}}
+	)
+	// blocks come twice as fast as they should
+	for i := 1; i < 10; i++ {
+		chain = append(chain, &proto.Header{
+			Height:     int32(i),
+			Difficulty: 100,
+			Timestamp:  int64(i) * int64(time.Millisecond*500),
+		})
+	}
+	difficulty, err := engine.nextDifficulty(chain)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(200), difficulty)
+
+	difficulty, err = engine.nextDifficulty(chain[:9])
+	require.Nil(t, err)
+	assert.Equal(t, uint64(100), difficulty)
+}
+
+func TestSealVerifySeal(t *testing.T) {
+	var (
+		engine  = NewProofOfWork(time.Second, 10)
+		privKey = crypto.GeneratePrivateKey()
+		chain   = headerChain{{Difficulty: 1 << 10}}
+		block   = util.RandomBlock()
+	)
+	block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1})
+	require.Nil(t, engine.Prepare(chain, block.Header))
+	assert.Equal(t, uint64(1<<10), block.Header.Difficulty)
+
+	require.Nil(t, engine.Seal(context.Background(), block, privKey))
+	assert.True(t, types.VerifyBlock(block))
+	assert.Nil(t, engine.VerifySeal(chain, block))
+
+	block.Header.Nonce++
+	types.SignBlock(privKey, block)
+	if meetsTarget(block.Header, targetFor(block.Header.Difficulty)) {
+		t.Skip("next nonce happens to meet the target as well")
+	}
+	assert.NotNil(t, engine.VerifySeal(chain, block))
+}
+
+func TestSealCancel(t *testing.T) {
+	var (
+		engine = NewProofOfWork(time.Second, 10)
+		chain  = headerChain{{Difficulty: ^uint64(0)}}
+		block  = util.RandomBlock()
+	)
+	require.Nil(t, engine.Prepare(chain, block.Header))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.NotNil(t, engine.Seal(ctx, block, crypto.GeneratePrivateKey()))
+}
@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"math/big"
+)
+
+// size in bytes of the elements MuHash multiplies
+const muHashElementLen = 384
+
+// muHashPrime is the largest prime below 2^3072
+var muHashPrime = new(big.Int).Sub(
+	new(big.Int).Lsh(big.NewInt(1), 3072),
+	big.NewInt(1103717),
+)
+
+// MuHash is a hash of a set that can be updated incrementally. Every element
+// is mapped to a number modulo a large prime, adding multiplies it into the
+// numerator and removing into the denominator, so the digest only depends on
+// the elements in the set and not on the order of the updates.
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+func NewMuHash() *MuHash {
+	return &MuHash{
+		numerator:   big.NewInt(1),
+		denominator: big.NewInt(1),
+	}
+}
+
+func (m *MuHash) Add(data []byte) {
+	m.numerator.Mul(m.numerator, muHashElement(data))
+	m.numerator.Mod(m.numerator, muHashPrime)
+}
+
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, muHashElement(data))
+	m.denominator.Mod(m.denominator, muHashPrime)
+}
+
+func (m *MuHash) Clone() *MuHash {
+	return &MuHash{
+		numerator:   new(big.Int).Set(m.numerator),
+		denominator: new(big.Int).Set(m.denominator),
+	}
+}
+
+func (m *MuHash) Digest() []byte {
+	value := new(big.Int).ModInverse(m.denominator, muHashPrime)
+	value.Mul(value, m.numerator)
+	value.Mod(value, muHashPrime)
+	hash := sha256.Sum256(value.FillBytes(make([]byte, muHashElementLen)))
+	return hash[:]
+}
+
+// muHashElement expands the hash of the data to a 3072 bit number.
+func muHashElement(data []byte) *big.Int {
+	seed := sha256.Sum256(data)
+	buf := make([]byte, 0, muHashElementLen)
+	for i := byte(0); len(buf) < muHashElementLen; i++ {
+		block := sha256.Sum256(append(seed[:], i))
+		buf = append(buf, block[:]...)
+	}
+	element := new(big.Int).SetBytes(buf)
+	return element.Mod(element, muHashPrime)
+}
@@ -0,0 +1,38 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuHashOrderIndependent(t *testing.T) {
+	var (
+		a = NewMuHash()
+		b = NewMuHash()
+	)
+	a.Add([]byte("foo"))
+	a.Add([]byte("bar"))
+	b.Add([]byte("bar"))
+	b.Add([]byte("foo"))
+	assert.Equal(t, a.Digest(), b.Digest())
+	assert.Equal(t, 32, len(a.Digest()))
+
+	b.Add([]byte("baz"))
+	assert.NotEqual(t, a.Digest(), b.Digest())
+}
+
+func TestMuHashRemove(t *testing.T) {
+	var (
+		empty = NewMuHash().Digest()
+		m     = NewMuHash()
+	)
+	// removing before adding still ends up at the same set
+	m.Remove([]byte("foo"))
+	m.Add([]byte("bar"))
+	m.Add([]byte("foo"))
+	clone := m.Clone()
+	m.Remove([]byte("bar"))
+	assert.Equal(t, empty, m.Digest())
+	assert.NotEqual(t, empty, clone.Digest())
+}
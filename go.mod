@@ -5,7 +5,6 @@ go 1.20
 require github.com/stretchr/testify v1.8.4
 
 require (
-	github.com/cbergoon/merkletree v0.2.0 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.24.0 // indirect
@@ -9,10 +9,11 @@ import (
 	"github.com/koshkaj/bloq/node"
 	"github.com/koshkaj/bloq/proto"
 	"github.com/koshkaj/bloq/util"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
+// seed of the validator bonded in the genesis block
+const validatorSeed = "13be19fc5de106d87f9deaec7de204bd5b3a36bb50d66f81fdd5d1482dbeab6e"
+
 func main() {
 	makeNode(":3000", []string{}, true)
 	time.Sleep(1 * time.Second)
@@ -31,7 +32,7 @@ func makeNode(listenAddr string, bootstrapNodes []string, isValidator bool) *nod
 		ListenAddr: listenAddr,
 	}
 	if isValidator {
-		cfg.PrivateKey = crypto.GeneratePrivateKey()
+		cfg.PrivateKey = crypto.NewPrivateKeyFromSeedStr(validatorSeed)
 	}
 	n := node.New(cfg)
 	go n.Start(listenAddr, bootstrapNodes)
@@ -39,7 +40,7 @@ func makeNode(listenAddr string, bootstrapNodes []string, isValidator bool) *nod
 }
 
 func makeTransaction() {
-	client, err := grpc.Dial(":3000", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	client, err := node.Dial(":3000", crypto.GeneratePrivateKey())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -63,9 +64,8 @@ func makeTransaction() {
 		Version: 1,
 	}
 
-	_, err = c.HandleTransaction(context.TODO(), tx)
-
-	if err != nil {
-		log.Fatal(err)
+	// the inputs are made up, so the nodes reject the tx
+	if _, err = c.HandleTransaction(context.TODO(), tx); err != nil {
+		log.Println(err)
 	}
 }
@@ -0,0 +1,536 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// addresses the book remembers, the worst ones are forgotten first
+	maxKnownAddrs = 1000
+	// misbehavior points after which a node is banned
+	banThreshold = 100
+	banDuration  = time.Hour * 24
+	// one misbehavior point is forgiven this often, only a node that keeps
+	// misbehaving gets banned
+	misbehaviorDecay = time.Minute
+	// node keys the book remembers misbehavior of
+	maxKnownNodes = 10000
+	// connected time that stops adding to the score of an address
+	maxUptimeScore = time.Hour * 24
+	// addresses that failed this many dials in a row are not handed out
+	maxSampleAttempts = 3
+)
+
+// KnownAddr is what the address book knows about a node.
+type KnownAddr struct {
+	Addr string `json:"addr"`
+	// who told us about the address
+	Source string `json:"source"`
+	// connection attempts since the last success
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	// average round trip of the pings
+	Latency     time.Duration `json:"latency"`
+	Uptime      time.Duration `json:"uptime"`
+	BannedUntil time.Time     `json:"bannedUntil"`
+	// identity key of the node, pinned the first time we talked to it
+	PublicKey []byte `json:"publicKey,omitempty"`
+
+	connectedAt time.Time
+}
+
+// Tried reports whether we were ever connected to the address.
+func (ka *KnownAddr) Tried() bool {
+	return !ka.LastSuccess.IsZero()
+}
+
+func (ka *KnownAddr) Banned() bool {
+	return time.Now().Before(ka.BannedUntil)
+}
+
+// Score rates how good a peer the address is. Long uptime counts in favor of
+// it; latency and failed attempts count against it.
+func (ka *KnownAddr) Score() float64 {
+	uptime := ka.Uptime
+	if !ka.connectedAt.IsZero() {
+		uptime += time.Since(ka.connectedAt)
+	}
+	if uptime > maxUptimeScore {
+		uptime = maxUptimeScore
+	}
+	score := uptime.Hours()
+	score -= ka.Latency.Seconds() * 10
+	score -= float64(ka.Attempts)
+	return score
+}
+
+// retryAt is when the address may be dialed again, the wait doubles with
+// every failed attempt.
+func (ka *KnownAddr) retryAt(min, max time.Duration) time.Time {
+	if ka.Attempts == 0 {
+		return ka.LastAttempt
+	}
+	backoff := min << (ka.Attempts - 1)
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+	return ka.LastAttempt.Add(backoff)
+}
+
+// NodeScore is the misbehavior held against a node key. Points are counted
+// against the key, many nodes can share a host behind a NAT. A ban holds
+// against the host the misbehavior came from as well, a new key is free to
+// make.
+type NodeScore struct {
+	Points      int       `json:"points"`
+	Updated     time.Time `json:"updated"`
+	BannedUntil time.Time `json:"bannedUntil"`
+}
+
+func (ns *NodeScore) Banned() bool {
+	return time.Now().Before(ns.BannedUntil)
+}
+
+// decay forgives the points that are due since the last update.
+func (ns *NodeScore) decay(now time.Time) {
+	forgiven := int(now.Sub(ns.Updated) / misbehaviorDecay)
+	if forgiven == 0 {
+		return
+	}
+	ns.Points -= forgiven
+	if ns.Points < 0 {
+		ns.Points = 0
+	}
+	ns.Updated = ns.Updated.Add(misbehaviorDecay * time.Duration(forgiven))
+}
+
+// AddrBook keeps track of the nodes we know about. With a path it survives
+// restarts of the node.
+type AddrBook struct {
+	mu    sync.Mutex
+	path  string
+	addrs map[string]*KnownAddr
+	// hex encoded node key -> misbehavior of the node
+	nodes map[string]*NodeScore
+	// banned ip or ipv6 subnet -> when the ban ends
+	hosts map[string]time.Time
+	dirty bool
+}
+
+// savedBook is how the book is written to its path.
+type savedBook struct {
+	Addrs []*KnownAddr          `json:"addrs"`
+	Nodes map[string]*NodeScore `json:"nodes"`
+	Hosts map[string]time.Time  `json:"hosts,omitempty"`
+}
+
+func NewAddrBook() *AddrBook {
+	return &AddrBook{
+		addrs: make(map[string]*KnownAddr),
+		nodes: make(map[string]*NodeScore),
+		hosts: make(map[string]time.Time),
+	}
+}
+
+// LoadAddrBook reads the book saved at path, an empty book is returned if
+// there is none yet.
+func LoadAddrBook(path string) (*AddrBook, error) {
+	book := NewAddrBook()
+	book.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := savedBook{}
+	// books of older versions only hold the addresses
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &saved.Addrs)
+	} else {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ka := range saved.Addrs {
+		book.addrs[ka.Addr] = ka
+	}
+	for key, ns := range saved.Nodes {
+		book.nodes[key] = ns
+	}
+	for host, until := range saved.Hosts {
+		book.hosts[host] = until
+	}
+	return book, nil
+}
+
+// Save writes the book to its path if it changed since the last save.
+func (b *AddrBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path == "" || !b.dirty {
+		return nil
+	}
+	saved := savedBook{
+		Addrs: make([]*KnownAddr, 0, len(b.addrs)),
+		Nodes: b.nodes,
+		Hosts: b.hosts,
+	}
+	for _, ka := range b.addrs {
+		saved.Addrs = append(saved.Addrs, ka)
+	}
+	sort.Slice(saved.Addrs, func(i, j int) bool { return saved.Addrs[i].Addr < saved.Addrs[j].Addr })
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write next to the book and rename, so a crash never leaves half a book
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// Add records an address we heard about from source. It reports whether the
+// address was new.
+func (b *AddrBook) Add(addr, source string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.addrs[addr]; ok || addr == "" {
+		return false
+	}
+	if len(b.addrs) >= maxKnownAddrs && !b.evict() {
+		return false
+	}
+	b.addrs[addr] = &KnownAddr{Addr: addr, Source: source}
+	b.dirty = true
+	return true
+}
+
+// evict forgets the worst address we never connected to.
+func (b *AddrBook) evict() bool {
+	var worst *KnownAddr
+	for _, ka := range b.addrs {
+		if ka.Tried() || ka.Banned() {
+			continue
+		}
+		if worst == nil || b.score(ka) < b.score(worst) {
+			worst = ka
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(b.addrs, worst.Addr)
+	return true
+}
+
+func (b *AddrBook) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.addrs[addr]; ok {
+		delete(b.addrs, addr)
+		b.dirty = true
+	}
+}
+
+func (b *AddrBook) Get(addr string) (KnownAddr, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return KnownAddr{}, false
+	}
+	return *ka, true
+}
+
+func (b *AddrBook) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.addrs)
+}
+
+// update applies f to the address, adding it to the book first if needed.
+func (b *AddrBook) update(addr string, f func(*KnownAddr)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ka, ok := b.addrs[addr]
+	if !ok {
+		ka = &KnownAddr{Addr: addr, Source: addr}
+		b.addrs[addr] = ka
+	}
+	f(ka)
+	b.dirty = true
+}
+
+func (b *AddrBook) Attempt(addr string) {
+	b.update(addr, func(ka *KnownAddr) {
+		ka.Attempts++
+		ka.LastAttempt = time.Now()
+	})
+}
+
+// Connected marks the address as a peer we are connected to.
+func (b *AddrBook) Connected(addr string) {
+	b.update(addr, func(ka *KnownAddr) {
+		ka.Attempts = 0
+		ka.LastSuccess = time.Now()
+		ka.connectedAt = ka.LastSuccess
+	})
+}
+
+func (b *AddrBook) Disconnected(addr string) {
+	b.update(addr, func(ka *KnownAddr) {
+		if !ka.connectedAt.IsZero() {
+			ka.Uptime += time.Since(ka.connectedAt)
+			ka.connectedAt = time.Time{}
+		}
+	})
+}
+
+// Pinged folds the round trip of a ping into the latency of the address.
+func (b *AddrBook) Pinged(addr string, rtt time.Duration) {
+	b.update(addr, func(ka *KnownAddr) {
+		if ka.Latency == 0 {
+			ka.Latency = rtt
+			return
+		}
+		ka.Latency = (ka.Latency*7 + rtt) / 8
+	})
+}
+
+// Misbehaved adds misbehavior points to the node key, once the points that
+// did not decay yet reach banThreshold the node is banned, together with the
+// addresses pinned to its key. It reports whether the node got banned.
+func (b *AddrBook) Misbehaved(key []byte, points int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var (
+		now    = time.Now()
+		id     = hex.EncodeToString(key)
+		ns, ok = b.nodes[id]
+	)
+	if !ok {
+		if len(b.nodes) >= maxKnownNodes {
+			b.forgetNodes(now)
+		}
+		ns = &NodeScore{Updated: now}
+		b.nodes[id] = ns
+	}
+	b.dirty = true
+	ns.decay(now)
+	ns.Points += points
+	if ns.Points < banThreshold || ns.Banned() {
+		return false
+	}
+	ns.BannedUntil = now.Add(banDuration)
+	ns.Points = 0
+	for _, ka := range b.addrs {
+		if bytes.Equal(ka.PublicKey, key) {
+			ka.BannedUntil = ns.BannedUntil
+		}
+	}
+	return true
+}
+
+// forgetNodes drops the nodes that are not banned and whose points were
+// forgiven.
+func (b *AddrBook) forgetNodes(now time.Time) {
+	for id, ns := range b.nodes {
+		ns.decay(now)
+		if !ns.Banned() && ns.Points == 0 {
+			delete(b.nodes, id)
+		}
+	}
+}
+
+// GetNode returns the misbehavior held against the node key.
+func (b *AddrBook) GetNode(key []byte) (NodeScore, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ns, ok := b.nodes[hex.EncodeToString(key)]
+	if !ok {
+		return NodeScore{}, false
+	}
+	return *ns, true
+}
+
+// IsNodeBanned reports whether the node with the key is banned.
+func (b *AddrBook) IsNodeBanned(key []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ns, ok := b.nodes[hex.EncodeToString(key)]
+	return ok && ns.Banned()
+}
+
+// score rates the address like KnownAddr.Score, the misbehavior points of the
+// node pinned to it count like failed attempts.
+func (b *AddrBook) score(ka *KnownAddr) float64 {
+	score := ka.Score()
+	if ka.PublicKey == nil {
+		return score
+	}
+	if ns, ok := b.nodes[hex.EncodeToString(ka.PublicKey)]; ok {
+		ns.decay(time.Now())
+		score -= float64(ns.Points)
+	}
+	return score
+}
+
+// misbehaving reports whether misbehavior is held against the node key.
+func (b *AddrBook) misbehaving(key []byte) bool {
+	if key == nil {
+		return false
+	}
+	ns, ok := b.nodes[hex.EncodeToString(key)]
+	if !ok {
+		return false
+	}
+	ns.decay(time.Now())
+	return ns.Banned() || ns.Points > 0
+}
+
+func (b *AddrBook) Ban(addr string, d time.Duration) {
+	b.update(addr, func(ka *KnownAddr) {
+		ka.BannedUntil = time.Now().Add(d)
+	})
+}
+
+// Pin binds the address to the identity key of the node behind it. Once
+// pinned, only that key is accepted for the address.
+func (b *AddrBook) Pin(addr string, key []byte) error {
+	var err error
+	b.update(addr, func(ka *KnownAddr) {
+		if ka.PublicKey == nil {
+			ka.PublicKey = key
+			return
+		}
+		if !bytes.Equal(ka.PublicKey, key) {
+			err = fmt.Errorf("%s is pinned to another node key", addr)
+		}
+	})
+	return err
+}
+
+func (b *AddrBook) IsBanned(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ka, ok := b.addrs[addr]
+	return ok && ka.Banned()
+}
+
+// banPrefix returns what a ban of the host holds against. A single ipv6 host
+// is handed a whole /64, so the subnet is banned.
+func banPrefix(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// hostOf returns the host of the address, or the address if it has no port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// BanHost bans the host a connection came from or went to for banDuration.
+func (b *AddrBook) BanHost(host string) {
+	if host == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for prefix, until := range b.hosts {
+		if now.After(until) {
+			delete(b.hosts, prefix)
+		}
+	}
+	b.hosts[banPrefix(host)] = now.Add(banDuration)
+	b.dirty = true
+}
+
+// IsHostBanned reports whether connections from or to the host are turned
+// away.
+func (b *AddrBook) IsHostBanned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hostBanned(host)
+}
+
+func (b *AddrBook) hostBanned(host string) bool {
+	until, ok := b.hosts[banPrefix(host)]
+	return ok && time.Now().Before(until)
+}
+
+// Candidates returns up to n addresses worth dialing, best first. Banned
+// addresses and hosts, the ones in skip and the ones still backing off are
+// left out.
+func (b *AddrBook) Candidates(n int, skip map[string]bool, minBackoff, maxBackoff time.Duration) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var (
+		now        = time.Now()
+		candidates = []*KnownAddr{}
+	)
+	for _, ka := range b.addrs {
+		if skip[ka.Addr] || ka.Banned() || b.hostBanned(hostOf(ka.Addr)) || now.Before(ka.retryAt(minBackoff, maxBackoff)) {
+			continue
+		}
+		candidates = append(candidates, ka)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return b.score(candidates[i]) > b.score(candidates[j])
+	})
+	addrs := []string{}
+	for i := 0; i < n && i < len(candidates); i++ {
+		addrs = append(addrs, candidates[i].Addr)
+	}
+	return addrs
+}
+
+// Sample returns up to n random addresses that we were connected to and that
+// did not fail or misbehave since, for handing out to other nodes.
+func (b *AddrBook) Sample(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	good := []string{}
+	for _, ka := range b.addrs {
+		if ka.Tried() && !ka.Banned() && ka.Attempts < maxSampleAttempts && !b.misbehaving(ka.PublicKey) {
+			good = append(good, ka.Addr)
+		}
+	}
+	rand.Shuffle(len(good), func(i, j int) {
+		good[i], good[j] = good[j], good[i]
+	})
+	if len(good) > n {
+		good = good[:n]
+	}
+	return good
+}
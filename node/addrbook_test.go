@@ -0,0 +1,149 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrBookPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrbook.json")
+	book, err := LoadAddrBook(path)
+	require.Nil(t, err)
+	require.Equal(t, 0, book.Len())
+
+	require.True(t, book.Add("a:3000", "seed"))
+	require.False(t, book.Add("a:3000", "b:3000"))
+	book.Add("b:3000", "seed")
+	book.Connected("a:3000")
+	book.Pinged("a:3000", time.Millisecond*20)
+	book.Disconnected("a:3000")
+	book.Ban("b:3000", time.Hour)
+	key := crypto.GeneratePrivateKey().Public().Bytes()
+	book.Misbehaved(key, banThreshold)
+	book.BanHost("10.0.0.1")
+	require.Nil(t, book.Save())
+
+	loaded, err := LoadAddrBook(path)
+	require.Nil(t, err)
+	require.Equal(t, 2, loaded.Len())
+	a, ok := loaded.Get("a:3000")
+	require.True(t, ok)
+	require.True(t, a.Tried())
+	require.Equal(t, "seed", a.Source)
+	require.Equal(t, time.Millisecond*20, a.Latency)
+	require.True(t, loaded.IsBanned("b:3000"))
+	require.True(t, loaded.IsNodeBanned(key))
+	require.True(t, loaded.IsHostBanned("10.0.0.1"))
+}
+
+func TestAddrBookCandidates(t *testing.T) {
+	book := NewAddrBook()
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		book.Add(addr, "seed")
+	}
+	book.Pinged("a", time.Second)
+	// banning the node bans the addresses pinned to its key
+	key := crypto.GeneratePrivateKey().Public().Bytes()
+	require.Nil(t, book.Pin("c", key))
+	book.Misbehaved(key, banThreshold)
+	book.Attempt("d")
+
+	// c is banned and d backs off, a is slow
+	require.Equal(t, []string{"b", "a"}, book.Candidates(10, nil, time.Minute, time.Hour))
+	require.Equal(t, []string{"a"}, book.Candidates(10, map[string]bool{"b": true}, time.Minute, time.Hour))
+	require.Len(t, book.Candidates(1, nil, time.Minute, time.Hour), 1)
+	require.Contains(t, book.Candidates(10, nil, 0, 0), "d")
+}
+
+func TestAddrBookCandidatesMisbehavior(t *testing.T) {
+	book := NewAddrBook()
+	for _, addr := range []string{"a", "b"} {
+		book.Add(addr, "seed")
+		book.Connected(addr)
+		book.Disconnected(addr)
+	}
+	require.Nil(t, book.Pin("a", crypto.GeneratePrivateKey().Public().Bytes()))
+	key := crypto.GeneratePrivateKey().Public().Bytes()
+	require.Nil(t, book.Pin("b", key))
+	book.update("b", func(ka *KnownAddr) { ka.Uptime = time.Hour })
+	require.Equal(t, []string{"b", "a"}, book.Candidates(10, nil, 0, 0))
+
+	// a node that misbehaves is dialed after the ones that do not
+	book.Misbehaved(key, 10)
+	require.Equal(t, []string{"a", "b"}, book.Candidates(10, nil, 0, 0))
+}
+
+func TestAddrBookSample(t *testing.T) {
+	book := NewAddrBook()
+	for _, addr := range []string{"a", "b", "c", "d", "e"} {
+		book.Add(addr, "seed")
+		book.Connected(addr)
+	}
+	book.Add("never", "seed")
+	key := crypto.GeneratePrivateKey().Public().Bytes()
+	require.Nil(t, book.Pin("b", key))
+	book.Misbehaved(key, 1)
+	for i := 0; i < maxSampleAttempts; i++ {
+		book.Attempt("c")
+	}
+
+	// only addresses that worked are handed out
+	require.ElementsMatch(t, []string{"a", "d", "e"}, book.Sample(10))
+	require.Len(t, book.Sample(2), 2)
+}
+
+func TestAddrBookMisbehavior(t *testing.T) {
+	var (
+		book  = NewAddrBook()
+		key   = crypto.GeneratePrivateKey().Public().Bytes()
+		other = crypto.GeneratePrivateKey().Public().Bytes()
+	)
+	require.False(t, book.Misbehaved(key, banThreshold/2))
+	require.False(t, book.IsNodeBanned(key))
+
+	// points are forgiven over time
+	book.nodes[hex.EncodeToString(key)].Updated = time.Now().Add(-misbehaviorDecay * banThreshold / 4)
+	require.False(t, book.Misbehaved(key, banThreshold/2))
+	require.False(t, book.IsNodeBanned(key))
+	require.True(t, book.Misbehaved(key, banThreshold/2))
+	require.True(t, book.IsNodeBanned(key))
+
+	// the ban of a key leaves other keys alone
+	require.False(t, book.IsNodeBanned(other))
+}
+
+func TestAddrBookHostBans(t *testing.T) {
+	book := NewAddrBook()
+	book.Add("10.0.0.1:3000", "seed")
+	book.Add("10.0.0.2:3000", "seed")
+	book.BanHost("10.0.0.1")
+	require.True(t, book.IsHostBanned("10.0.0.1"))
+	require.False(t, book.IsHostBanned("10.0.0.2"))
+	require.Equal(t, []string{"10.0.0.2:3000"}, book.Candidates(10, nil, 0, 0))
+
+	// an ipv6 host is banned with its subnet
+	book.BanHost("2001:db8::1")
+	require.True(t, book.IsHostBanned("2001:db8::ffff"))
+	require.False(t, book.IsHostBanned("2001:db8:0:1::1"))
+
+	book.hosts[banPrefix("10.0.0.1")] = time.Now().Add(-time.Second)
+	require.False(t, book.IsHostBanned("10.0.0.1"))
+}
+
+func TestAddrBookIsBounded(t *testing.T) {
+	book := NewAddrBook()
+	book.Add("tried", "seed")
+	book.Connected("tried")
+	for i := 0; i < maxKnownAddrs+10; i++ {
+		book.Add(fmt.Sprintf("10.0.0.%d:3000", i), "spammer")
+	}
+	require.Equal(t, maxKnownAddrs, book.Len())
+	_, ok := book.Get("tried")
+	require.True(t, ok)
+}
@@ -0,0 +1,580 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"go.uber.org/zap"
+)
+
+type step int
+
+const (
+	stepPropose step = iota
+	stepPrevote
+	stepPrecommit
+	stepCommit
+)
+
+type bftTimeouts struct {
+	propose   time.Duration
+	prevote   time.Duration
+	precommit time.Duration
+	// every round waits this much longer than the one before it
+	delta time.Duration
+	// time between committing a block and starting the next height
+	commit time.Duration
+	// time between sending the proposal and votes of the round again
+	gossip time.Duration
+}
+
+// cap on buffered messages for the next height
+const maxFutureMsgs = 1024
+
+var defaultTimeouts = bftTimeouts{
+	propose:   time.Second * 3,
+	prevote:   time.Second,
+	precommit: time.Second,
+	delta:     time.Millisecond * 500,
+	commit:    blockTime,
+	gossip:    time.Second,
+}
+
+type timeoutEvent struct {
+	height int
+	round  int
+	step   step
+}
+
+type voteKey struct {
+	round    int
+	voteType proto.VoteType
+}
+
+// BFT is a Tendermint style finality gadget. Every height runs one or more
+// rounds of propose, prevote and precommit; a block is committed once more
+// than 2/3 of the voting power precommitted to it and is never reverted
+// afterwards. Nodes without a validator key follow the votes and commit
+// blocks without voting themselves.
+type BFT struct {
+	privKey   *crypto.PrivateKey
+	chain     *Chain
+	mempool   *Mempool
+	evidence  *EvidencePool
+	logger    *zap.SugaredLogger
+	timeouts  bftTimeouts
+	broadcast func(msg any)
+
+	proposalCh chan *proto.Proposal
+	voteCh     chan *proto.Vote
+	commitCh   chan *proto.CommittedBlock
+	timeoutCh  chan timeoutEvent
+	quitCh     chan struct{}
+
+	// round state, only touched by the run loop
+	height      int
+	round       int
+	step        step
+	validators  *ValidatorSet
+	proposals   map[int]*proto.Proposal
+	votes       map[voteKey]map[string]*proto.Vote
+	lockedRound int
+	lockedBlock *proto.Block
+	// the block we proposed at this height, re-proposed in later rounds so
+	// that we never sign two different headers at the same height
+	proposed  *proto.Block
+	scheduled map[timeoutEvent]bool
+	// messages for the next height that arrived before we committed ours
+	future []any
+}
+
+func NewBFT(chain *Chain, mempool *Mempool, evidence *EvidencePool, privKey *crypto.PrivateKey, logger *zap.SugaredLogger, broadcast func(msg any)) *BFT {
+	return &BFT{
+		privKey:    privKey,
+		chain:      chain,
+		mempool:    mempool,
+		evidence:   evidence,
+		logger:     logger,
+		timeouts:   defaultTimeouts,
+		broadcast:  broadcast,
+		proposalCh: make(chan *proto.Proposal, 64),
+		voteCh:     make(chan *proto.Vote, 256),
+		commitCh:   make(chan *proto.CommittedBlock),
+		timeoutCh:  make(chan timeoutEvent, 16),
+		quitCh:     make(chan struct{}),
+	}
+}
+
+func (b *BFT) HandleProposal(p *proto.Proposal) {
+	select {
+	case b.proposalCh <- p:
+	case <-b.quitCh:
+	}
+}
+
+func (b *BFT) HandleVote(v *proto.Vote) {
+	select {
+	case b.voteCh <- v:
+	case <-b.quitCh:
+	}
+}
+
+// HandleCommit applies a block that was already committed by the rest of the
+// network, it is used to catch up with peers that are ahead of us.
+func (b *BFT) HandleCommit(cb *proto.CommittedBlock) {
+	select {
+	case b.commitCh <- cb:
+	case <-b.quitCh:
+	}
+}
+
+func (b *BFT) Stop() {
+	close(b.quitCh)
+}
+
+func (b *BFT) run() {
+	if b.privKey != nil {
+		b.logger.Infow("starting validator", "pubkey", hex.EncodeToString(b.privKey.Public().Bytes()), "blocktime", b.timeouts.commit)
+	}
+	b.startHeight()
+	gossip := time.NewTicker(b.timeouts.gossip)
+	defer gossip.Stop()
+	for {
+		select {
+		case p := <-b.proposalCh:
+			b.handleProposal(p)
+		case v := <-b.voteCh:
+			b.handleVote(v)
+		case cb := <-b.commitCh:
+			b.handleCommit(cb)
+		case t := <-b.timeoutCh:
+			b.handleTimeout(t)
+		case <-gossip.C:
+			b.regossip()
+		case <-b.quitCh:
+			return
+		}
+	}
+}
+
+func (b *BFT) startHeight() {
+	b.height = b.chain.Height() + 1
+	b.validators = b.chain.Validators()
+	b.proposals = make(map[int]*proto.Proposal)
+	b.votes = make(map[voteKey]map[string]*proto.Vote)
+	b.scheduled = make(map[timeoutEvent]bool)
+	b.lockedRound = -1
+	b.lockedBlock = nil
+	b.proposed = nil
+	b.startRound(0)
+
+	future := b.future
+	b.future = nil
+	for _, msg := range future {
+		switch v := msg.(type) {
+		case *proto.Proposal:
+			b.handleProposal(v)
+		case *proto.Vote:
+			b.handleVote(v)
+		}
+	}
+}
+
+func (b *BFT) startRound(round int) {
+	b.round = round
+	b.step = stepPropose
+	b.logger.Debugw("new round", "height", b.height, "round", round)
+
+	if b.isProposer(round) {
+		block := b.lockedBlock
+		if block == nil {
+			block = b.proposed
+		}
+		if block == nil {
+			block = b.createBlock()
+			b.proposed = block
+		}
+		if block != nil {
+			proposal := &proto.Proposal{
+				Block: block,
+				Round: int32(round),
+			}
+			types.SignProposal(b.privKey, b.chain.ChainID(), proposal)
+			b.handleProposal(proposal)
+		}
+	}
+	if p, ok := b.proposals[round]; ok && b.step == stepPropose {
+		b.prevote(p.Block)
+	}
+	b.schedule(stepPropose, b.timeouts.propose)
+}
+
+func (b *BFT) isProposer(round int) bool {
+	if b.privKey == nil {
+		return false
+	}
+	proposer := b.validators.Proposer(b.height, round)
+	return proposer != nil && bytes.Equal(proposer.PublicKey, b.privKey.Public().Bytes())
+}
+
+func (b *BFT) createBlock() *proto.Block {
+	block, err := newBlock(b.chain, b.mempool, b.evidence)
+	if err != nil {
+		b.logger.Errorw("could not create block", "err", err)
+		return nil
+	}
+	if err := b.chain.Engine().Seal(context.Background(), block, b.privKey); err != nil {
+		b.logger.Errorw("could not seal block", "err", err)
+		return nil
+	}
+	b.logger.Debugw("created block", "height", b.height, "lenTx", len(block.Transactions))
+	return block
+}
+
+func (b *BFT) handleProposal(p *proto.Proposal) {
+	block := p.Block
+	if block == nil || block.Header == nil {
+		return
+	}
+	height := int(block.Header.Height)
+	round := int(p.Round)
+	if height > b.height {
+		b.deferMsg(p)
+		return
+	}
+	if height < b.height || !b.inRoundWindow(round) {
+		return
+	}
+	b.checkEvidence(block)
+	if _, ok := b.proposals[round]; ok {
+		return
+	}
+	// the proposer signs the proposal, the block may be one that another
+	// validator sealed in an earlier round and we are locked on
+	proposer := b.validators.Proposer(height, round)
+	if proposer == nil || !bytes.Equal(proposer.PublicKey, p.PublicKey) || !types.VerifyProposal(b.chain.ChainID(), p) {
+		b.logger.Debugw("proposal from wrong proposer", "height", height, "round", round)
+		return
+	}
+	if err := b.chain.ValidateBlock(block); err != nil {
+		b.logger.Debugw("invalid proposal", "height", height, "round", round, "err", err)
+		return
+	}
+	b.proposals[round] = p
+	b.broadcast(p)
+
+	if round == b.round && b.step == stepPropose {
+		b.prevote(block)
+	}
+	b.checkQuorums(round)
+}
+
+func (b *BFT) handleVote(v *proto.Vote) {
+	height := int(v.Height)
+	if height > b.height {
+		b.deferMsg(v)
+		return
+	}
+	if height < b.height || !b.inRoundWindow(int(v.Round)) {
+		return
+	}
+	key := hex.EncodeToString(v.PublicKey)
+	if _, ok := b.validators.Get(v.PublicKey); !ok {
+		return
+	}
+	vk := voteKey{round: int(v.Round), voteType: v.Type}
+	if _, ok := b.votes[vk]; !ok {
+		b.votes[vk] = make(map[string]*proto.Vote)
+	}
+	if _, ok := b.votes[vk][key]; ok {
+		return
+	}
+	if !types.VerifyVote(b.chain.ChainID(), v) {
+		return
+	}
+	b.votes[vk][key] = v
+	b.broadcast(v)
+	b.checkQuorums(int(v.Round))
+}
+
+func (b *BFT) handleCommit(cb *proto.CommittedBlock) {
+	if cb.Block == nil || cb.Commit == nil || int(cb.Commit.Height) != b.height {
+		return
+	}
+	b.checkEvidence(cb.Block)
+	if err := b.chain.CommitBlock(cb.Block, cb.Commit); err != nil {
+		b.logger.Errorw("failed to apply committed block", "height", b.height, "err", err)
+		return
+	}
+	updatePools(b.chain, cb.Block, b.mempool, b.evidence, b.broadcast)
+	b.logger.Debugw("caught up with committed block", "height", b.height)
+	b.startHeight()
+}
+
+// checkEvidence looks for a validator that signed another header at the same
+// height, the evidence is gossiped and included in our next proposal.
+func (b *BFT) checkEvidence(block *proto.Block) {
+	ev := b.evidence.CheckBlock(block, b.validators, b.chain.Height())
+	if ev == nil {
+		return
+	}
+	b.logger.Warnw("validator double-signed",
+		"height", ev.HeaderA.Height,
+		"validator", hex.EncodeToString(ev.PublicKey))
+	if b.evidence.Add(ev) {
+		b.broadcast(ev)
+	}
+}
+
+// inRoundWindow reports whether messages for the round of the current height
+// are kept. Rounds further ahead than the next one are dropped, they would
+// let a validator fill our memory; their messages are gossiped again once we
+// get closer.
+func (b *BFT) inRoundWindow(round int) bool {
+	return round >= 0 && round <= b.round+1
+}
+
+func (b *BFT) deferMsg(msg any) {
+	if len(b.future) < maxFutureMsgs {
+		b.future = append(b.future, msg)
+	}
+}
+
+func (b *BFT) handleTimeout(t timeoutEvent) {
+	if t.height != b.height || t.round != b.round || t.step != b.step {
+		return
+	}
+	switch t.step {
+	case stepPropose:
+		b.logger.Debugw("propose timeout", "height", b.height, "round", b.round)
+		b.prevote(nil)
+	case stepPrevote:
+		b.precommit(nil)
+	case stepPrecommit:
+		b.startRound(b.round + 1)
+	case stepCommit:
+		b.startHeight()
+	}
+}
+
+// prevote votes for the block, or for nil when we are locked on another one.
+// A lock gives way to more than 2/3 of the prevotes for the block in a later
+// round, otherwise a minority locked on a block nobody else saw could never
+// agree with the rest. Every step is left after its timeout at the latest.
+func (b *BFT) prevote(block *proto.Block) {
+	if b.lockedBlock != nil && block != nil && !sameBlock(b.lockedBlock, block) {
+		if b.hasPOL(block) {
+			b.unlock()
+		} else {
+			block = nil
+		}
+	}
+	b.step = stepPrevote
+	b.schedule(stepPrevote, b.timeouts.prevote)
+	b.vote(proto.VoteType_PREVOTE, block)
+}
+
+func (b *BFT) precommit(block *proto.Block) {
+	if block != nil {
+		b.lockedRound = b.round
+		b.lockedBlock = block
+	}
+	b.step = stepPrecommit
+	b.schedule(stepPrecommit, b.timeouts.precommit)
+	b.vote(proto.VoteType_PRECOMMIT, block)
+}
+
+// hasPOL reports whether more than 2/3 prevoted for the block in a round
+// after the one we locked in.
+func (b *BFT) hasPOL(block *proto.Block) bool {
+	var (
+		hash  = hex.EncodeToString(types.HashBlock(block))
+		total = b.validators.TotalPower()
+	)
+	for round := b.lockedRound + 1; round <= b.round; round++ {
+		if best, power := b.tally(round, proto.VoteType_PREVOTE); best == hash && hasQuorum(power, total) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BFT) unlock() {
+	b.lockedRound = -1
+	b.lockedBlock = nil
+}
+
+func sameBlock(a, b *proto.Block) bool {
+	return bytes.Equal(types.HashBlock(a), types.HashBlock(b))
+}
+
+func (b *BFT) vote(voteType proto.VoteType, block *proto.Block) {
+	if b.privKey == nil {
+		return
+	}
+	if _, ok := b.validators.Get(b.privKey.Public().Bytes()); !ok {
+		return
+	}
+	vote := &proto.Vote{
+		Type:   voteType,
+		Height: int32(b.height),
+		Round:  int32(b.round),
+	}
+	if block != nil {
+		vote.BlockHash = types.HashBlock(block)
+	}
+	types.SignVote(b.privKey, b.chain.ChainID(), vote)
+	b.handleVote(vote)
+}
+
+func (b *BFT) checkQuorums(round int) {
+	if b.step == stepCommit {
+		return
+	}
+	total := b.validators.TotalPower()
+
+	if round > b.round && hasOneThird(b.roundPower(round), total) {
+		b.startRound(round)
+		b.checkQuorums(round)
+		return
+	}
+
+	hash, power := b.tally(round, proto.VoteType_PRECOMMIT)
+	if hash != "" && hasQuorum(power, total) {
+		if p, ok := b.proposals[round]; ok && hex.EncodeToString(types.HashBlock(p.Block)) == hash {
+			b.commit(p.Block, round)
+			return
+		}
+	}
+
+	if round != b.round || b.step != stepPrevote {
+		return
+	}
+	hash, power = b.tally(round, proto.VoteType_PREVOTE)
+	if hasQuorum(power, total) {
+		if hash == "" {
+			b.unlock()
+			b.precommit(nil)
+			return
+		}
+		if p, ok := b.proposals[round]; ok && hex.EncodeToString(types.HashBlock(p.Block)) == hash {
+			b.precommit(p.Block)
+			return
+		}
+	}
+}
+
+// tally returns the block hash with the most voting power behind it in the
+// given round and that power. An empty hash stands for nil.
+func (b *BFT) tally(round int, voteType proto.VoteType) (string, int64) {
+	powers := make(map[string]int64)
+	for key, vote := range b.votes[voteKey{round: round, voteType: voteType}] {
+		pubKey, _ := hex.DecodeString(key)
+		validator, _ := b.validators.Get(pubKey)
+		powers[hex.EncodeToString(vote.BlockHash)] += validator.Power
+	}
+	var (
+		best      string
+		bestPower int64
+	)
+	for hash, power := range powers {
+		if power > bestPower {
+			best, bestPower = hash, power
+		}
+	}
+	return best, bestPower
+}
+
+func (b *BFT) roundPower(round int) int64 {
+	var (
+		voters = make(map[string]bool)
+		power  int64
+	)
+	for _, voteType := range []proto.VoteType{proto.VoteType_PREVOTE, proto.VoteType_PRECOMMIT} {
+		for key := range b.votes[voteKey{round: round, voteType: voteType}] {
+			if voters[key] {
+				continue
+			}
+			voters[key] = true
+			pubKey, _ := hex.DecodeString(key)
+			validator, _ := b.validators.Get(pubKey)
+			power += validator.Power
+		}
+	}
+	return power
+}
+
+func (b *BFT) commit(block *proto.Block, round int) {
+	hash := types.HashBlock(block)
+	cert := &proto.CommitCertificate{
+		Height:    int32(b.height),
+		Round:     int32(round),
+		BlockHash: hash,
+	}
+	for _, vote := range b.votes[voteKey{round: round, voteType: proto.VoteType_PRECOMMIT}] {
+		if bytes.Equal(vote.BlockHash, hash) {
+			cert.Precommits = append(cert.Precommits, vote)
+		}
+	}
+	if err := b.chain.CommitBlock(block, cert); err != nil {
+		b.logger.Errorw("failed to commit block", "height", b.height, "err", err)
+		return
+	}
+	updatePools(b.chain, block, b.mempool, b.evidence, b.broadcast)
+	b.logger.Infow("committed block",
+		"height", b.height,
+		"round", round,
+		"hash", hex.EncodeToString(hash),
+		"lenTx", len(block.Transactions))
+
+	b.step = stepCommit
+	b.schedule(stepCommit, b.timeouts.commit)
+}
+
+// regossip sends the proposal and the votes of the current round again. Peers
+// that connected late or lost them to a dropped link would wait for them
+// until the round times out, and the next round could be lost the same way.
+func (b *BFT) regossip() {
+	if p, ok := b.proposals[b.round]; ok {
+		b.broadcast(p)
+	}
+	for _, voteType := range []proto.VoteType{proto.VoteType_PREVOTE, proto.VoteType_PRECOMMIT} {
+		for _, vote := range b.votes[voteKey{round: b.round, voteType: voteType}] {
+			b.broadcast(vote)
+		}
+	}
+}
+
+func (b *BFT) schedule(s step, timeout time.Duration) {
+	event := timeoutEvent{
+		height: b.height,
+		round:  b.round,
+		step:   s,
+	}
+	if b.scheduled[event] {
+		return
+	}
+	b.scheduled[event] = true
+	if s != stepCommit {
+		timeout += b.timeouts.delta * time.Duration(b.round)
+	}
+	time.AfterFunc(timeout, func() {
+		select {
+		case b.timeoutCh <- event:
+		case <-b.quitCh:
+		}
+	})
+}
+
+func hasQuorum(power, total int64) bool {
+	return power*3 > total*2
+}
+
+func hasOneThird(power, total int64) bool {
+	return power*3 > total
+}
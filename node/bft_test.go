@@ -0,0 +1,353 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	pb "google.golang.org/protobuf/proto"
+)
+
+var testTimeouts = bftTimeouts{
+	propose:   time.Millisecond * 100,
+	prevote:   time.Millisecond * 50,
+	precommit: time.Millisecond * 50,
+	delta:     time.Millisecond * 10,
+	commit:    time.Millisecond * 10,
+	gossip:    time.Millisecond * 50,
+}
+
+func posChain(t *testing.T) *Chain {
+	chain, err := NewChainFromGenesis(PoSGenesis(), NewMemoryBlockStore(), NewMemoryTXStore())
+	require.Nil(t, err)
+	return chain
+}
+
+// validatorChains returns identical chains on which every key is a validator
+// with the same voting power as the genesis validator.
+func validatorChains(t *testing.T, keys []*crypto.PrivateKey) []*Chain {
+	var (
+		base       = posChain(t)
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		bonds      = []*proto.Transaction{}
+	)
+	for _, key := range keys[1:] {
+		bond := stakeTx(t, base, proto.TxType_BOND, key, key.Public().Bytes(), genesisStake)
+		bond.Inputs = nil
+		bonds = append(bonds, bond)
+	}
+	// split the genesis output so that every bond has its own input
+	split := stakeTx(t, base, proto.TxType_TRANSFER, genesisKey, nil, 0)
+	split.Stake = nil
+	for range bonds {
+		split.Outputs = append(split.Outputs, &proto.TxOutput{
+			Amount:  genesisStake,
+			Address: genesisKey.Public().Address().Bytes(),
+		})
+	}
+	split.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, split).Bytes()
+	addTxBlock(t, base, split)
+
+	for i, bond := range bonds {
+		bond.Inputs = []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(split),
+				PrevOutIndex: uint32(i),
+				PublicKey:    genesisKey.Public().Bytes(),
+			},
+		}
+		bond.Stake.Signature = types.SignTransaction(keys[i+1], defaultChainID, bond).Bytes()
+		bond.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, bond).Bytes()
+	}
+	addTxBlock(t, base, bonds...)
+	fillEpoch(t, base)
+	require.Equal(t, len(keys), base.Validators().Len())
+
+	chains := make([]*Chain, len(keys))
+	for i := range keys {
+		chains[i] = replayChain(t, base)
+	}
+	return chains
+}
+
+func replayChain(t *testing.T, chain *Chain) *Chain {
+	replayed := posChain(t)
+	for i := 1; i <= chain.Height(); i++ {
+		b, err := chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		require.Nil(t, replayed.addBlock(b))
+	}
+	return replayed
+}
+
+func startBFTs(chains []*Chain, keys []*crypto.PrivateKey, online []bool) []*BFT {
+	return startLinkedBFTs(chains, keys, online, func(from, to int) bool { return true })
+}
+
+// startLinkedBFTs starts the validators that are online, a message only gets
+// from one to another while linked says so.
+func startLinkedBFTs(chains []*Chain, keys []*crypto.PrivateKey, online []bool, linked func(from, to int) bool) []*BFT {
+	logger := zap.NewNop().Sugar()
+	bfts := make([]*BFT, len(chains))
+	for i := range chains {
+		i := i
+		bfts[i] = NewBFT(chains[i], NewMempool(), NewEvidencePool(), keys[i], logger, func(msg any) {
+			for j, other := range bfts {
+				if j == i || !online[j] || !linked(i, j) {
+					continue
+				}
+				switch v := msg.(type) {
+				case *proto.Proposal:
+					go other.HandleProposal(pb.Clone(v).(*proto.Proposal))
+				case *proto.Vote:
+					go other.HandleVote(pb.Clone(v).(*proto.Vote))
+				}
+			}
+		})
+		bfts[i].timeouts = testTimeouts
+	}
+	for i, b := range bfts {
+		if online[i] {
+			go b.run()
+		}
+	}
+	return bfts
+}
+
+func stopBFTs(bfts []*BFT, online []bool) {
+	for i, b := range bfts {
+		if online[i] {
+			b.Stop()
+		}
+	}
+}
+
+func TestBFTSingleValidator(t *testing.T) {
+	var (
+		chain   = posChain(t)
+		privKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		online  = []bool{true}
+		bfts    = startBFTs([]*Chain{chain}, []*crypto.PrivateKey{privKey}, online)
+	)
+	defer stopBFTs(bfts, online)
+
+	require.Eventually(t, func() bool {
+		return chain.FinalizedHeight() >= 3
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestBFTCommitsWithQuorum(t *testing.T) {
+	keys := []*crypto.PrivateKey{
+		crypto.NewPrivateKeyFromSeedStr(seed),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+	}
+	var (
+		chains = validatorChains(t, keys)
+		start  = chains[0].Height()
+		// one of four equally powered validators is offline, the rest still
+		// hold more than 2/3 of the voting power
+		online = []bool{true, true, true, false}
+		bfts   = startBFTs(chains, keys, online)
+	)
+	require.Eventually(t, func() bool {
+		for i, chain := range chains {
+			if online[i] && chain.FinalizedHeight() < start+5 {
+				return false
+			}
+		}
+		return true
+	}, time.Second*10, time.Millisecond*10)
+
+	stopBFTs(bfts, online)
+
+	height := start + 5
+	for i := 1; i < 3; i++ {
+		a, err := chains[0].GetBlockByHeight(height)
+		require.Nil(t, err)
+		b, err := chains[i].GetBlockByHeight(height)
+		require.Nil(t, err)
+		require.Equal(t, types.HashBlock(a), types.HashBlock(b))
+	}
+	cert, err := chains[0].GetCommit(height)
+	require.Nil(t, err)
+	require.Equal(t, int32(height), cert.Height)
+	require.GreaterOrEqual(t, len(cert.Precommits), 3)
+}
+
+func TestBFTNoQuorum(t *testing.T) {
+	keys := []*crypto.PrivateKey{
+		crypto.NewPrivateKeyFromSeedStr(seed),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+	}
+	var (
+		chains = validatorChains(t, keys)
+		start  = chains[0].Height()
+		online = []bool{true, true, false, false}
+		bfts   = startBFTs(chains, keys, online)
+	)
+	defer stopBFTs(bfts, online)
+
+	time.Sleep(time.Millisecond * 500)
+	require.Equal(t, start, chains[0].Height())
+	require.Equal(t, 0, chains[0].FinalizedHeight())
+}
+
+func TestBFTRecoversLostMessages(t *testing.T) {
+	keys := []*crypto.PrivateKey{
+		crypto.NewPrivateKeyFromSeedStr(seed),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+	}
+	var (
+		chains    = validatorChains(t, keys)
+		start     = chains[0].Height()
+		online    = []bool{true, true, true, true}
+		connected atomic.Bool
+		bfts      = startLinkedBFTs(chains, keys, online, func(from, to int) bool { return connected.Load() })
+	)
+	defer stopBFTs(bfts, online)
+
+	// the first proposal and votes go out before the validators are connected
+	time.Sleep(time.Millisecond * 300)
+	require.Equal(t, start, chains[0].Height())
+	connected.Store(true)
+	require.Eventually(t, func() bool {
+		for _, chain := range chains {
+			if chain.FinalizedHeight() < start+2 {
+				return false
+			}
+		}
+		return true
+	}, time.Second*10, time.Millisecond*10)
+}
+
+func TestBFTLocks(t *testing.T) {
+	keys := []*crypto.PrivateKey{
+		crypto.NewPrivateKeyFromSeedStr(seed),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+		crypto.GeneratePrivateKey(),
+	}
+	var (
+		chains     = validatorChains(t, keys)
+		height     = chains[0].Height() + 1
+		validators = chains[0].Validators()
+		byPubKey   = make(map[string]*crypto.PrivateKey)
+	)
+	for _, key := range keys {
+		byPubKey[string(key.Public().Bytes())] = key
+	}
+	// the validator under test does not propose in the first three rounds
+	mine := 0
+	for i, key := range keys {
+		if bytes.Equal(key.Public().Bytes(), validators.Proposer(height, 3).PublicKey) {
+			mine = i
+		}
+	}
+	var (
+		me    = keys[mine]
+		b     = NewBFT(chains[mine], NewMempool(), NewEvidencePool(), me, zap.NewNop().Sugar(), func(msg any) {})
+		sealA = byPubKey[string(validators.Proposer(height, 0).PublicKey)]
+		sealB = byPubKey[string(validators.Proposer(height, 2).PublicKey)]
+	)
+	b.timeouts = testTimeouts
+	defer b.Stop()
+	sealed := func(key *crypto.PrivateKey) *proto.Block {
+		block, err := newBlock(b.chain, NewMempool(), NewEvidencePool())
+		require.Nil(t, err)
+		types.SignBlock(key, block)
+		return block
+	}
+	propose := func(round int, block *proto.Block) {
+		p := &proto.Proposal{Block: block, Round: int32(round)}
+		types.SignProposal(byPubKey[string(validators.Proposer(height, round).PublicKey)], defaultChainID, p)
+		b.handleProposal(p)
+	}
+	// others votes for the block in the round from count validators but us
+	others := func(voteType proto.VoteType, round int, block *proto.Block, count int) {
+		for _, key := range keys {
+			if key == me || count == 0 {
+				continue
+			}
+			count--
+			v := &proto.Vote{Type: voteType, Height: int32(height), Round: int32(round), BlockHash: types.HashBlock(block)}
+			types.SignVote(key, defaultChainID, v)
+			b.handleVote(v)
+		}
+	}
+	ours := func(voteType proto.VoteType, round int) []byte {
+		v, ok := b.votes[voteKey{round: round, voteType: voteType}][hex.EncodeToString(me.Public().Bytes())]
+		require.True(t, ok)
+		return v.BlockHash
+	}
+	timeout := func(s step) {
+		b.handleTimeout(timeoutEvent{height: height, round: b.round, step: s})
+	}
+	b.startHeight()
+	var (
+		blockA = sealed(sealA)
+		blockB = sealed(sealB)
+	)
+
+	// we lock on A in round 0
+	propose(0, blockA)
+	others(proto.VoteType_PREVOTE, 0, blockA, 2)
+	require.Equal(t, types.HashBlock(blockA), ours(proto.VoteType_PRECOMMIT, 0))
+	timeout(stepPrecommit)
+
+	// the proposer of round 1 proposes A again although it did not seal it,
+	// while the others saw more than 2/3 prevote for B
+	propose(1, blockA)
+	require.Equal(t, types.HashBlock(blockA), ours(proto.VoteType_PREVOTE, 1))
+	others(proto.VoteType_PREVOTE, 1, blockB, 3)
+	timeout(stepPrevote)
+	timeout(stepPrecommit)
+
+	// which frees us to prevote for B once it is proposed
+	propose(2, blockB)
+	require.Equal(t, types.HashBlock(blockB), ours(proto.VoteType_PREVOTE, 2))
+
+	// votes for rounds far ahead are not kept
+	others(proto.VoteType_PREVOTE, 9, blockB, 3)
+	require.Empty(t, b.votes[voteKey{round: 9, voteType: proto.VoteType_PREVOTE}])
+}
+
+func TestVerifyCommit(t *testing.T) {
+	var (
+		chain   = posChain(t)
+		privKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		block   = randomBlock(t, chain)
+	)
+	types.SignBlock(privKey, block)
+	vote := &proto.Vote{
+		Type:      proto.VoteType_PRECOMMIT,
+		Height:    1,
+		BlockHash: types.HashBlock(block),
+	}
+	cert := &proto.CommitCertificate{
+		Height:    1,
+		BlockHash: types.HashBlock(block),
+	}
+	require.NotNil(t, chain.CommitBlock(block, cert))
+
+	// a vote from someone outside the validator set does not count
+	types.SignVote(crypto.GeneratePrivateKey(), defaultChainID, vote)
+	cert.Precommits = []*proto.Vote{vote}
+	require.NotNil(t, chain.CommitBlock(block, cert))
+
+	types.SignVote(privKey, defaultChainID, vote)
+	require.Nil(t, chain.CommitBlock(block, cert))
+	require.Equal(t, 1, chain.FinalizedHeight())
+}
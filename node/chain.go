@@ -2,18 +2,51 @@ package node
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"runtime"
+	"sync"
+	"time"
 
+	"github.com/koshkaj/bloq/consensus"
 	"github.com/koshkaj/bloq/crypto"
 	"github.com/koshkaj/bloq/proto"
 	"github.com/koshkaj/bloq/types"
 )
 
-const seed = "13be19fc5de106d87f9deaec7de204bd5b3a36bb50d66f81fdd5d1482dbeab6e"
+const (
+	// blocks may be timestamped at most this far ahead of the local clock
+	maxClockDrift = time.Minute
+	// most headers served in a single response
+	maxHeaders = 500
+	// signatures remembered as verified
+	sigCacheSize = 100000
+)
+
+// errTxLocked is returned for txs that will become valid once their lock
+// time has passed.
+var errTxLocked = errors.New("tx is time locked")
+
+// stateError is a tx error that depends on the state of the chain, like an
+// output that is already spent or not there yet. The tx may well be valid on
+// the chain of the node that relayed it.
+type stateError struct {
+	error
+}
+
+func (e stateError) Unwrap() error {
+	return e.error
+}
+
+func isStateError(err error) bool {
+	return errors.As(err, &stateError{})
+}
 
 type HeaderList struct {
+	lock    sync.RWMutex
 	headers []*proto.Header
 }
 
@@ -27,18 +60,35 @@ func (list *HeaderList) Height() int {
 	return list.Len() - 1
 }
 
-func (list *HeaderList) Get(index int) *proto.Header {
-	if index > list.Height() {
-		log.Fatal("index too high")
+// Get returns the header at the given height. The height is checked under
+// the same lock as the read, a reorg may truncate the list at any time.
+func (list *HeaderList) Get(index int) (*proto.Header, error) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	if index < 0 || index >= len(list.headers) {
+		return nil, fmt.Errorf("given height [%d] is invalid, current height [%d]", index, len(list.headers)-1)
 	}
-	return list.headers[index]
+	return list.headers[index], nil
 }
 
 func (list *HeaderList) Add(h *proto.Header) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
 	list.headers = append(list.headers, h)
 }
 
+// Truncate drops every header from the given height on.
+func (list *HeaderList) Truncate(height int) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	if height < len(list.headers) {
+		list.headers = list.headers[:height]
+	}
+}
+
 func (list *HeaderList) Len() int {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
 	return len(list.headers)
 }
 
@@ -46,37 +96,630 @@ type UTXO struct {
 	Hash     string
 	OutIndex int
 	Amount   int64
-	Spent    bool
+	Address  []byte
+	// spending condition, set instead of the address
+	Predicate *proto.Predicate
+	Spent     bool
+	// height from which the output can be spent, set for unbonded coins
+	Maturity int
+}
+
+// newUTXOs returns the outputs the tx creates in a block at the given height.
+func newUTXOs(tx *proto.Transaction, height int) []*UTXO {
+	var (
+		hash     = hex.EncodeToString(types.HashTransaction(tx))
+		maturity = 0
+		utxos    = make([]*UTXO, len(tx.Outputs))
+	)
+	if tx.Type == proto.TxType_UNBOND {
+		maturity = height + unbondingDelay
+	}
+	for idx, output := range tx.Outputs {
+		utxos[idx] = &UTXO{
+			Hash:      hash,
+			Amount:    output.Amount,
+			Address:   output.Address,
+			Predicate: output.Predicate,
+			OutIndex:  idx,
+			Spent:     false,
+			Maturity:  maturity,
+		}
+	}
+	return utxos
+}
+
+func (u *UTXO) Key() string {
+	return fmt.Sprintf("%s_%d", u.Hash, u.OutIndex)
+}
+
+// commitment is what the state root commits to for every unspent output.
+func (u *UTXO) commitment() []byte {
+	buf := []byte(u.Key())
+	buf = binary.BigEndian.AppendUint64(buf, uint64(u.Amount))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(u.Maturity))
+	buf = append(buf, u.Address...)
+	if u.Predicate != nil {
+		buf = append(buf, types.EncodePredicate(u.Predicate)...)
+	}
+	return buf
+}
+
+// undoLog collects the inverse of every change a block made to the state, so
+// that the block can be disconnected again during a reorg.
+type undoLog []func()
+
+func (u *undoLog) add(f func()) {
+	*u = append(*u, f)
+}
+
+func (u undoLog) revert() {
+	for i := len(u) - 1; i >= 0; i-- {
+		u[i]()
+	}
 }
 
 type Chain struct {
-	txStore    TXStorer
-	blockStore BlockStorer
-	utxoStore  UTXOStorer
-	headers    *HeaderList
+	txStore     TXStorer
+	blockStore  BlockStorer
+	utxoStore   UTXOStorer
+	commitStore CommitStorer
+	headers     *HeaderList
+	staking     *Staking
+	engine      consensus.Engine
+	chainID     string
+	// serializes validating and adding blocks
+	blockLock sync.Mutex
+	// block hash -> undo log of every block that is not final yet
+	undo map[string]undoLog
+	// signatures verified before, mostly by mempool admission
+	sigCache *types.SigCache
+
+	lock       sync.RWMutex
+	validators *ValidatorSet
+	// height of the first block a validator set commits -> the set, light
+	// clients follow the changes of the set through them
+	validatorSets map[int]*ValidatorSet
+	// tx hash -> hash of the block that included it
+	txBlocks map[string]string
+	// commitment to the set of unspent outputs at the tip
+	state *crypto.MuHash
+	// blocks up to this height carry a commit certificate and are never reverted
+	finalized int
 }
 
 func NewChain(bs BlockStorer, txStore TXStorer) *Chain {
-	chain := &Chain{
-		blockStore: bs,
-		headers:    NewHeaderList(),
-		utxoStore:  NewMemoryUTXOStore(),
-		txStore:    txStore,
+	chain, err := NewChainFromGenesis(DefaultGenesis(), bs, txStore)
+	if err != nil {
+		log.Fatal(err)
 	}
-	chain.addBlock(createGenesisBlock())
 	return chain
 }
 
+func NewChainFromGenesis(g *Genesis, bs BlockStorer, txStore TXStorer) (*Chain, error) {
+	engine, err := g.Engine()
+	if err != nil {
+		return nil, err
+	}
+	chain := &Chain{
+		blockStore:  bs,
+		headers:     NewHeaderList(),
+		utxoStore:   NewMemoryUTXOStore(),
+		commitStore: NewMemoryCommitStore(),
+		txStore:     txStore,
+		staking:     NewStaking(),
+		engine:      engine,
+		chainID:     g.ChainID,
+		state:       crypto.NewMuHash(),
+		txBlocks:    make(map[string]string),
+		undo:        make(map[string]undoLog),
+		sigCache:    types.NewSigCache(sigCacheSize),
+
+		validatorSets: make(map[int]*ValidatorSet),
+	}
+	if err := chain.addBlock(g.Block()); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+func (c *Chain) Engine() consensus.Engine {
+	return c.engine
+}
+
+func (c *Chain) ChainID() string {
+	return c.chainID
+}
+
+// StateRoot returns the commitment to the utxo set at the tip.
+func (c *Chain) StateRoot() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.state.Digest()
+}
+
+// NextStateRoot returns the state root the block has to commit to when it
+// extends the tip.
+func (c *Chain) NextStateRoot(b *proto.Block) ([]byte, error) {
+	state, err := c.nextState(b, c.Height()+1)
+	if err != nil {
+		return nil, err
+	}
+	return state.Digest(), nil
+}
+
+// nextState applies the outputs created, spent and slashed by the block to a
+// copy of the state commitment.
+func (c *Chain) nextState(b *proto.Block, height int) (*crypto.MuHash, error) {
+	c.lock.RLock()
+	state := c.state.Clone()
+	c.lock.RUnlock()
+	var (
+		created = make(map[string]*UTXO)
+		// outputs of the stake unbonded in the block and the validators
+		// slashed in it, evidence burns a share of both
+		unbonded = make(map[string][]*UTXO)
+		jailed   = make(map[string]bool)
+	)
+	for _, tx := range b.Transactions {
+		utxos := newUTXOs(tx, height)
+		for _, utxo := range utxos {
+			state.Add(utxo.commitment())
+			created[utxo.Key()] = utxo
+		}
+		if tx.Type == proto.TxType_UNBOND && tx.Stake != nil {
+			validator := hex.EncodeToString(tx.Stake.Validator)
+			unbonded[validator] = append(unbonded[validator], utxos...)
+		}
+		if tx.Type == proto.TxType_EVIDENCE && tx.Evidence != nil {
+			offender := hex.EncodeToString(tx.Evidence.PublicKey)
+			if !jailed[offender] && !c.staking.Jailed(tx.Evidence.PublicKey) {
+				jailed[offender] = true
+				utxos, err := c.unbondingOutputs(tx.Evidence.PublicKey, height)
+				if err != nil {
+					return nil, err
+				}
+				for _, utxo := range append(utxos, unbonded[offender]...) {
+					state.Remove(utxo.commitment())
+					state.Add(slashed(utxo).commitment())
+				}
+			}
+		}
+		for _, input := range tx.Inputs {
+			key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+			utxo, ok := created[key]
+			if !ok {
+				var err error
+				if utxo, err = c.utxoStore.Get(key); err != nil {
+					return nil, err
+				}
+			}
+			state.Remove(utxo.commitment())
+		}
+	}
+	return state, nil
+}
+
+// Validators returns the validator set of the current epoch.
+func (c *Chain) Validators() *ValidatorSet {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.validators
+}
+
 func (c *Chain) Height() int {
 	return c.headers.Height()
 
 }
 
+func (c *Chain) IsValidator(pubKey []byte) bool {
+	_, ok := c.Validators().Get(pubKey)
+	return ok
+}
+
+// AddBlock extends the tip with the block. Blocks building on an earlier
+// block are kept as side blocks and the chain switches to their branch if
+// the engine's fork choice prefers it.
 func (c *Chain) AddBlock(b *proto.Block) error {
+	return c.connectBlock(b, false)
+}
+
+// AddBlocks adds a run of blocks, as fetched during the initial sync. The
+// checks that do not depend on the state run for all blocks at once on every
+// cpu, while the blocks are still applied one after the other. It returns how
+// many of the blocks were added.
+func (c *Chain) AddBlocks(blocks []*proto.Block) (int, error) {
+	quit := make(chan struct{})
+	defer close(quit)
+	results := c.precheck(blocks, quit)
+	for i, b := range blocks {
+		if err := <-results[i]; err != nil {
+			return i, err
+		}
+		if err := c.connectBlock(b, true); err != nil {
+			return i, err
+		}
+	}
+	return len(blocks), nil
+}
+
+// precheck runs checkBody for the blocks on a pool of workers, the result of
+// every block arrives on its own channel.
+func (c *Chain) precheck(blocks []*proto.Block, quit chan struct{}) []chan error {
+	var (
+		results = make([]chan error, len(blocks))
+		jobs    = make(chan int)
+	)
+	for i := range results {
+		results[i] = make(chan error, 1)
+	}
+	for w := 0; w < runtime.NumCPU(); w++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- c.checkBody(blocks[i])
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range blocks {
+			select {
+			case jobs <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// connectBlock adds the block on top of the tip or as a side block. The body
+// of prechecked blocks has already been checked.
+func (c *Chain) connectBlock(b *proto.Block, prechecked bool) error {
+	c.blockLock.Lock()
+	defer c.blockLock.Unlock()
+	tip, err := c.headers.Get(c.Height())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b.Header.PrevHash, types.HashHeader(tip)) {
+		return c.addSideBlock(b)
+	}
+	if err := c.validateBlock(b, prechecked); err != nil {
+		return err
+	}
+	if err := c.addBlock(b); err != nil {
+		return err
+	}
+	c.setFinalized(c.engine.Finalize(c))
+	return nil
+}
+
+func (c *Chain) FinalizedHeight() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.finalized
+}
+
+// setFinalized moves the finalized height forward and forgets the undo logs
+// of the blocks that can no longer be reverted.
+func (c *Chain) setFinalized(height int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if height > c.Height() {
+		height = c.Height()
+	}
+	for h := c.finalized + 1; h <= height; h++ {
+		header, err := c.headers.Get(h)
+		if err != nil {
+			break
+		}
+		delete(c.undo, hex.EncodeToString(types.HashHeader(header)))
+	}
+	if height > c.finalized {
+		c.finalized = height
+		c.staking.PruneUnbonding(height)
+	}
+}
+
+func (c *Chain) addSideBlock(b *proto.Block) error {
+	hash := hex.EncodeToString(types.HashBlock(b))
+	if _, err := c.blockStore.Get(hash); err == nil {
+		return fmt.Errorf("block %s is already known", hash)
+	}
+	ancestor, branch, err := c.findBranch(b.Header.PrevHash)
+	if err != nil {
+		return err
+	}
+	if ancestor < c.FinalizedHeight() {
+		return fmt.Errorf("block %s forks off below the finalized height %d", hash, c.FinalizedHeight())
+	}
+	reader := &branchReader{
+		Chain:    c,
+		ancestor: ancestor,
+		headers:  headersOf(branch),
+	}
+	parent, err := reader.GetHeader(reader.Height())
+	if err != nil {
+		return err
+	}
+	if err := validateHeader(c.chainID, parent, b.Header); err != nil {
+		return err
+	}
+	if err := c.engine.VerifySeal(reader, b); err != nil {
+		return err
+	}
+	if err := c.blockStore.Put(b); err != nil {
+		return err
+	}
+	branch = append(branch, b)
+	current := make([]*proto.Header, 0, c.Height()-ancestor)
+	for h := ancestor + 1; h <= c.Height(); h++ {
+		header, err := c.headers.Get(h)
+		if err != nil {
+			return err
+		}
+		current = append(current, header)
+	}
+	if !c.engine.ForkChoice(current, headersOf(branch)) {
+		return nil
+	}
+	return c.reorg(ancestor, branch)
+}
+
+// findBranch walks back from the given block until it reaches the main
+// chain. It returns the height of the common ancestor and the side blocks
+// after it, oldest first.
+func (c *Chain) findBranch(hash []byte) (int, []*proto.Block, error) {
+	branch := []*proto.Block{}
+	for {
+		b, err := c.GetBlockByHash(hash)
+		if err != nil {
+			return 0, nil, fmt.Errorf("unknown parent block %s", hex.EncodeToString(hash))
+		}
+		height := int(b.Header.Height)
+		if header, err := c.headers.Get(height); err == nil && bytes.Equal(types.HashHeader(header), hash) {
+			for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+				branch[i], branch[j] = branch[j], branch[i]
+			}
+			return height, branch, nil
+		}
+		branch = append(branch, b)
+		hash = b.Header.PrevHash
+	}
+}
+
+// reorg disconnects every block after the ancestor and connects the branch
+// instead. If a block of the branch is invalid the old blocks are restored.
+func (c *Chain) reorg(ancestor int, branch []*proto.Block) error {
+	old := []*proto.Block{}
+	for c.Height() > ancestor {
+		b, err := c.GetBlockByHeight(c.Height())
+		if err != nil {
+			return err
+		}
+		if err := c.disconnectTip(); err != nil {
+			return err
+		}
+		old = append([]*proto.Block{b}, old...)
+	}
+	for _, b := range branch {
+		err := c.ValidateBlock(b)
+		if err == nil {
+			err = c.addBlock(b)
+		}
+		if err != nil {
+			for c.Height() > ancestor {
+				if err := c.disconnectTip(); err != nil {
+					return err
+				}
+			}
+			for _, b := range old {
+				if err := c.addBlock(b); err != nil {
+					return err
+				}
+			}
+			return fmt.Errorf("reorg to block %s failed: %s", hex.EncodeToString(types.HashBlock(b)), err)
+		}
+	}
+	c.setFinalized(c.engine.Finalize(c))
+	return nil
+}
+
+func (c *Chain) disconnectTip() error {
+	height := c.Height()
+	if height <= c.FinalizedHeight() {
+		return fmt.Errorf("cannot disconnect finalized block at height %d", height)
+	}
+	header, err := c.headers.Get(height)
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(types.HashHeader(header))
+	undo, ok := c.undo[hash]
+	if !ok {
+		return fmt.Errorf("no undo log for block %s", hash)
+	}
+	undo.revert()
+	delete(c.undo, hash)
+	return nil
+}
+
+func headersOf(blocks []*proto.Block) []*proto.Header {
+	headers := make([]*proto.Header, len(blocks))
+	for i, b := range blocks {
+		headers[i] = b.Header
+	}
+	return headers
+}
+
+// branchReader shows the chain as if the side branch was connected after
+// the ancestor, so that side blocks are verified against their own parents.
+type branchReader struct {
+	*Chain
+	ancestor int
+	headers  []*proto.Header
+}
+
+func (r *branchReader) Height() int {
+	return r.ancestor + len(r.headers)
+}
+
+func (r *branchReader) GetHeader(height int) (*proto.Header, error) {
+	if height > r.Height() || height < 0 {
+		return nil, fmt.Errorf("given height [%d] is invalid, current height [%d]", height, r.Height())
+	}
+	if height > r.ancestor {
+		return r.headers[height-r.ancestor-1], nil
+	}
+	return r.Chain.GetHeader(height)
+}
+
+// CommitBlock adds a block that 2/3+ of the voting power precommitted to.
+// The certificate is stored alongside the block, which becomes final.
+func (c *Chain) CommitBlock(b *proto.Block, cert *proto.CommitCertificate) error {
+	if err := c.VerifyCommit(b, cert); err != nil {
+		return err
+	}
+	c.blockLock.Lock()
+	defer c.blockLock.Unlock()
 	if err := c.ValidateBlock(b); err != nil {
 		return err
 	}
-	return c.addBlock(b)
+	if err := c.addBlock(b); err != nil {
+		return err
+	}
+	if err := c.commitStore.Put(cert); err != nil {
+		return err
+	}
+	c.setFinalized(c.Height())
+	return nil
+}
+
+// VerifyCommit checks that the certificate holds valid precommits for the
+// block from more than 2/3 of the voting power of the current validator set.
+func (c *Chain) VerifyCommit(b *proto.Block, cert *proto.CommitCertificate) error {
+	return verifyCommit(c.chainID, c.Validators(), types.HashBlock(b), c.Height()+1, cert)
+}
+
+// verifyCommit checks that the certificate holds valid precommits for the
+// block hash at the height from more than 2/3 of the voting power of the
+// validators.
+func verifyCommit(chainID string, validators *ValidatorSet, hash []byte, height int, cert *proto.CommitCertificate) error {
+	var (
+		signed = make(map[string]bool)
+		power  int64
+	)
+	if cert == nil {
+		return fmt.Errorf("block at height [%d] has no commit", height)
+	}
+	if int(cert.Height) != height {
+		return fmt.Errorf("commit height [%d] does not match next height [%d]", cert.Height, height)
+	}
+	if !bytes.Equal(cert.BlockHash, hash) {
+		return fmt.Errorf("commit is not for block %s", hex.EncodeToString(hash))
+	}
+	for _, vote := range cert.Precommits {
+		if vote.Type != proto.VoteType_PRECOMMIT || vote.Height != cert.Height || vote.Round != cert.Round {
+			return fmt.Errorf("commit contains a vote for another height, round or step")
+		}
+		if !bytes.Equal(vote.BlockHash, hash) {
+			return fmt.Errorf("commit contains a vote for another block")
+		}
+		validator, ok := validators.Get(vote.PublicKey)
+		if !ok {
+			return fmt.Errorf("commit contains a vote from unknown validator %s", hex.EncodeToString(vote.PublicKey))
+		}
+		key := hex.EncodeToString(vote.PublicKey)
+		if signed[key] {
+			return fmt.Errorf("commit contains duplicate votes from validator %s", key)
+		}
+		if !types.VerifyVote(chainID, vote) {
+			return fmt.Errorf("commit contains an invalid vote signature")
+		}
+		signed[key] = true
+		power += validator.Power
+	}
+	if !hasQuorum(power, validators.TotalPower()) {
+		return fmt.Errorf("commit has %d of %d voting power, need more than 2/3", power, validators.TotalPower())
+	}
+	return nil
+}
+
+func (c *Chain) GetCommit(height int) (*proto.CommitCertificate, error) {
+	header, err := c.headers.Get(height)
+	if err != nil {
+		return nil, err
+	}
+	return c.commitStore.Get(hex.EncodeToString(types.HashHeader(header)))
+}
+
+func (c *Chain) GetHeader(height int) (*proto.Header, error) {
+	return c.headers.Get(height)
+}
+
+// GetHeaders returns up to count signed headers starting at the given height.
+func (c *Chain) GetHeaders(from, count int) ([]*proto.SignedHeader, error) {
+	if _, err := c.headers.Get(from); err != nil {
+		return nil, err
+	}
+	if count > maxHeaders {
+		count = maxHeaders
+	}
+	headers := []*proto.SignedHeader{}
+	for h := from; h < from+count && h <= c.Height(); h++ {
+		b, err := c.GetBlockByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		sh := &proto.SignedHeader{
+			Header:    b.Header,
+			PublicKey: b.PublicKey,
+			Signature: b.Signature,
+		}
+		// light clients check the commit of every header against the
+		// validators they follow from genesis
+		if c.engine.Name() == consensus.PoS && h > 0 {
+			if sh.Commit, err = c.commitStore.Get(hex.EncodeToString(types.HashBlock(b))); err != nil {
+				return nil, err
+			}
+			c.lock.RLock()
+			if vs, ok := c.validatorSets[h]; ok {
+				sh.Validators = vs.Proto()
+			}
+			c.lock.RUnlock()
+		}
+		headers = append(headers, sh)
+	}
+	return headers, nil
+}
+
+// GetTxProof returns the merkle branch of a tx included in the chain.
+func (c *Chain) GetTxProof(txHash []byte) (*proto.TxProof, error) {
+	c.lock.RLock()
+	blockHash, ok := c.txBlocks[hex.EncodeToString(txHash)]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("tx %s is not included in the chain", hex.EncodeToString(txHash))
+	}
+	b, err := c.blockStore.Get(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	for i, tx := range b.Transactions {
+		if !bytes.Equal(types.HashTransaction(tx), txHash) {
+			continue
+		}
+		proof, err := types.GetMerkleProof(b, i)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.TxProof{
+			TxHash: txHash,
+			Height: b.Header.Height,
+			Proof:  proof,
+		}, nil
+	}
+	return nil, fmt.Errorf("block %s does not contain tx %s", blockHash, hex.EncodeToString(txHash))
 }
 
 func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
@@ -85,85 +728,370 @@ func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
 }
 
 func (c *Chain) GetBlockByHeight(height int) (*proto.Block, error) {
-	if c.Height() < height {
-		return nil, fmt.Errorf("given height [%d] is invalid, current height [%d]", height, c.Height())
+	header, err := c.headers.Get(height)
+	if err != nil {
+		return nil, err
 	}
-	header := c.headers.Get(height)
-	hash := types.HashHeader(header)
-	return c.GetBlockByHash(hash)
+	return c.GetBlockByHash(types.HashHeader(header))
 }
 
 func (c *Chain) ValidateBlock(b *proto.Block) error {
-	if !types.VerifyBlock(b) {
-		return fmt.Errorf("invalid block signature")
-	}
+	return c.validateBlock(b, false)
+}
 
-	currentBlock, err := c.GetBlockByHeight(c.Height())
+func (c *Chain) validateBlock(b *proto.Block, prechecked bool) error {
+	tip, err := c.headers.Get(c.Height())
 	if err != nil {
 		return err
 	}
-	currentBlockHash := types.HashBlock(currentBlock)
-	if !bytes.Equal(currentBlockHash, b.Header.PrevHash) {
-		return fmt.Errorf("invalid previous block hash")
+	if err := validateHeader(c.chainID, tip, b.Header); err != nil {
+		return err
+	}
+	if err := c.engine.VerifySeal(c, b); err != nil {
+		return err
 	}
+	if !prechecked {
+		if err := c.checkBody(b); err != nil {
+			return err
+		}
+	}
+	var (
+		spent   = make(map[string]bool)
+		changes = make(stakeChanges)
+	)
 	for _, tx := range b.Transactions {
-		if err := c.ValidateTransaction(tx); err != nil {
+		if err := c.validateTxState(tx); err != nil {
 			return err
 		}
+		if err := c.checkStakeChanges(tx, changes); err != nil {
+			return err
+		}
+		changes.add(tx)
+		for _, input := range tx.Inputs {
+			key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+			if spent[key] {
+				return fmt.Errorf("block spends output %s twice", key)
+			}
+			spent[key] = true
+		}
+	}
+	root, err := c.NextStateRoot(b)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, b.Header.StateRoot) {
+		return fmt.Errorf("invalid state root")
+	}
+	return nil
+}
+
+// checkBody runs the checks of the block that do not depend on the state of
+// the chain. The signatures are verified in parallel up front. They are not
+// added to the cache, which holds the txs of the mempool, a block that turns
+// out invalid must not flush those.
+func (c *Chain) checkBody(b *proto.Block) error {
+	if !types.VerifyBody(b) {
+		return fmt.Errorf("block transactions do not match the header")
+	}
+	if !types.VerifyTransactions(c.chainID, b.Transactions, c.sigCache) {
+		return fmt.Errorf("invalid tx signature")
+	}
+	return nil
+}
+
+// validateHeader checks that the header directly follows its parent.
+func validateHeader(chainID string, parent, header *proto.Header) error {
+	if !bytes.Equal(types.HashHeader(parent), header.PrevHash) {
+		return fmt.Errorf("invalid previous block hash")
+	}
+	if header.Height != parent.Height+1 {
+		return fmt.Errorf("invalid block height [%d], expected [%d]", header.Height, parent.Height+1)
+	}
+	if header.ChainID != chainID {
+		return fmt.Errorf("block is for chain [%s], expected [%s]", header.ChainID, chainID)
+	}
+	if header.Timestamp <= parent.Timestamp {
+		return fmt.Errorf("block timestamp is not after its parent's")
+	}
+	if time.Unix(0, header.Timestamp).After(time.Now().Add(maxClockDrift)) {
+		return fmt.Errorf("block timestamp is too far in the future")
 	}
 	return nil
 }
 
+// ValidateTransaction checks a tx against the next block. Once it is valid
+// its signatures are cached, so that they are not verified again when the tx
+// arrives in a block.
 func (c *Chain) ValidateTransaction(tx *proto.Transaction) error {
-	if !types.VerifyTransaction(tx) {
+	txx := []*proto.Transaction{tx}
+	if !types.VerifyTransactions(c.chainID, txx, c.sigCache) {
 		return fmt.Errorf("invalid tx signature")
 	}
+	if err := c.validateTxState(tx); err != nil {
+		return err
+	}
+	types.CacheTransactions(c.chainID, txx, c.sigCache)
+	return nil
+}
+
+// validateTxState runs the checks of the tx that depend on the state of the
+// chain, its signatures have to be verified already.
+func (c *Chain) validateTxState(tx *proto.Transaction) error {
 	var (
-		nIutputs   = len(tx.Inputs)
-		hash       = types.HashTransaction(tx)
-		sumInputs  = 0
-		sumOutputs = 0
+		hash       = hex.EncodeToString(types.HashTransaction(tx))
+		sumInputs  int64
+		sumOutputs int64
 	)
-
-	for i := 0; i < nIutputs; i++ {
-		prevHash := hex.EncodeToString(tx.Inputs[i].PrevTxHash)
-		key := fmt.Sprintf("%s_%d", prevHash, i)
+	if _, err := c.txStore.Get(hash); err == nil {
+		return stateError{fmt.Errorf("tx %s is already included in the chain", hash)}
+	}
+	for i, input := range tx.Inputs {
+		prevHash := hex.EncodeToString(input.PrevTxHash)
+		key := fmt.Sprintf("%s_%d", prevHash, input.PrevOutIndex)
 		utxo, err := c.utxoStore.Get(key)
-		sumInputs += int(utxo.Amount)
 		if err != nil {
-			return err
+			return stateError{err}
 		}
 		if utxo.Spent {
-			return fmt.Errorf("input %d of tx %s is already spent", i, hash)
+			return stateError{fmt.Errorf("input %d of tx %s is already spent", i, hash)}
+		}
+		if utxo.Maturity > c.Height()+1 {
+			return stateError{fmt.Errorf("input %d of tx %s can not be spent before height %d", i, hash, utxo.Maturity)}
+		}
+		if !canSpend(tx, input, utxo) {
+			return fmt.Errorf("input %d of tx %s does not satisfy the output it spends", i, hash)
 		}
+		sumInputs += utxo.Amount
 	}
-	for _, output := range tx.Outputs {
-		sumOutputs += int(output.Amount)
+	for i, output := range tx.Outputs {
+		if output.Predicate != nil {
+			if len(output.Address) != 0 {
+				return fmt.Errorf("output %d of tx %s has both an address and a predicate", i, hash)
+			}
+			if err := types.ValidatePredicate(output.Predicate); err != nil {
+				return fmt.Errorf("output %d of tx %s: %w", i, hash, err)
+			}
+		}
+		sumOutputs += output.Amount
 	}
-	if sumInputs < sumOutputs {
+	switch tx.Type {
+	case proto.TxType_TRANSFER:
+		if sumInputs < sumOutputs {
+			return fmt.Errorf("insufficient balance")
+		}
+	case proto.TxType_EVIDENCE:
+		if err := c.validateEvidence(tx); err != nil {
+			return err
+		}
+	default:
+		if err := c.validateStake(tx, sumInputs, sumOutputs); err != nil {
+			return err
+		}
+	}
+	// the lock time comes last, only txs that are valid apart from it get
+	// parked until it passes
+	if err := c.checkLockTime(tx); err != nil {
+		return fmt.Errorf("tx %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+// canSpend checks that the input is allowed to spend the utxo. Plain outputs
+// are spent by the key of their address, the signature itself is checked by
+// types.VerifyTransaction. Predicate outputs take no more witness data than
+// they need.
+func canSpend(tx *proto.Transaction, input *proto.TxInput, utxo *UTXO) bool {
+	if utxo.Predicate != nil {
+		return len(input.PublicKey) == 0 && types.SatisfiesPredicate(utxo.Predicate, tx, input)
+	}
+	if len(input.PublicKey) != crypto.PubKeyLen {
+		return false
+	}
+	return bytes.Equal(crypto.PublicKeyFromBytes(input.PublicKey).Address().Bytes(), utxo.Address)
+}
+
+// checkLockTime checks that the tx can be included in the next block. Time
+// locks are compared to the timestamp of the tip, which every node agrees on.
+func (c *Chain) checkLockTime(tx *proto.Transaction) error {
+	tip, err := c.headers.Get(c.Height())
+	if err != nil {
+		return err
+	}
+	var (
+		height = uint64(tip.Height + 1)
+		now    = uint64(tip.Timestamp / int64(time.Second))
+	)
+	if tx.Expiry != 0 && height > tx.Expiry {
+		return stateError{fmt.Errorf("expired at height %d", tx.Expiry)}
+	}
+	switch {
+	case tx.LockTime == 0:
+	case tx.LockTime < types.LockTimeThreshold && height < tx.LockTime:
+		return fmt.Errorf("%w until height %d", errTxLocked, tx.LockTime)
+	case tx.LockTime >= types.LockTimeThreshold && now < tx.LockTime:
+		return fmt.Errorf("%w until %s", errTxLocked, time.Unix(int64(tx.LockTime), 0).UTC())
+	}
+	return nil
+}
+
+func (c *Chain) validateStake(tx *proto.Transaction, sumInputs, sumOutputs int64) error {
+	var (
+		stake     = tx.Stake
+		validator = stake.Validator
+		staker    = stake.PublicKey
+	)
+	if stake.Amount <= 0 {
+		return fmt.Errorf("invalid stake amount %d", stake.Amount)
+	}
+	switch tx.Type {
+	case proto.TxType_BOND:
+		if !bytes.Equal(validator, staker) {
+			return fmt.Errorf("validators can only bond their own stake, use delegate instead")
+		}
+		if c.staking.SelfStake(validator)+stake.Amount < minValidatorStake {
+			return stateError{fmt.Errorf("validator stake must be at least %d", minValidatorStake)}
+		}
+	case proto.TxType_DELEGATE:
+		if bytes.Equal(validator, staker) {
+			return fmt.Errorf("validators can not delegate to themselves, use bond instead")
+		}
+		if c.staking.SelfStake(validator) < minValidatorStake {
+			return stateError{fmt.Errorf("delegating to unknown validator %s", hex.EncodeToString(validator))}
+		}
+	case proto.TxType_UNBOND:
+		if len(tx.Inputs) > 0 {
+			return fmt.Errorf("unbond tx can not have inputs")
+		}
+		if bonded := c.staking.Bonded(validator, staker); bonded < stake.Amount {
+			return stateError{fmt.Errorf("cannot unbond %d, only %d is bonded", stake.Amount, bonded)}
+		}
+		if sumOutputs > stake.Amount {
+			return fmt.Errorf("unbond outputs exceed the unbonded amount")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown tx type %d", tx.Type)
+	}
+	if sumInputs < sumOutputs+stake.Amount {
 		return fmt.Errorf("insufficient balance")
 	}
+	return nil
+}
+
+// stakeChanges sums what the txs of a block bonded and unbonded so far, by
+// validator and staker.
+type stakeChanges map[string]int64
+
+func stakeKey(validator, staker []byte) string {
+	return fmt.Sprintf("%s_%s", hex.EncodeToString(validator), hex.EncodeToString(staker))
+}
 
+func (s stakeChanges) add(tx *proto.Transaction) {
+	switch tx.Type {
+	case proto.TxType_BOND, proto.TxType_DELEGATE:
+		s[stakeKey(tx.Stake.Validator, tx.Stake.PublicKey)] += tx.Stake.Amount
+	case proto.TxType_UNBOND:
+		s[stakeKey(tx.Stake.Validator, tx.Stake.PublicKey)] -= tx.Stake.Amount
+	}
+}
+
+// checkStakeChanges runs the stake checks of validateStake again on the stake
+// the block left, validateStake only sees the stake before the block. Two
+// unbonds of the block can not take out the same stake like that.
+func (c *Chain) checkStakeChanges(tx *proto.Transaction, changes stakeChanges) error {
+	if tx.Stake == nil {
+		return nil
+	}
+	var (
+		stake     = tx.Stake
+		validator = stake.Validator
+		selfStake = c.staking.SelfStake(validator) + changes[stakeKey(validator, validator)]
+	)
+	switch tx.Type {
+	case proto.TxType_BOND:
+		if selfStake+stake.Amount < minValidatorStake {
+			return fmt.Errorf("validator stake must be at least %d", minValidatorStake)
+		}
+	case proto.TxType_DELEGATE:
+		if selfStake < minValidatorStake {
+			return fmt.Errorf("delegating to validator %s that unbonds in the same block", hex.EncodeToString(validator))
+		}
+	case proto.TxType_UNBOND:
+		bonded := c.staking.Bonded(validator, stake.PublicKey) + changes[stakeKey(validator, stake.PublicKey)]
+		if bonded < stake.Amount {
+			return fmt.Errorf("cannot unbond %d, only %d is left bonded in the block", stake.Amount, bonded)
+		}
+	}
 	return nil
 }
 
-func (c *Chain) addBlock(b *proto.Block) error {
+func (c *Chain) validateEvidence(tx *proto.Transaction) error {
+	if len(tx.Inputs) > 0 || len(tx.Outputs) > 0 {
+		return fmt.Errorf("evidence tx can not have inputs or outputs")
+	}
+	ev := tx.Evidence
+	if ev == nil || ev.HeaderA == nil || ev.HeaderB == nil {
+		return fmt.Errorf("evidence tx is missing a header")
+	}
+	// the headers verify against the chain id they carry, evidence from
+	// another chain would pass otherwise
+	if ev.HeaderA.ChainID != c.chainID || ev.HeaderB.ChainID != c.chainID {
+		return fmt.Errorf("evidence is for chain [%s], expected [%s]", ev.HeaderA.ChainID, c.chainID)
+	}
+	offender := hex.EncodeToString(ev.PublicKey)
+	if int(ev.HeaderA.Height) <= c.Height()-evidenceMaxAge {
+		return stateError{fmt.Errorf("evidence against %s is too old", offender)}
+	}
+	if c.staking.Jailed(ev.PublicKey) {
+		return stateError{fmt.Errorf("validator %s is already slashed", offender)}
+	}
+	// stake that is still unbonding answers for the validator too
+	if c.staking.Slashable(ev.PublicKey, c.Height()+1) == 0 {
+		return stateError{fmt.Errorf("evidence against %s who has nothing at stake", offender)}
+	}
+	return nil
+}
+
+func (c *Chain) addBlock(b *proto.Block) (err error) {
+	var undo undoLog
 	c.headers.Add(b.Header)
+	height := c.Height()
+	undo.add(func() { c.headers.Truncate(height) })
+	defer func() {
+		if err != nil {
+			undo.revert()
+			return
+		}
+		if height > c.FinalizedHeight() {
+			c.undo[hex.EncodeToString(types.HashBlock(b))] = undo
+		}
+	}()
+	state, err := c.nextState(b, height)
+	if err != nil {
+		return err
+	}
+	blockHash := hex.EncodeToString(types.HashBlock(b))
 	for _, tx := range b.Transactions {
+		hash := hex.EncodeToString(types.HashTransaction(tx))
 		if err := c.txStore.Put(tx); err != nil {
 			return err
 		}
-		for idx, output := range tx.Outputs {
-			hash := hex.EncodeToString(types.HashTransaction(tx))
-			utxo := &UTXO{
-				Hash:     hash,
-				Amount:   output.Amount,
-				OutIndex: idx,
-				Spent:    false,
-			}
+		c.lock.Lock()
+		c.txBlocks[hash] = blockHash
+		c.lock.Unlock()
+		undo.add(func() {
+			c.txStore.Delete(hash)
+			c.lock.Lock()
+			delete(c.txBlocks, hash)
+			c.lock.Unlock()
+		})
+		for _, utxo := range newUTXOs(tx, height) {
 			if err := c.utxoStore.Put(utxo); err != nil {
 				return err
 			}
+			key := utxo.Key()
+			undo.add(func() { c.utxoStore.Delete(key) })
 		}
 		for _, input := range tx.Inputs {
 			key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
@@ -175,31 +1103,130 @@ func (c *Chain) addBlock(b *proto.Block) error {
 			if err := c.utxoStore.Put(utxo); err != nil {
 				return err
 			}
+			undo.add(func() {
+				utxo.Spent = false
+				c.utxoStore.Put(utxo)
+			})
+		}
+		if err := c.applyStake(tx, height, &undo); err != nil {
+			return err
 		}
 	}
+	if height%epochLength == 0 {
+		c.setValidators(c.staking.ValidatorSet(height), &undo)
+	}
+	c.lock.Lock()
+	prev := c.state
+	c.state = state
+	c.lock.Unlock()
+	undo.add(func() {
+		c.lock.Lock()
+		c.state = prev
+		c.lock.Unlock()
+	})
 
 	return c.blockStore.Put(b)
 }
 
-func createGenesisBlock() *proto.Block {
-	privKey := crypto.NewPrivateKeyFromSeedStr(seed)
-	block := &proto.Block{
-		Header: &proto.Header{
-			Version: 1,
-		},
+// unbondingOutputs returns the outputs of the stake that is still unbonding
+// from the validator at the given height.
+func (c *Chain) unbondingOutputs(validator []byte, height int) ([]*UTXO, error) {
+	utxos := []*UTXO{}
+	for _, u := range c.staking.Unbonding(validator, height) {
+		for _, key := range u.outputKeys() {
+			utxo, err := c.utxoStore.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			utxos = append(utxos, utxo)
+		}
 	}
-	tx := &proto.Transaction{
-		Version: 1,
-		Inputs:  []*proto.TxInput{},
-		Outputs: []*proto.TxOutput{
-			{
-				Amount:  8888,
-				Address: privKey.Public().Address().Bytes(),
-			},
-		},
+	return utxos, nil
+}
+
+// slashed returns the output with slashPercent of its amount burned.
+func slashed(utxo *UTXO) *UTXO {
+	burned := *utxo
+	burned.Amount -= utxo.Amount * slashPercent / 100
+	return &burned
+}
+
+// slashUnbonding burns the share of the stake that left the validator but
+// can not be spent yet, unbonding right after misbehaving does not escape
+// the penalty.
+func (c *Chain) slashUnbonding(validator []byte, height int, undo *undoLog) error {
+	utxos, err := c.unbondingOutputs(validator, height)
+	if err != nil {
+		return err
+	}
+	for _, utxo := range utxos {
+		if err := c.utxoStore.Put(slashed(utxo)); err != nil {
+			return err
+		}
+		utxo := utxo
+		undo.add(func() { c.utxoStore.Put(utxo) })
 	}
-	block.Transactions = append(block.Transactions, tx)
-	types.SignBlock(privKey, block)
+	return nil
+}
+
+// setValidators makes the set commit the blocks after the tip.
+func (c *Chain) setValidators(validators *ValidatorSet, undo *undoLog) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var (
+		height      = c.headers.Height() + 1
+		prev        = c.validators
+		prevSet, ok = c.validatorSets[height]
+	)
+	c.validators = validators
+	c.validatorSets[height] = validators
+	undo.add(func() {
+		c.lock.Lock()
+		c.validators = prev
+		if ok {
+			c.validatorSets[height] = prevSet
+		} else {
+			delete(c.validatorSets, height)
+		}
+		c.lock.Unlock()
+	})
+}
 
-	return block
+func (c *Chain) applyStake(tx *proto.Transaction, height int, undo *undoLog) error {
+	switch tx.Type {
+	case proto.TxType_BOND, proto.TxType_DELEGATE:
+		stake := tx.Stake
+		c.staking.Bond(stake.Validator, stake.PublicKey, stake.Amount)
+		undo.add(func() { c.staking.Unbond(stake.Validator, stake.PublicKey, stake.Amount) })
+	case proto.TxType_UNBOND:
+		stake := tx.Stake
+		if err := c.staking.Unbond(stake.Validator, stake.PublicKey, stake.Amount); err != nil {
+			return err
+		}
+		undo.add(func() { c.staking.Bond(stake.Validator, stake.PublicKey, stake.Amount) })
+		u := &unbonding{
+			txHash:   hex.EncodeToString(types.HashTransaction(tx)),
+			outputs:  len(tx.Outputs),
+			maturity: height + unbondingDelay,
+		}
+		for _, output := range tx.Outputs {
+			u.amount += output.Amount
+		}
+		c.staking.AddUnbonding(stake.Validator, u)
+		undo.add(func() { c.staking.RemoveUnbonding(stake.Validator, u.txHash) })
+	case proto.TxType_EVIDENCE:
+		offender := tx.Evidence.PublicKey
+		if !c.staking.Jailed(offender) {
+			if err := c.slashUnbonding(offender, height, undo); err != nil {
+				return err
+			}
+		}
+		snap := c.staking.snapshot(offender)
+		c.staking.Slash(offender)
+		undo.add(func() { c.staking.restore(offender, snap) })
+		// a slashed validator leaves the set right away instead of at the
+		// end of the epoch
+		c.setValidators(c.Validators().Without(offender), undo)
+	}
+	return nil
 }
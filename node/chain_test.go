@@ -1,7 +1,9 @@
 package node
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/koshkaj/bloq/crypto"
 	"github.com/koshkaj/bloq/proto"
@@ -11,16 +13,28 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func randomBlock(t *testing.T, chain *Chain) *proto.Block {
-	privKey := crypto.GeneratePrivateKey()
+func randomBlock(t testing.TB, chain *Chain) *proto.Block {
+	privKey := crypto.NewPrivateKeyFromSeedStr(seed)
 	b := util.RandomBlock()
 	prevBlock, err := chain.GetBlockByHeight(chain.Height())
 	require.Nil(t, err)
 	b.Header.PrevHash = types.HashBlock(prevBlock)
+	b.Header.Height = prevBlock.Header.Height + 1
+	b.Header.ChainID = chain.ChainID()
+	if b.Header.Timestamp <= prevBlock.Header.Timestamp {
+		b.Header.Timestamp = prevBlock.Header.Timestamp + 1
+	}
+	b.Header.StateRoot = chain.StateRoot()
 	types.SignBlock(privKey, b)
 	return b
 }
 
+func setStateRoot(t testing.TB, chain *Chain, b *proto.Block) {
+	root, err := chain.NextStateRoot(b)
+	require.Nil(t, err)
+	b.Header.StateRoot = root
+}
+
 func TestNewChain(t *testing.T) {
 	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
 	require.Equal(t, 0, chain.Height())
@@ -55,6 +69,22 @@ func TestChainHeight(t *testing.T) {
 	}
 }
 
+func TestGetPastTip(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	for i := 0; i < 3; i++ {
+		require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	}
+	// a reorg can drop headers between a height check and the lookup
+	chain.headers.Truncate(2)
+	_, err := chain.GetBlockByHeight(3)
+	require.NotNil(t, err)
+	_, err = chain.GetHeader(-1)
+	require.NotNil(t, err)
+	headers, err := chain.GetHeaders(0, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(headers))
+}
+
 func TestAddBlockWithTx(t *testing.T) {
 	var (
 		privKey   = crypto.NewPrivateKeyFromSeedStr(seed)
@@ -62,7 +92,7 @@ func TestAddBlockWithTx(t *testing.T) {
 		block     = randomBlock(t, chain)
 		recipient = crypto.GeneratePrivateKey().Public().Address().Bytes()
 	)
-	ftt, err := chain.txStore.Get("3621faa661c206054d614eaa103687095e6dc8722bb31a03143bd3deeb0613b0") // Genisis Transaction
+	ftt, err := chain.txStore.Get("2f32f445146ed10298b064e1f285ab18b98b83b2e8e5d6d0dad01ca7099b0e9d") // Genisis Transaction
 	assert.Nil(t, err)
 
 	inputs := []*proto.TxInput{
@@ -88,10 +118,11 @@ func TestAddBlockWithTx(t *testing.T) {
 		Inputs:  inputs,
 		Outputs: outputs,
 	}
-	sig := types.SignTransaction(privKey, tx)
+	sig := types.SignTransaction(privKey, defaultChainID, tx)
 	tx.Inputs[0].Signature = sig.Bytes()
 
 	block.Transactions = append(block.Transactions, tx)
+	setStateRoot(t, chain, block)
 	types.SignBlock(privKey, block)
 	require.Nil(t, chain.AddBlock(block))
 }
@@ -103,7 +134,7 @@ func TestAddBlockWithTxLowFunds(t *testing.T) {
 		block     = randomBlock(t, chain)
 		recipient = crypto.GeneratePrivateKey().Public().Address().Bytes()
 	)
-	ftt, err := chain.txStore.Get("3621faa661c206054d614eaa103687095e6dc8722bb31a03143bd3deeb0613b0") // Genisis Transaction
+	ftt, err := chain.txStore.Get("2f32f445146ed10298b064e1f285ab18b98b83b2e8e5d6d0dad01ca7099b0e9d") // Genisis Transaction
 	assert.Nil(t, err)
 
 	inputs := []*proto.TxInput{
@@ -125,9 +156,307 @@ func TestAddBlockWithTxLowFunds(t *testing.T) {
 		Inputs:  inputs,
 		Outputs: outputs,
 	}
-	sig := types.SignTransaction(privKey, tx)
+	sig := types.SignTransaction(privKey, defaultChainID, tx)
 	tx.Inputs[0].Signature = sig.Bytes()
 
 	block.Transactions = append(block.Transactions, tx)
 	require.NotNil(t, chain.AddBlock(block))
 }
+
+func TestAuthorityRejectsOtherSigners(t *testing.T) {
+	var (
+		chain = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		block = randomBlock(t, chain)
+	)
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+	require.NotNil(t, chain.AddBlock(block))
+	require.NotNil(t, chain.Engine().Seal(context.Background(), block, crypto.GeneratePrivateKey()))
+
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(seed), block)
+	require.Nil(t, chain.AddBlock(block))
+}
+
+func TestValidateBlockHeader(t *testing.T) {
+	var (
+		chain     = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey   = crypto.NewPrivateKeyFromSeedStr(seed)
+		parent, _ = chain.headers.Get(0)
+	)
+	tests := map[string]func(h *proto.Header){
+		"height":   func(h *proto.Header) { h.Height = 5 },
+		"chain id": func(h *proto.Header) { h.ChainID = "other" },
+		"past":     func(h *proto.Header) { h.Timestamp = parent.Timestamp },
+		"future":   func(h *proto.Header) { h.Timestamp = time.Now().Add(maxClockDrift * 2).UnixNano() },
+	}
+	for name, tamper := range tests {
+		block := randomBlock(t, chain)
+		tamper(block.Header)
+		types.SignBlock(privKey, block)
+		require.NotNil(t, chain.AddBlock(block), name)
+	}
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	require.Equal(t, 1, chain.Height())
+}
+
+func TestStateRoot(t *testing.T) {
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		genesis = chain.StateRoot()
+		staker  = crypto.GeneratePrivateKey()
+		bond    = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	)
+	// a block without txs leaves the utxo set as it is
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	require.Equal(t, genesis, chain.StateRoot())
+
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, bond)
+	types.SignBlock(privKey, block)
+	require.NotNil(t, chain.AddBlock(block))
+
+	setStateRoot(t, chain, block)
+	types.SignBlock(privKey, block)
+	require.Nil(t, chain.AddBlock(block))
+	require.Equal(t, block.Header.StateRoot, chain.StateRoot())
+	require.NotEqual(t, genesis, chain.StateRoot())
+}
+
+func TestSigCacheHoldsValidTxsOnly(t *testing.T) {
+	var (
+		chain    = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey  = crypto.NewPrivateKeyFromSeedStr(seed)
+		staker   = crypto.GeneratePrivateKey()
+		bond     = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+		delegate = stakeTx(t, chain, proto.TxType_DELEGATE, staker, crypto.GeneratePrivateKey().Public().Bytes(), minValidatorStake)
+	)
+	// the signatures of an invalid block are verified but not cached
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, bond)
+	types.SignBlock(privKey, block)
+	require.NotNil(t, chain.AddBlock(block))
+	require.Equal(t, 0, chain.sigCache.Len())
+
+	require.NotNil(t, chain.ValidateTransaction(delegate))
+	require.Equal(t, 0, chain.sigCache.Len())
+	require.Nil(t, chain.ValidateTransaction(bond))
+	require.Equal(t, 2, chain.sigCache.Len())
+}
+
+func TestBlockDoubleSpend(t *testing.T) {
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		keyA    = crypto.GeneratePrivateKey()
+		keyB    = crypto.GeneratePrivateKey()
+		// both bonds are funded by the same genesis output
+		a = stakeTx(t, chain, proto.TxType_BOND, keyA, keyA.Public().Bytes(), minValidatorStake)
+		b = stakeTx(t, chain, proto.TxType_BOND, keyB, keyB.Public().Bytes(), minValidatorStake)
+	)
+	require.Nil(t, chain.ValidateTransaction(a))
+	require.Nil(t, chain.ValidateTransaction(b))
+
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, a, b)
+	setStateRoot(t, chain, block)
+	types.SignBlock(privKey, block)
+	require.ErrorContains(t, chain.AddBlock(block), "twice")
+}
+
+func TestRejectTxFromOtherChain(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		staker     = crypto.GeneratePrivateKey()
+		tx         = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	)
+	require.Nil(t, chain.ValidateTransaction(tx))
+
+	tx.Stake.Signature = types.SignTransaction(staker, "testnet", tx).Bytes()
+	tx.Inputs[0].Signature = types.SignTransaction(genesisKey, "testnet", tx).Bytes()
+	require.NotNil(t, chain.ValidateTransaction(tx))
+}
+
+func lockedTx(t *testing.T, chain *Chain, lockTime, expiry uint64) *proto.Transaction {
+	var (
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		staker     = crypto.GeneratePrivateKey()
+		tx         = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	)
+	tx.LockTime = lockTime
+	tx.Expiry = expiry
+	tx.Stake.Signature = types.SignTransaction(staker, defaultChainID, tx).Bytes()
+	tx.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, tx).Bytes()
+	return tx
+}
+
+func TestTxHeightLock(t *testing.T) {
+	var (
+		chain = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		tx    = lockedTx(t, chain, 3, 0)
+	)
+	require.ErrorIs(t, chain.ValidateTransaction(tx), errTxLocked)
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	require.ErrorIs(t, chain.ValidateTransaction(tx), errTxLocked)
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	// the tx can go into block 3
+	require.Nil(t, chain.ValidateTransaction(tx))
+}
+
+func TestTxTimeLock(t *testing.T) {
+	var (
+		chain  = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		unlock = time.Now().Unix() + 10
+		tx     = lockedTx(t, chain, uint64(unlock), 0)
+	)
+	require.ErrorIs(t, chain.ValidateTransaction(tx), errTxLocked)
+
+	block := randomBlock(t, chain)
+	block.Header.Timestamp = unlock * int64(time.Second)
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(seed), block)
+	require.Nil(t, chain.AddBlock(block))
+	require.Nil(t, chain.ValidateTransaction(tx))
+}
+
+func TestTxLockedWithUnknownInput(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		staker     = crypto.GeneratePrivateKey()
+		tx         = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	)
+	// a made up input fails right away instead of being parked
+	tx.LockTime = 1 << 30
+	tx.Inputs[0].PrevTxHash = util.RandomHash()
+	tx.Stake.Signature = types.SignTransaction(staker, defaultChainID, tx).Bytes()
+	tx.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, tx).Bytes()
+	err := chain.ValidateTransaction(tx)
+	require.NotNil(t, err)
+	require.NotErrorIs(t, err, errTxLocked)
+}
+
+func TestTxExpiry(t *testing.T) {
+	var (
+		chain = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		tx    = lockedTx(t, chain, 0, 1)
+	)
+	require.Nil(t, chain.ValidateTransaction(tx))
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	err := chain.ValidateTransaction(tx)
+	require.NotNil(t, err)
+	require.NotErrorIs(t, err, errTxLocked)
+}
+
+func TestMultisigTreasury(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		custody    = []*crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+		treasury   = types.NewMultisig(2, custody[0].Public(), custody[1].Public(), custody[2].Public())
+	)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	fund := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: types.HashTransaction(genesis.Transactions[0]),
+				PublicKey:  genesisKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{{Amount: 1000, Predicate: treasury}},
+	}
+	fund.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, fund).Bytes()
+	addTxBlock(t, chain, fund)
+
+	input := &proto.TxInput{PrevTxHash: types.HashTransaction(fund)}
+	spend := &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{input},
+		Outputs: []*proto.TxOutput{{Amount: 1000, Address: genesisKey.Public().Address().Bytes()}},
+	}
+	types.AddWitness(custody[1], defaultChainID, spend, input)
+	require.NotNil(t, chain.ValidateTransaction(spend))
+
+	// the key of an address can not spend the treasury on its own
+	input.PublicKey = custody[1].Public().Bytes()
+	input.Signature = input.Witnesses[0].Signature
+	input.Witnesses = nil
+	require.NotNil(t, chain.ValidateTransaction(spend))
+
+	input.PublicKey, input.Signature = nil, nil
+	types.AddWitness(custody[1], defaultChainID, spend, input)
+	types.AddWitness(custody[2], defaultChainID, spend, input)
+	require.Nil(t, chain.ValidateTransaction(spend))
+	addTxBlock(t, chain, spend)
+}
+
+func TestSpendRequiresOwner(t *testing.T) {
+	var (
+		chain = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		thief = crypto.GeneratePrivateKey()
+	)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: types.HashTransaction(genesis.Transactions[0]),
+				PublicKey:  thief.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{{Amount: 1, Address: thief.Public().Address().Bytes()}},
+	}
+	tx.Inputs[0].Signature = types.SignTransaction(thief, defaultChainID, tx).Bytes()
+	require.ErrorContains(t, chain.ValidateTransaction(tx), "does not satisfy")
+}
+
+func TestTxHashCanNotBeChanged(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		custody    = []*crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+		treasury   = types.NewMultisig(1, custody[0].Public(), custody[1].Public())
+	)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	fund := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: types.HashTransaction(genesis.Transactions[0]),
+				PublicKey:  genesisKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{{Amount: 1000, Predicate: treasury}},
+	}
+	fund.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, fund).Bytes()
+	require.Nil(t, chain.ValidateTransaction(fund))
+
+	// a preimage on an input spent by its key is not signed for
+	fund.Inputs[0].Preimage = []byte("relayed")
+	require.NotNil(t, chain.ValidateTransaction(fund))
+	fund.Inputs[0].Preimage = nil
+	addTxBlock(t, chain, fund)
+
+	input := &proto.TxInput{PrevTxHash: types.HashTransaction(fund)}
+	spend := &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{input},
+		Outputs: []*proto.TxOutput{{Amount: 1000, Address: genesisKey.Public().Address().Bytes()}},
+	}
+	types.AddWitness(custody[0], defaultChainID, spend, input)
+	types.AddWitness(custody[1], defaultChainID, spend, input)
+	// one of the two witnesses could be dropped
+	require.NotNil(t, chain.ValidateTransaction(spend))
+	input.Witnesses = input.Witnesses[:1]
+	require.Nil(t, chain.ValidateTransaction(spend))
+	// and so could a copy of it
+	input.Witnesses = append(input.Witnesses, input.Witnesses[0])
+	require.NotNil(t, chain.ValidateTransaction(spend))
+	input.Witnesses = input.Witnesses[:1]
+	// or a signature next to the witnesses
+	input.Signature = input.Witnesses[0].Signature
+	require.NotNil(t, chain.ValidateTransaction(spend))
+}
@@ -0,0 +1,146 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+// rebuildBlock fills in the txs of a compact block from the ones that came
+// along and from the mempool. It returns the indexes of the txs we lack.
+func rebuildBlock(cb *proto.CompactBlock, mempool *Mempool) (*proto.Block, []uint32, error) {
+	if cb.Header == nil {
+		return nil, nil, fmt.Errorf("compact block has no header")
+	}
+	if int(cb.Header.TxCount) != len(cb.ShortIds) {
+		return nil, nil, fmt.Errorf("compact block has %d short ids for %d txs", len(cb.ShortIds), cb.Header.TxCount)
+	}
+	b := &proto.Block{
+		Header:       cb.Header,
+		PublicKey:    cb.PublicKey,
+		Signature:    cb.Signature,
+		Transactions: make([]*proto.Transaction, len(cb.ShortIds)),
+	}
+	for _, pre := range cb.Prefilled {
+		if int(pre.Index) >= len(b.Transactions) || pre.Transaction == nil {
+			return nil, nil, fmt.Errorf("prefilled tx %d is not in the block", pre.Index)
+		}
+		b.Transactions[pre.Index] = pre.Transaction
+	}
+	// a short id that several pooled txs share is asked for like a missing tx
+	pooled := make(map[string]*proto.Transaction)
+	for _, tx := range mempool.List() {
+		id := string(types.ShortTxID(cb.Salt, types.HashTransaction(tx)))
+		if _, ok := pooled[id]; ok {
+			pooled[id] = nil
+			continue
+		}
+		pooled[id] = tx
+	}
+	missing := []uint32{}
+	for i, id := range cb.ShortIds {
+		if b.Transactions[i] != nil {
+			continue
+		}
+		if tx := pooled[string(id)]; tx != nil {
+			b.Transactions[i] = tx
+			continue
+		}
+		missing = append(missing, uint32(i))
+	}
+	return b, missing, nil
+}
+
+// receiveCompactBlock rebuilds a block a peer pushed to us. The txs missing
+// from our mempool take a round trip to the peer, which runs apart from the
+// reader of the stream as the response comes in through it. The block counts
+// as seen once it is accepted, a broken copy does not keep out a good one.
+func (n *Node) receiveCompactBlock(p *Peer, cb *proto.CompactBlock) error {
+	if cb.Header == nil {
+		return invalid(fmt.Errorf("compact block has no header"))
+	}
+	hash := hex.EncodeToString(types.HashHeader(cb.Header))
+	p.known.Add(hash)
+	if n.seen.Has(hash) {
+		return nil
+	}
+	if n.light != nil {
+		err := n.light.AddHeader(&proto.SignedHeader{
+			Header:    cb.Header,
+			PublicKey: cb.PublicKey,
+			Signature: cb.Signature,
+		})
+		if err == nil {
+			n.seen.Add(hash)
+		}
+		return err
+	}
+	b, missing, err := rebuildBlock(cb, n.mempool)
+	if err != nil {
+		return invalid(err)
+	}
+	if len(missing) == 0 {
+		return n.completeBlock(p, b)
+	}
+	go n.fetchBlockTxs(p, b, missing)
+	return nil
+}
+
+func (n *Node) fetchBlockTxs(p *Peer, b *proto.Block, missing []uint32) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call)
+	defer cancel()
+	resp, err := p.GetBlockTxs(ctx, &proto.BlockTxsRequest{BlockHash: types.HashBlock(b), Indexes: missing})
+	n.callDone(p, err)
+	if err != nil {
+		n.logger.Debugw("could not fetch block txs", "we", n.ListenAddr, "peer", p.Addr(), "err", err)
+		return
+	}
+	if len(resp.Transactions) != len(missing) {
+		n.penalize(p.key(), p.host, "compactBlock", invalid(fmt.Errorf("peer sent %d of %d missing txs", len(resp.Transactions), len(missing))))
+		return
+	}
+	for i, index := range missing {
+		b.Transactions[index] = resp.Transactions[i]
+	}
+	if err := n.completeBlock(p, b); err != nil {
+		n.penalize(p.key(), p.host, "compactBlock", err)
+	}
+}
+
+// completeBlock adds a rebuilt block. A pooled tx that happens to share the
+// short id of a tx of the block breaks its root hash, the whole block is
+// asked for then.
+func (n *Node) completeBlock(p *Peer, b *proto.Block) error {
+	if !types.VerifyRootHash(b) {
+		item := &proto.InvItem{Type: proto.InvType_INV_BLOCK, Hash: types.HashBlock(b)}
+		n.send(p, &proto.Envelope{Payload: &proto.Envelope_GetData{GetData: &proto.GetData{Items: []*proto.InvItem{item}}}})
+		return nil
+	}
+	if err := n.receiveBlock(b); err != nil {
+		return err
+	}
+	n.seen.Add(hex.EncodeToString(types.HashBlock(b)))
+	return nil
+}
+
+// blockTxs returns the txs of a block that a peer could not rebuild.
+func (n *Node) blockTxs(req *proto.BlockTxsRequest) (*proto.BlockTxs, error) {
+	if n.light != nil {
+		return nil, fmt.Errorf("light nodes do not serve blocks")
+	}
+	b, err := n.chain.GetBlockByHash(req.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	txs := &proto.BlockTxs{BlockHash: req.BlockHash}
+	for _, index := range req.Indexes {
+		if int(index) >= len(b.Transactions) {
+			return nil, fmt.Errorf("block has no tx %d", index)
+		}
+		txs.Transactions = append(txs.Transactions, b.Transactions[index])
+	}
+	return txs, nil
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildBlock(t *testing.T) {
+	var (
+		block   = spendChain(t, 2, 3)[1]
+		mempool = NewMempool()
+	)
+	mempool.Add(block.Transactions[0])
+	mempool.Add(block.Transactions[2])
+	cb := types.NewCompactBlock(block, 1)
+
+	rebuilt, missing, err := rebuildBlock(cb, mempool)
+	require.Nil(t, err)
+	require.Equal(t, []uint32{1}, missing)
+	require.Equal(t, block.Transactions[0], rebuilt.Transactions[0])
+	require.Equal(t, block.Transactions[2], rebuilt.Transactions[2])
+
+	cb.ShortIds = cb.ShortIds[1:]
+	_, _, err = rebuildBlock(cb, mempool)
+	require.NotNil(t, err)
+}
+
+func TestCompactBlockRelay(t *testing.T) {
+	var (
+		n          = testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+		blocks     = spendChain(t, 2, 3)
+		block      = blocks[1]
+		p, sentToP = recordedPeer(n, "127.0.0.1:3001")
+		q, sentToQ = recordedPeer(n, "127.0.0.1:3002")
+	)
+	defer p.Close()
+	defer q.Close()
+	require.Nil(t, n.addBlock(blocks[0]))
+	n.mempool.Add(block.Transactions[0])
+	n.mempool.Add(block.Transactions[2])
+
+	// the tx we lack is fetched from the peer that pushed the block
+	require.Nil(t, n.handleEnvelope(p, envelope(types.NewCompactBlock(block, 1))))
+	req := nextEnvelope(t, sentToP)
+	require.Equal(t, []uint32{1}, req.GetBlockTxsRequest().Indexes)
+	p.deliver(&proto.Envelope{
+		RequestId: req.RequestId,
+		Response:  true,
+		Payload:   &proto.Envelope_BlockTxs{BlockTxs: &proto.BlockTxs{Transactions: block.Transactions[1:2]}},
+	})
+	require.Eventually(t, func() bool { return n.chain.Height() == 2 }, time.Second, time.Millisecond*10)
+
+	// the block goes on to the peers that do not have it
+	cb := nextEnvelope(t, sentToQ).GetCompactBlock()
+	require.Equal(t, block.Header, cb.Header)
+	require.Equal(t, 3, len(cb.ShortIds))
+	requireNothingSent(t, sentToP)
+
+	// and the txs it was asked for are served
+	resp, err := n.blockTxs(&proto.BlockTxsRequest{BlockHash: types.HashBlock(block), Indexes: []uint32{2}})
+	require.Nil(t, err)
+	require.Equal(t, block.Transactions[2], resp.Transactions[0])
+	_, err = n.blockTxs(&proto.BlockTxsRequest{BlockHash: types.HashBlock(block), Indexes: []uint32{3}})
+	require.NotNil(t, err)
+}
+
+func TestCompactBlockSeenOnceAccepted(t *testing.T) {
+	var (
+		n      = testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+		blocks = spendChain(t, 2, 1)
+		block  = blocks[1]
+		p, _   = recordedPeer(n, "127.0.0.1:3001")
+	)
+	defer p.Close()
+	require.Nil(t, n.addBlock(blocks[0]))
+	n.mempool.Add(block.Transactions[0])
+
+	// a copy with a broken signature is turned down
+	forged := types.NewCompactBlock(block, 1)
+	forged.Signature = make([]byte, len(block.Signature))
+	require.NotNil(t, n.handleEnvelope(p, envelope(forged)))
+	require.Equal(t, 1, n.chain.Height())
+
+	// and does not keep out the real one
+	require.Nil(t, n.handleEnvelope(p, envelope(types.NewCompactBlock(block, 1))))
+	require.Equal(t, 2, n.chain.Height())
+}
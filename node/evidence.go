@@ -0,0 +1,113 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+type signedHeader struct {
+	header    *proto.Header
+	signature []byte
+}
+
+// EvidencePool remembers the headers every validator signed so that a second,
+// different header at the same height can be turned into evidence. Evidence
+// stays pending until it is included in a block.
+type EvidencePool struct {
+	mu sync.Mutex
+	// height_pubkey -> first header seen from that signer at that height
+	seen    map[string]*signedHeader
+	pending map[string]*proto.Evidence
+}
+
+func NewEvidencePool() *EvidencePool {
+	return &EvidencePool{
+		seen:    make(map[string]*signedHeader),
+		pending: make(map[string]*proto.Evidence),
+	}
+}
+
+// CheckBlock records the signed header of the block and returns evidence if
+// its signer already signed a different header at the same height. Only
+// headers of the validators and of heights that can still be punished after
+// the tip are recorded, anyone can sign headers for every height there is.
+func (pool *EvidencePool) CheckBlock(b *proto.Block, validators *ValidatorSet, tip int) *proto.Evidence {
+	height := int(b.Header.Height)
+	if height <= tip-evidenceMaxAge || height > tip+1 {
+		return nil
+	}
+	if _, ok := validators.Get(b.PublicKey); !ok {
+		return nil
+	}
+	if !types.VerifyHeader(b.Header, b.PublicKey, b.Signature) {
+		return nil
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	key := fmt.Sprintf("%d_%s", b.Header.Height, hex.EncodeToString(b.PublicKey))
+	first, ok := pool.seen[key]
+	if !ok {
+		pool.seen[key] = &signedHeader{
+			header:    b.Header,
+			signature: b.Signature,
+		}
+		return nil
+	}
+	return types.NewEvidence(&proto.Block{
+		Header:    first.header,
+		PublicKey: b.PublicKey,
+		Signature: first.signature,
+	}, b)
+}
+
+// Add returns false if the evidence is invalid or already known.
+func (pool *EvidencePool) Add(ev *proto.Evidence) bool {
+	if !types.VerifyEvidence(ev) {
+		return false
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	hash := hex.EncodeToString(types.HashEvidence(ev))
+	if _, ok := pool.pending[hash]; ok {
+		return false
+	}
+	pool.pending[hash] = ev
+	return true
+}
+
+func (pool *EvidencePool) Remove(ev *proto.Evidence) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	delete(pool.pending, hex.EncodeToString(types.HashEvidence(ev)))
+}
+
+func (pool *EvidencePool) Pending() []*proto.Evidence {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	evidence := make([]*proto.Evidence, 0, len(pool.pending))
+	for _, ev := range pool.pending {
+		evidence = append(evidence, ev)
+	}
+	return evidence
+}
+
+// Prune forgets headers and evidence that are too old to be punished at the
+// given height.
+func (pool *EvidencePool) Prune(height int) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for key, sh := range pool.seen {
+		if int(sh.header.Height) <= height-evidenceMaxAge {
+			delete(pool.seen, key)
+		}
+	}
+	for key, ev := range pool.pending {
+		if int(ev.HeaderA.Height) <= height-evidenceMaxAge {
+			delete(pool.pending, key)
+		}
+	}
+}
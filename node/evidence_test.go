@@ -0,0 +1,168 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+)
+
+func doubleSign(t *testing.T, chain *Chain, privKey *crypto.PrivateKey) (*proto.Block, *proto.Block) {
+	a := randomBlock(t, chain)
+	b := randomBlock(t, chain)
+	b.Header.Height = a.Header.Height
+	types.SignBlock(privKey, a)
+	types.SignBlock(privKey, b)
+	return a, b
+}
+
+func TestEvidencePoolDetectsDoubleSign(t *testing.T) {
+	var (
+		pool       = NewEvidencePool()
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey    = crypto.GeneratePrivateKey()
+		validators = &ValidatorSet{Validators: []*Validator{{PublicKey: privKey.Public().Bytes(), Power: 1}}}
+		tip        = chain.Height()
+		a, b       = doubleSign(t, chain, privKey)
+	)
+	require.Nil(t, pool.CheckBlock(a, validators, tip))
+	require.Nil(t, pool.CheckBlock(a, validators, tip))
+
+	ev := pool.CheckBlock(b, validators, tip)
+	require.NotNil(t, ev)
+	require.Equal(t, privKey.Public().Bytes(), ev.PublicKey)
+
+	require.True(t, pool.Add(ev))
+	require.False(t, pool.Add(ev))
+	require.Len(t, pool.Pending(), 1)
+
+	pool.Prune(int(a.Header.Height) + evidenceMaxAge)
+	require.Len(t, pool.Pending(), 0)
+	require.Nil(t, pool.CheckBlock(b, validators, tip))
+}
+
+func TestEvidencePoolIgnoresStrangers(t *testing.T) {
+	var (
+		pool       = NewEvidencePool()
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey    = crypto.GeneratePrivateKey()
+		validators = &ValidatorSet{Validators: []*Validator{{PublicKey: privKey.Public().Bytes(), Power: 1}}}
+		a, _       = doubleSign(t, chain, privKey)
+	)
+	// headers of signers outside the set are not kept
+	require.Nil(t, pool.CheckBlock(a, &ValidatorSet{}, chain.Height()))
+	// and neither are headers far from the tip
+	a.Header.Height = 1000
+	types.SignBlock(privKey, a)
+	require.Nil(t, pool.CheckBlock(a, validators, chain.Height()))
+	require.Empty(t, pool.seen)
+}
+
+func TestSlashDoubleSigner(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		validator  = genesisKey.Public().Bytes()
+		a, b       = doubleSign(t, chain, genesisKey)
+		tx         = &proto.Transaction{
+			Version:  1,
+			Type:     proto.TxType_EVIDENCE,
+			Evidence: types.NewEvidence(a, b),
+		}
+	)
+	addTxBlock(t, chain, tx)
+
+	require.True(t, chain.staking.Jailed(validator))
+	require.Equal(t, int64(genesisStake*(100-slashPercent)/100), chain.staking.SelfStake(validator))
+	// the validator is removed right away, not at the end of the epoch
+	_, ok := chain.Validators().Get(validator)
+	require.False(t, ok)
+
+	fillEpoch(t, chain)
+	require.Equal(t, 0, chain.Validators().Len())
+
+	// the same offence can not be punished twice
+	tx.Evidence = types.NewEvidence(b, a)
+	tx.Version = 2
+	require.NotNil(t, chain.ValidateTransaction(tx))
+}
+
+func TestSlashUnbondingStake(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		validator  = genesisKey.Public().Bytes()
+		a, b       = doubleSign(t, chain, genesisKey)
+		unbond     = stakeTx(t, chain, proto.TxType_UNBOND, genesisKey, validator, genesisStake)
+	)
+	// the double-signer unbonds everything before the evidence is in
+	unbond.Outputs = []*proto.TxOutput{{Amount: genesisStake, Address: genesisKey.Public().Address().Bytes()}}
+	unbond.Stake.Signature = types.SignTransaction(genesisKey, defaultChainID, unbond).Bytes()
+	addTxBlock(t, chain, unbond)
+	unbondHeight := chain.Height()
+	require.Equal(t, int64(0), chain.staking.SelfStake(validator))
+
+	addTxBlock(t, chain, &proto.Transaction{
+		Version:  1,
+		Type:     proto.TxType_EVIDENCE,
+		Evidence: types.NewEvidence(a, b),
+	})
+	require.True(t, chain.staking.Jailed(validator))
+
+	// the unbonded coins lost their share once they mature
+	for chain.Height() < unbondHeight+unbondingDelay-1 {
+		require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	}
+	spend := func(amount int64) *proto.Transaction {
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash: types.HashTransaction(unbond),
+					PublicKey:  validator,
+				},
+			},
+			Outputs: []*proto.TxOutput{{Amount: amount, Address: genesisKey.Public().Address().Bytes()}},
+		}
+		tx.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, tx).Bytes()
+		return tx
+	}
+	require.NotNil(t, chain.ValidateTransaction(spend(genesisStake)))
+	require.Nil(t, chain.ValidateTransaction(spend(genesisStake*(100-slashPercent)/100)))
+}
+
+func TestInvalidEvidence(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		a, b       = doubleSign(t, chain, genesisKey)
+		ev         = types.NewEvidence(a, b)
+	)
+	ev.HeaderB.Timestamp++
+	tx := &proto.Transaction{
+		Version:  1,
+		Type:     proto.TxType_EVIDENCE,
+		Evidence: ev,
+	}
+	require.NotNil(t, chain.ValidateTransaction(tx))
+
+	// only validators with something at stake can be slashed
+	a, b = doubleSign(t, chain, crypto.GeneratePrivateKey())
+	tx.Evidence = types.NewEvidence(a, b)
+	require.NotNil(t, chain.ValidateTransaction(tx))
+
+	// double signing on another chain is no offence on this one
+	a, b = doubleSign(t, chain, genesisKey)
+	a.Header.ChainID = "devnet"
+	b.Header.ChainID = "devnet"
+	types.SignBlock(genesisKey, a)
+	types.SignBlock(genesisKey, b)
+	tx.Evidence = types.NewEvidence(a, b)
+	require.True(t, types.VerifyEvidence(tx.Evidence))
+	require.NotNil(t, chain.ValidateTransaction(tx))
+
+	tx.Evidence = &proto.Evidence{}
+	require.NotNil(t, chain.validateEvidence(tx))
+}
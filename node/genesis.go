@@ -0,0 +1,122 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/koshkaj/bloq/consensus"
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+const (
+	seed = "13be19fc5de106d87f9deaec7de204bd5b3a36bb50d66f81fdd5d1482dbeab6e"
+	// coins the genesis validator has bonded at height 0
+	genesisStake = 1000
+	// proof-of-work chains retarget their difficulty every difficultyInterval blocks
+	difficultyInterval = 10
+	defaultDifficulty  = 1 << 16
+	defaultChainID     = "bloq"
+)
+
+// Genesis describes the first block of a chain and the consensus every
+// block after it follows.
+type Genesis struct {
+	// every header of the chain carries it, so blocks can not be replayed
+	// on another chain
+	ChainID   string
+	Consensus string
+	// initial proof-of-work difficulty, only used by proof-of-work chains
+	Difficulty uint64
+	// public keys allowed to seal blocks on authority chains, anyone can
+	// seal if empty
+	Authorities [][]byte
+}
+
+// DefaultGenesis returns an authority chain sealed by the genesis key.
+func DefaultGenesis() *Genesis {
+	privKey := crypto.NewPrivateKeyFromSeedStr(seed)
+	return &Genesis{
+		ChainID:     defaultChainID,
+		Consensus:   consensus.Authority,
+		Authorities: [][]byte{privKey.Public().Bytes()},
+	}
+}
+
+func PoSGenesis() *Genesis {
+	return &Genesis{
+		ChainID:   defaultChainID,
+		Consensus: consensus.PoS,
+	}
+}
+
+func PoWGenesis() *Genesis {
+	return &Genesis{
+		ChainID:    defaultChainID,
+		Consensus:  consensus.PoW,
+		Difficulty: defaultDifficulty,
+	}
+}
+
+func (g *Genesis) Engine() (consensus.Engine, error) {
+	if g.ChainID == "" {
+		return nil, fmt.Errorf("genesis needs a chain id")
+	}
+	switch g.Consensus {
+	case consensus.Authority:
+		return consensus.NewProofOfAuthority(g.Authorities), nil
+	case consensus.PoS:
+		return consensus.NewProofOfStake(), nil
+	case consensus.PoW:
+		if g.Difficulty == 0 {
+			return nil, fmt.Errorf("proof-of-work genesis needs a difficulty")
+		}
+		return consensus.NewProofOfWork(blockTime, difficultyInterval), nil
+	default:
+		return nil, fmt.Errorf("unknown consensus [%s]", g.Consensus)
+	}
+}
+
+func (g *Genesis) Block() *proto.Block {
+	privKey := crypto.NewPrivateKeyFromSeedStr(seed)
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version: 1,
+			ChainID: g.ChainID,
+		},
+	}
+	if g.Consensus == consensus.PoW {
+		block.Header.Difficulty = g.Difficulty
+	}
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  8888,
+				Address: privKey.Public().Address().Bytes(),
+			},
+		},
+	}
+	bond := &proto.Transaction{
+		Version: 1,
+		Type:    proto.TxType_BOND,
+		Stake: &proto.Stake{
+			Validator: privKey.Public().Bytes(),
+			Amount:    genesisStake,
+			PublicKey: privKey.Public().Bytes(),
+		},
+	}
+	bond.Stake.Signature = types.SignTransaction(privKey, g.ChainID, bond).Bytes()
+	block.Transactions = append(block.Transactions, tx, bond)
+	state := crypto.NewMuHash()
+	for _, tx := range block.Transactions {
+		for _, utxo := range newUTXOs(tx, 0) {
+			state.Add(utxo.commitment())
+		}
+	}
+	block.Header.StateRoot = state.Digest()
+	types.SignBlock(privKey, block)
+
+	return block
+}
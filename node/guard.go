@@ -0,0 +1,189 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// largest message we accept or send
+	maxMsgSize = 4 << 20
+	// concurrent calls a single connection may have open
+	maxConcurrentStreams = 64
+	// misbehavior points for a tx that does not validate
+	invalidTxPoints = 10
+	// misbehavior points for every call over the rate limit
+	rateLimitPoints = 1
+	// rate limits of callers that were quiet this long are forgotten
+	limiterIdle = time.Minute * 10
+)
+
+type rateLimit struct {
+	// calls per second
+	rate float64
+	// calls allowed at once after a quiet period
+	burst float64
+}
+
+// per caller limits of the messages that make us validate or serve a lot of
+// data, by the kind of the message
+var rateLimits = map[string]rateLimit{
+	"transaction":     {rate: 100, burst: 200},
+	"block":           {rate: 10, burst: 20},
+	"compactBlock":    {rate: 10, burst: 20},
+	"blockTxsRequest": {rate: 50, burst: 100},
+	"inventory":       {rate: 100, burst: 200},
+	"getData":         {rate: 50, burst: 100},
+	"blockRequest":    {rate: 100, burst: 200},
+	"headersRequest":  {rate: 10, burst: 20},
+	"txProofRequest":  {rate: 50, burst: 100},
+	"addrRequest":     {rate: 1, burst: 10},
+}
+
+// misbehavior points for messages rejected as invalid, one point for the rest
+var invalidPoints = map[string]int{
+	"transaction":  invalidTxPoints,
+	"block":        invalidBlockPoints,
+	"compactBlock": invalidBlockPoints,
+}
+
+// the kind of message each unary call carries
+var methodKinds = map[string]string{
+	"/Node/HandleTransaction": "transaction",
+	"/Node/GetValidators":     "validatorSetRequest",
+	"/Node/GetBlock":          "blockRequest",
+	"/Node/GetHeaders":        "headersRequest",
+	"/Node/GetTxProof":        "txProofRequest",
+	"/Node/GetAddrs":          "addrRequest",
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per caller and method.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *rateLimiter) allow(key string, limit rateLimit) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.rate
+	if b.tokens > limit.burst {
+		b.tokens = limit.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) prune(idle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if time.Since(b.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// callerAddr returns the address unary calls are rate limited by, the host
+// the caller connected from. Peers are limited by their own address instead.
+func callerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// allow enforces the rate limit of the kind of message on the caller.
+func (n *Node) allow(caller, kind string) error {
+	if limit, ok := rateLimits[kind]; ok && !n.limiter.allow(caller+"/"+kind, limit) {
+		return status.Errorf(codes.ResourceExhausted, "rate limit of %s exceeded", kind)
+	}
+	return nil
+}
+
+// penalize holds a message that was rejected as invalid or over the rate
+// limit against the node key of the caller, and its host once that gets it
+// banned.
+func (n *Node) penalize(key []byte, host, kind string, err error) {
+	switch status.Code(err) {
+	case codes.ResourceExhausted:
+		n.misbehaved(key, host, rateLimitPoints, err)
+	case codes.InvalidArgument:
+		points, ok := invalidPoints[kind]
+		if !ok {
+			points = 1
+		}
+		n.misbehaved(key, host, points, err)
+	}
+}
+
+// guard is the interceptor every unary call passes. It turns away banned
+// callers, enforces the rate limits and holds calls that are rejected as
+// invalid against the caller. A malformed message that makes a handler panic
+// fails the call instead of taking the node down.
+func (n *Node) guard(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	var (
+		caller = callerAddr(ctx)
+		key    = callerKey(ctx)
+		kind   = methodKinds[info.FullMethod]
+	)
+	if n.book.IsNodeBanned(key) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is banned", hex.EncodeToString(key))
+	}
+	if n.book.IsHostBanned(caller) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is banned", caller)
+	}
+	if err := n.allow(caller, kind); err != nil {
+		n.penalize(key, caller, kind, err)
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			n.logger.Errorw("recovered from panic", "method", info.FullMethod, "caller", caller, "panic", r)
+			err = status.Errorf(codes.Internal, "internal error")
+		}
+	}()
+	resp, err = handler(ctx, req)
+	n.penalize(key, caller, kind, err)
+	return resp, err
+}
+
+// invalid marks an error as a message that failed validation, the guard
+// counts it as misbehavior of the caller.
+func invalid(err error) error {
+	return status.Error(codes.InvalidArgument, err.Error())
+}
@@ -0,0 +1,155 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func dialNode(t *testing.T, addr string, key *crypto.PrivateKey) proto.NodeClient {
+	conn, err := Dial(addr, key)
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := proto.NewNodeClient(conn)
+	require.Eventually(t, func() bool {
+		_, err := client.GetValidators(context.Background(), &proto.ValidatorSetRequest{})
+		return status.Code(err) != codes.Unavailable
+	}, time.Second*3, time.Millisecond*10)
+	return client
+}
+
+func startGuardedNode(t *testing.T) (*Node, proto.NodeClient) {
+	addr := freeAddr(t)
+	n := startNode(t, testPeerTimeouts, addr)
+	t.Cleanup(n.Stop)
+	return n, dialNode(t, addr, crypto.GeneratePrivateKey())
+}
+
+// openStream connects to the node like a peer that advertises listenAddr.
+func openStream(t *testing.T, n *Node, listenAddr string) proto.Node_ConnectClient {
+	key := crypto.GeneratePrivateKey()
+	conn, err := Dial(n.ListenAddr, key)
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		conn.Close()
+	})
+	stream, err := proto.NewNodeClient(conn).Connect(ctx)
+	require.Nil(t, err)
+	v := &proto.Version{Version: "bloq-1", ListenAddr: listenAddr}
+	types.SignVersion(key, n.chain.ChainID(), v)
+	require.Nil(t, stream.Send(versionEnvelope(v)))
+	env, err := stream.Recv()
+	require.Nil(t, err)
+	require.NotNil(t, env.GetVersion())
+	return stream
+}
+
+// invalidTx is signed with a key that does not match the signature.
+func invalidTx() *proto.Transaction {
+	return &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{{PublicKey: make([]byte, 32), Signature: make([]byte, 64)}},
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		l     = newRateLimiter()
+		limit = rateLimit{rate: 100, burst: 3}
+	)
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("a", limit))
+	}
+	require.False(t, l.allow("a", limit))
+	// other callers have their own bucket
+	require.True(t, l.allow("b", limit))
+
+	time.Sleep(time.Millisecond * 20)
+	require.True(t, l.allow("a", limit))
+
+	l.prune(0)
+	require.Empty(t, l.buckets)
+}
+
+func TestInvalidTxsGetCallerBanned(t *testing.T) {
+	var (
+		n, _   = startGuardedNode(t)
+		key    = crypto.GeneratePrivateKey()
+		client = dialNode(t, n.ListenAddr, key)
+	)
+	for i := 0; i < banThreshold/invalidTxPoints; i++ {
+		_, err := client.HandleTransaction(context.Background(), invalidTx())
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	require.True(t, n.book.IsNodeBanned(key.Public().Bytes()))
+	_, err := client.GetValidators(context.Background(), &proto.ValidatorSetRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// a new key does not get the host past the ban
+	require.True(t, n.book.IsHostBanned("127.0.0.1"))
+	_, err = dialNode(t, n.ListenAddr, crypto.GeneratePrivateKey()).GetValidators(context.Background(), &proto.ValidatorSetRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestStaleTxsAreNoMisbehavior(t *testing.T) {
+	var (
+		n, _   = startGuardedNode(t)
+		key    = crypto.GeneratePrivateKey()
+		client = dialNode(t, n.ListenAddr, key)
+		spend  = stakeTx(t, n.chain, proto.TxType_BOND, key, key.Public().Bytes(), minValidatorStake)
+	)
+	addTxBlock(t, n.chain, spend)
+	// a tx the chain already has may just have been relayed late
+	_, err := client.HandleTransaction(context.Background(), spend)
+	require.NotNil(t, err)
+	require.NotEqual(t, codes.InvalidArgument, status.Code(err))
+	_, ok := n.book.GetNode(key.Public().Bytes())
+	require.False(t, ok)
+}
+
+func TestRateLimitExceeded(t *testing.T) {
+	_, client := startGuardedNode(t)
+
+	limit := rateLimits["headersRequest"]
+	var err error
+	for i := 0; i <= int(limit.burst)+1 && err == nil; i++ {
+		_, err = client.GetHeaders(context.Background(), &proto.HeadersRequest{From: 0, Count: 1})
+	}
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestMalformedMessages(t *testing.T) {
+	n, client := startGuardedNode(t)
+	ctx := context.Background()
+
+	_, err := client.GetBlock(ctx, &proto.BlockRequest{Height: -1})
+	require.NotNil(t, err)
+
+	_, err = client.HandleTransaction(ctx, &proto.Transaction{Inputs: []*proto.TxInput{{PublicKey: make([]byte, maxMsgSize+1)}}})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// peers are held to what they send over their stream
+	stream := openStream(t, n, "127.0.0.1:1")
+	require.Eventually(t, func() bool { return len(n.Peers()) == 1 }, time.Second*3, time.Millisecond*10)
+	key := n.Peers()[0].key()
+	require.Nil(t, stream.Send(envelope(&proto.Block{})))
+	require.Nil(t, stream.Send(versionEnvelope(&proto.Version{})))
+	require.Eventually(t, func() bool {
+		ns, _ := n.book.GetNode(key)
+		return ns.Points == invalidBlockPoints+1
+	}, time.Second*3, time.Millisecond*10)
+
+	// the node survived all of it
+	_, err = client.GetBlock(ctx, &proto.BlockRequest{Height: 0})
+	require.Nil(t, err)
+	require.Len(t, n.Peers(), 1)
+}
@@ -0,0 +1,225 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+const (
+	// hashes remembered per peer as known to it
+	maxKnownInventory = 8192
+	// hashes of txs and blocks we received, they are not fetched again
+	maxSeenInventory = 1 << 16
+	// items a single inventory or getdata may carry
+	maxInvItems = 1000
+	// txs rejected for the state of the chain are not fetched again until
+	// then, or until a new block changes the state
+	rejectedTxExpiry = time.Minute
+)
+
+// rejection notes when a tx was rejected for the state of the chain.
+type rejection struct {
+	height int
+	at     time.Time
+}
+
+// knownInventory is a set of hashes that forgets the oldest ones once it
+// holds size hashes.
+type knownInventory struct {
+	mu     sync.Mutex
+	size   int
+	hashes map[string]bool
+	order  []string
+	next   int
+}
+
+func newKnownInventory(size int) *knownInventory {
+	return &knownInventory{
+		size:   size,
+		hashes: make(map[string]bool),
+	}
+}
+
+// Add remembers the hash, it reports whether the hash was new.
+func (k *knownInventory) Add(hash string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.hashes[hash] {
+		return false
+	}
+	if len(k.order) < k.size {
+		k.order = append(k.order, hash)
+	} else {
+		delete(k.hashes, k.order[k.next])
+		k.order[k.next] = hash
+		k.next = (k.next + 1) % k.size
+	}
+	k.hashes[hash] = true
+	return true
+}
+
+// Remove forgets the hash. Its slot is only reused once it is the oldest.
+func (k *knownInventory) Remove(hash string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.hashes, hash)
+}
+
+func (k *knownInventory) Has(hash string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.hashes[hash]
+}
+
+// inventoryItem returns the item a tx or block is announced with, other
+// messages are pushed whole.
+func inventoryItem(msg any) (*proto.InvItem, bool) {
+	switch v := msg.(type) {
+	case *proto.Transaction:
+		return &proto.InvItem{Type: proto.InvType_INV_TX, Hash: types.HashTransaction(v)}, true
+	case *proto.Block:
+		if v.Header == nil {
+			return nil, false
+		}
+		return &proto.InvItem{Type: proto.InvType_INV_BLOCK, Hash: types.HashBlock(v)}, true
+	}
+	return nil, false
+}
+
+// receiveInventory asks the peer for the announced txs and blocks we have
+// not seen. What another peer was already asked for is left to that peer,
+// unless it did not deliver within a call timeout.
+func (n *Node) receiveInventory(p *Peer, inv *proto.Inventory) error {
+	if len(inv.Items) > maxInvItems {
+		return invalid(fmt.Errorf("inventory has %d items, at most %d are allowed", len(inv.Items), maxInvItems))
+	}
+	want := []*proto.InvItem{}
+	for _, item := range inv.Items {
+		hash := hex.EncodeToString(item.Hash)
+		p.known.Add(hash)
+		// light nodes do not relay txs
+		if item.Type == proto.InvType_INV_TX && n.light != nil {
+			continue
+		}
+		if n.seen.Has(hash) || n.recentlyRejected(hash) || !n.wantData(hash) {
+			continue
+		}
+		want = append(want, item)
+	}
+	if len(want) > 0 {
+		n.send(p, &proto.Envelope{Payload: &proto.Envelope_GetData{GetData: &proto.GetData{Items: want}}})
+	}
+	return nil
+}
+
+// wantData reports whether the body of the hash should be asked for, and
+// notes that it was.
+func (n *Node) wantData(hash string) bool {
+	n.invLock.Lock()
+	defer n.invLock.Unlock()
+	if asked, ok := n.requested[hash]; ok && time.Since(asked) < n.peerTimeouts.call {
+		return false
+	}
+	n.requested[hash] = time.Now()
+	return true
+}
+
+// received notes that the body of the hash arrived, it is neither asked for
+// nor announced to the sender again.
+func (n *Node) received(p *Peer, hash string) {
+	p.known.Add(hash)
+	n.seen.Add(hash)
+	n.invLock.Lock()
+	delete(n.requested, hash)
+	n.invLock.Unlock()
+}
+
+// rejectTx notes that the tx does not fit the state of the chain. It may
+// fit a later state, so it is no longer seen but is only fetched again once
+// the rejection expired or a new block arrived.
+func (n *Node) rejectTx(hash string) {
+	n.seen.Remove(hash)
+	n.invLock.Lock()
+	defer n.invLock.Unlock()
+	n.rejected[hash] = rejection{height: n.chain.Height(), at: time.Now()}
+}
+
+func (n *Node) recentlyRejected(hash string) bool {
+	n.invLock.Lock()
+	r, ok := n.rejected[hash]
+	n.invLock.Unlock()
+	return ok && r.height == n.chain.Height() && time.Since(r.at) < rejectedTxExpiry
+}
+
+// forgetRequests drops the requests that were not delivered in time and the
+// rejections that expired.
+func (n *Node) forgetRequests() {
+	height := n.chain.Height()
+	n.invLock.Lock()
+	defer n.invLock.Unlock()
+	for hash, asked := range n.requested {
+		if time.Since(asked) >= n.peerTimeouts.call {
+			delete(n.requested, hash)
+		}
+	}
+	for hash, r := range n.rejected {
+		if r.height != height || time.Since(r.at) >= rejectedTxExpiry {
+			delete(n.rejected, hash)
+		}
+	}
+}
+
+// announceMempool tells the peer about the txs of our mempool, whether it is
+// known to have them or not. Gossip that was dropped from a full send queue
+// reaches the peer like that after all.
+func (n *Node) announceMempool(p *Peer) {
+	items := []*proto.InvItem{}
+	for _, tx := range n.mempool.List() {
+		if len(items) == maxInvItems {
+			break
+		}
+		items = append(items, &proto.InvItem{Type: proto.InvType_INV_TX, Hash: types.HashTransaction(tx)})
+	}
+	if len(items) > 0 {
+		n.send(p, &proto.Envelope{Payload: &proto.Envelope_Inventory{Inventory: &proto.Inventory{Items: items}}})
+	}
+}
+
+// serveData sends the peer the txs and blocks it asked for, the ones we do
+// not have are left out.
+func (n *Node) serveData(p *Peer, req *proto.GetData) error {
+	if len(req.Items) > maxInvItems {
+		return invalid(fmt.Errorf("getdata has %d items, at most %d are allowed", len(req.Items), maxInvItems))
+	}
+	for _, item := range req.Items {
+		hash := hex.EncodeToString(item.Hash)
+		var msg any
+		switch item.Type {
+		case proto.InvType_INV_TX:
+			tx, ok := n.mempool.Get(hash)
+			if !ok {
+				continue
+			}
+			msg = tx
+		case proto.InvType_INV_BLOCK:
+			if n.light != nil {
+				continue
+			}
+			b, err := n.chain.GetBlockByHash(item.Hash)
+			if err != nil {
+				continue
+			}
+			msg = b
+		default:
+			continue
+		}
+		p.known.Add(hash)
+		n.send(p, envelope(msg))
+	}
+	return nil
+}
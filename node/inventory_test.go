@@ -0,0 +1,171 @@
+package node
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStream keeps everything sent to it.
+type recordingStream struct {
+	envelopeStream
+	sent chan *proto.Envelope
+}
+
+func (s *recordingStream) Send(env *proto.Envelope) error {
+	s.sent <- env
+	return nil
+}
+
+func recordedPeer(n *Node, addr string) (*Peer, chan *proto.Envelope) {
+	stream := &recordingStream{sent: make(chan *proto.Envelope, peerQueueSize)}
+	p := newPeer(stream, addr, &proto.Version{}, false)
+	go p.writeLoop()
+	n.peerLock.Lock()
+	n.peers[addr] = p
+	n.peerLock.Unlock()
+	return p, stream.sent
+}
+
+func nextEnvelope(t *testing.T, sent chan *proto.Envelope) *proto.Envelope {
+	select {
+	case env := <-sent:
+		return env
+	case <-time.After(time.Second):
+		t.Fatal("nothing was sent")
+		return nil
+	}
+}
+
+func requireNothingSent(t *testing.T, sent chan *proto.Envelope) {
+	select {
+	case env := <-sent:
+		t.Fatalf("unexpected %s", envelopeKind(env))
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestKnownInventory(t *testing.T) {
+	known := newKnownInventory(2)
+	require.True(t, known.Add("a"))
+	require.False(t, known.Add("a"))
+	require.True(t, known.Add("b"))
+	require.True(t, known.Add("c"))
+	// the oldest hash made room
+	require.False(t, known.Has("a"))
+	require.True(t, known.Has("b"))
+	require.True(t, known.Has("c"))
+}
+
+func TestInventoryGossip(t *testing.T) {
+	var (
+		n           = testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+		p, sentToP  = recordedPeer(n, "127.0.0.1:3001")
+		q, sentToQ  = recordedPeer(n, "127.0.0.1:3002")
+		staker      = crypto.GeneratePrivateKey()
+		tx          = stakeTx(t, n.chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+		hash        = types.HashTransaction(tx)
+		announce    = &proto.Envelope{Payload: &proto.Envelope_Inventory{Inventory: &proto.Inventory{Items: []*proto.InvItem{{Type: proto.InvType_INV_TX, Hash: hash}}}}}
+		requestData = &proto.Envelope{Payload: &proto.Envelope_GetData{GetData: &proto.GetData{Items: []*proto.InvItem{{Type: proto.InvType_INV_TX, Hash: hash}}}}}
+	)
+	defer p.Close()
+	defer q.Close()
+
+	// we only ask the first peer that announced the tx
+	require.Nil(t, n.handleEnvelope(p, announce))
+	require.Equal(t, hash, nextEnvelope(t, sentToP).GetGetData().Items[0].Hash)
+	require.Nil(t, n.handleEnvelope(q, announce))
+	requireNothingSent(t, sentToQ)
+
+	// the tx is announced to the peer that did not have it, not sent back
+	require.Nil(t, n.handleEnvelope(p, envelope(tx)))
+	require.True(t, n.mempool.Has(tx))
+	requireNothingSent(t, sentToP)
+	requireNothingSent(t, sentToQ)
+
+	r, sentToR := recordedPeer(n, "127.0.0.1:3003")
+	defer r.Close()
+	n.broadcast(tx)
+	n.broadcast(tx)
+	require.Equal(t, hash, nextEnvelope(t, sentToR).GetInventory().Items[0].Hash)
+	requireNothingSent(t, sentToR)
+
+	// the body goes out once asked for
+	require.Nil(t, n.handleEnvelope(r, requestData))
+	require.Equal(t, tx, nextEnvelope(t, sentToR).GetTransaction())
+	// a tx we do not have is left out
+	requestData.GetGetData().Items[0].Hash = make([]byte, 32)
+	require.Nil(t, n.handleEnvelope(r, requestData))
+	requireNothingSent(t, sentToR)
+}
+
+func TestAnnounceMempool(t *testing.T) {
+	var (
+		n          = testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+		p, sentToP = recordedPeer(n, "127.0.0.1:3001")
+		staker     = crypto.GeneratePrivateKey()
+		tx         = stakeTx(t, n.chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	)
+	defer p.Close()
+	n.announceMempool(p)
+	requireNothingSent(t, sentToP)
+
+	// the tx is announced again even though the peer is known to have it
+	n.mempool.Add(tx)
+	p.known.Add(hex.EncodeToString(types.HashTransaction(tx)))
+	n.announceMempool(p)
+	require.Equal(t, types.HashTransaction(tx), nextEnvelope(t, sentToP).GetInventory().Items[0].Hash)
+}
+
+func TestInventoryRefetchesRejectedTx(t *testing.T) {
+	var (
+		n          = testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+		p, sentToP = recordedPeer(n, "127.0.0.1:3001")
+		staker     = crypto.GeneratePrivateKey()
+		// delegating to a validator we do not know of yet
+		tx       = stakeTx(t, n.chain, proto.TxType_DELEGATE, staker, crypto.GeneratePrivateKey().Public().Bytes(), minValidatorStake)
+		hash     = types.HashTransaction(tx)
+		announce = &proto.Envelope{Payload: &proto.Envelope_Inventory{Inventory: &proto.Inventory{Items: []*proto.InvItem{{Type: proto.InvType_INV_TX, Hash: hash}}}}}
+	)
+	defer p.Close()
+
+	require.Nil(t, n.handleEnvelope(p, announce))
+	require.Equal(t, hash, nextEnvelope(t, sentToP).GetGetData().Items[0].Hash)
+	require.True(t, isStateError(n.handleEnvelope(p, envelope(tx))))
+	require.False(t, n.mempool.Has(tx))
+
+	// the state did not change, so the tx is not fetched again
+	require.Nil(t, n.handleEnvelope(p, announce))
+	requireNothingSent(t, sentToP)
+
+	require.Nil(t, n.chain.AddBlock(randomBlock(t, n.chain)))
+	require.Nil(t, n.handleEnvelope(p, announce))
+	require.Equal(t, hash, nextEnvelope(t, sentToP).GetGetData().Items[0].Hash)
+}
+
+func TestInventoryGossipAcrossNodes(t *testing.T) {
+	var (
+		addrA = freeAddr(t)
+		addrB = freeAddr(t)
+		addrC = freeAddr(t)
+		a     = startNode(t, testPeerTimeouts, addrA)
+	)
+	defer a.Stop()
+	time.Sleep(time.Millisecond * 50)
+	b := startNode(t, testPeerTimeouts, addrB, addrA)
+	defer b.Stop()
+	time.Sleep(time.Millisecond * 50)
+	c := startNode(t, testPeerTimeouts, addrC, addrB)
+	defer c.Stop()
+	require.Eventually(t, func() bool { return len(b.Peers()) == 2 }, time.Second*3, time.Millisecond*10)
+
+	staker := crypto.GeneratePrivateKey()
+	tx := stakeTx(t, a.chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	require.Nil(t, a.receiveTx("", tx))
+	require.Eventually(t, func() bool { return c.mempool.Has(tx) }, time.Second*3, time.Millisecond*10)
+}
@@ -0,0 +1,397 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/koshkaj/bloq/consensus"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+)
+
+// LightClient follows the chain by its headers only. Payments are checked
+// with merkle proofs served by full nodes against the synced headers. Like
+// the chain it keeps competing branches and switches to one the engine's
+// fork choice prefers.
+type LightClient struct {
+	engine  consensus.Engine
+	chainID string
+	headers *HeaderList
+
+	// serializes adding headers, a branch switch spans several steps
+	headerLock sync.Mutex
+
+	lock sync.RWMutex
+	// hash -> header of the branches we do not follow, down to the
+	// finalized height
+	side      map[string]*proto.Header
+	finalized int
+	// light clients do not track stakes, on proof-of-stake chains they start
+	// from the validators of the genesis block and follow the changes the
+	// headers hand over
+	validators *ValidatorSet
+}
+
+func NewLightClient(g *Genesis) (*LightClient, error) {
+	engine, err := g.Engine()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		genesis = g.Block()
+		staking = NewStaking()
+	)
+	for _, tx := range genesis.Transactions {
+		if tx.Type == proto.TxType_BOND {
+			staking.Bond(tx.Stake.Validator, tx.Stake.PublicKey, tx.Stake.Amount)
+		}
+	}
+	lc := &LightClient{
+		engine:     engine,
+		chainID:    g.ChainID,
+		headers:    NewHeaderList(),
+		validators: staking.ValidatorSet(0),
+		side:       make(map[string]*proto.Header),
+	}
+	lc.headers.Add(genesis.Header)
+	return lc, nil
+}
+
+func (lc *LightClient) Height() int {
+	return lc.headers.Height()
+}
+
+func (lc *LightClient) GetHeader(height int) (*proto.Header, error) {
+	return lc.headers.Get(height)
+}
+
+// FinalizedHeight returns the height up to which the headers can no longer
+// be replaced by another branch.
+func (lc *LightClient) FinalizedHeight() int {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	return lc.finalized
+}
+
+// setFinalized moves the finalized height to where the engine puts it. The
+// commits of proof-of-stake headers are verified, so every header is final.
+func (lc *LightClient) setFinalized() {
+	height := lc.Height()
+	if lc.engine.Name() != consensus.PoS {
+		height = lc.engine.Finalize(lc)
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if height <= lc.finalized {
+		return
+	}
+	lc.finalized = height
+	for hash, header := range lc.side {
+		if int(header.Height) <= height {
+			delete(lc.side, hash)
+		}
+	}
+}
+
+func (lc *LightClient) IsValidator(pubKey []byte) bool {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	_, ok := lc.validators.Get(pubKey)
+	return ok
+}
+
+// AddHeader adds a header that follows the tip or a header of another branch
+// after the finalized height, it has to carry a valid seal. On proof-of-stake
+// chains it also needs a commit of the validators.
+func (lc *LightClient) AddHeader(sh *proto.SignedHeader) error {
+	if sh.Header == nil {
+		return fmt.Errorf("signed header has no header")
+	}
+	lc.headerLock.Lock()
+	defer lc.headerLock.Unlock()
+	if lc.hasHeader(sh.Header) {
+		return fmt.Errorf("header %s is already known", hex.EncodeToString(types.HashHeader(sh.Header)))
+	}
+	ancestor, branch, err := lc.findBranch(sh.Header)
+	if err != nil {
+		return err
+	}
+	if ancestor != lc.Height() || len(branch) > 0 {
+		return lc.addSideHeader(sh, ancestor, branch)
+	}
+	tip, err := lc.headers.Get(lc.Height())
+	if err != nil {
+		return err
+	}
+	if err := validateHeader(lc.chainID, tip, sh.Header); err != nil {
+		return err
+	}
+	if lc.engine.Name() == consensus.PoS {
+		if err := lc.verifyCommit(sh); err != nil {
+			return err
+		}
+	}
+	block := &proto.Block{
+		Header:    sh.Header,
+		PublicKey: sh.PublicKey,
+		Signature: sh.Signature,
+	}
+	if err := lc.engine.VerifySeal(lc, block); err != nil {
+		return err
+	}
+	lc.headers.Add(sh.Header)
+	lc.setFinalized()
+	return nil
+}
+
+// hasHeader reports whether the header is on any of our branches.
+func (lc *LightClient) hasHeader(h *proto.Header) bool {
+	hash := types.HashHeader(h)
+	if header, err := lc.headers.Get(int(h.Height)); err == nil && bytes.Equal(types.HashHeader(header), hash) {
+		return true
+	}
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	_, ok := lc.side[hex.EncodeToString(hash)]
+	return ok
+}
+
+// findBranch walks back from the parent of the header until it reaches the
+// branch we follow. It returns the height of the common ancestor and the side
+// headers after it, oldest first.
+func (lc *LightClient) findBranch(h *proto.Header) (int, []*proto.Header, error) {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	var (
+		branch = []*proto.Header{}
+		hash   = h.PrevHash
+	)
+	for height := int(h.Height) - 1; height >= 0; height-- {
+		if header, err := lc.headers.Get(height); err == nil && bytes.Equal(types.HashHeader(header), hash) {
+			for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+				branch[i], branch[j] = branch[j], branch[i]
+			}
+			return height, branch, nil
+		}
+		parent, ok := lc.side[hex.EncodeToString(hash)]
+		if !ok {
+			break
+		}
+		branch = append(branch, parent)
+		hash = parent.PrevHash
+	}
+	return 0, nil, fmt.Errorf("unknown parent header %s", hex.EncodeToString(h.PrevHash))
+}
+
+// addSideHeader keeps a header of another branch and switches to its branch
+// if the engine prefers it. Branches can not fork off below the finalized
+// height, which rules them out on proof-of-stake and authority chains.
+func (lc *LightClient) addSideHeader(sh *proto.SignedHeader, ancestor int, branch []*proto.Header) error {
+	if ancestor < lc.FinalizedHeight() {
+		return fmt.Errorf("header %d forks off below the finalized height %d", sh.Header.Height, lc.FinalizedHeight())
+	}
+	reader := &headerBranchReader{
+		LightClient: lc,
+		ancestor:    ancestor,
+		headers:     branch,
+	}
+	parent, err := reader.GetHeader(reader.Height())
+	if err != nil {
+		return err
+	}
+	if err := validateHeader(lc.chainID, parent, sh.Header); err != nil {
+		return err
+	}
+	block := &proto.Block{
+		Header:    sh.Header,
+		PublicKey: sh.PublicKey,
+		Signature: sh.Signature,
+	}
+	if err := lc.engine.VerifySeal(reader, block); err != nil {
+		return err
+	}
+	lc.lock.Lock()
+	lc.side[hex.EncodeToString(types.HashHeader(sh.Header))] = sh.Header
+	lc.lock.Unlock()
+
+	branch = append(branch, sh.Header)
+	current := make([]*proto.Header, 0, lc.Height()-ancestor)
+	for h := ancestor + 1; h <= lc.Height(); h++ {
+		header, err := lc.headers.Get(h)
+		if err != nil {
+			return err
+		}
+		current = append(current, header)
+	}
+	if !lc.engine.ForkChoice(current, branch) {
+		return nil
+	}
+	// the headers we followed become a side branch in turn
+	lc.lock.Lock()
+	for _, header := range current {
+		lc.side[hex.EncodeToString(types.HashHeader(header))] = header
+	}
+	for _, header := range branch {
+		delete(lc.side, hex.EncodeToString(types.HashHeader(header)))
+	}
+	lc.lock.Unlock()
+	lc.headers.Truncate(ancestor + 1)
+	for _, header := range branch {
+		lc.headers.Add(header)
+	}
+	lc.setFinalized()
+	return nil
+}
+
+// headerBranchReader shows the headers as if the side branch was connected
+// after the ancestor, so that side headers are verified against their own
+// parents.
+type headerBranchReader struct {
+	*LightClient
+	ancestor int
+	headers  []*proto.Header
+}
+
+func (r *headerBranchReader) Height() int {
+	return r.ancestor + len(r.headers)
+}
+
+func (r *headerBranchReader) GetHeader(height int) (*proto.Header, error) {
+	if height > r.Height() || height < 0 {
+		return nil, fmt.Errorf("given height [%d] is invalid, current height [%d]", height, r.Height())
+	}
+	if height > r.ancestor {
+		return r.headers[height-r.ancestor-1], nil
+	}
+	return r.LightClient.GetHeader(height)
+}
+
+// verifyCommit checks the commit of the header against the validators we
+// follow. A header that hands over to other validators is only followed if
+// the ones we trust with more than 1/3 of their power signed its commit too,
+// at least one honest validator vouches for the new set like that.
+func (lc *LightClient) verifyCommit(sh *proto.SignedHeader) error {
+	var (
+		height     = int(sh.Header.Height)
+		hash       = types.HashHeader(sh.Header)
+		validators = lc.Validators()
+	)
+	if sh.Validators != nil {
+		next := validatorSetFromProto(sh.Validators)
+		if err := verifyCommit(lc.chainID, next, hash, height, sh.Commit); err != nil {
+			return err
+		}
+		if power := signedPower(validators, sh.Commit); !hasOneThird(power, validators.TotalPower()) {
+			return fmt.Errorf("validators we follow signed %d of %d voting power of the commit at height [%d]", power, validators.TotalPower(), height)
+		}
+		lc.lock.Lock()
+		lc.validators = next
+		lc.lock.Unlock()
+		return nil
+	}
+	return verifyCommit(lc.chainID, validators, hash, height, sh.Commit)
+}
+
+// signedPower returns the voting power the validators have in the commit,
+// the votes are already verified.
+func signedPower(validators *ValidatorSet, cert *proto.CommitCertificate) int64 {
+	var power int64
+	for _, vote := range cert.Precommits {
+		if v, ok := validators.Get(vote.PublicKey); ok {
+			power += v.Power
+		}
+	}
+	return power
+}
+
+func (lc *LightClient) Validators() *ValidatorSet {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	return lc.validators
+}
+
+// FullNode is what light clients need from the full node they sync with.
+type FullNode interface {
+	GetHeaders(context.Context, *proto.HeadersRequest) (*proto.Headers, error)
+	GetTxProof(context.Context, *proto.TxProofRequest) (*proto.TxProof, error)
+}
+
+// Sync fetches the headers we are missing from a full node. It starts after
+// the finalized height, the node may follow another branch than we do after
+// it.
+func (lc *LightClient) Sync(c FullNode) error {
+	from := lc.FinalizedHeight() + 1
+	for {
+		resp, err := c.GetHeaders(context.Background(), &proto.HeadersRequest{
+			From:  int32(from),
+			Count: maxHeaders,
+		})
+		if err != nil {
+			return err
+		}
+		for _, sh := range resp.Headers {
+			if sh.Header != nil && lc.hasHeader(sh.Header) {
+				continue
+			}
+			if err := lc.AddHeader(sh); err != nil {
+				return err
+			}
+		}
+		if len(resp.Headers) < maxHeaders {
+			return nil
+		}
+		from += len(resp.Headers)
+	}
+}
+
+func validatorSetFromProto(vs *proto.ValidatorSet) *ValidatorSet {
+	validators := make([]*Validator, len(vs.Validators))
+	for i, v := range vs.Validators {
+		validators[i] = &Validator{
+			PublicKey: v.PublicKey,
+			Power:     v.Power,
+		}
+	}
+	return &ValidatorSet{
+		Epoch:      int(vs.Epoch),
+		Height:     int(vs.Height),
+		Validators: validators,
+	}
+}
+
+// VerifyTxProof checks that the tx is included in a block of the synced
+// header chain.
+func (lc *LightClient) VerifyTxProof(p *proto.TxProof) error {
+	header, err := lc.GetHeader(int(p.Height))
+	if err != nil {
+		return err
+	}
+	// a proof for a tree of another size could prove a leaf that is no tx
+	if p.Proof == nil || p.Proof.Leaves != header.TxCount {
+		return fmt.Errorf("merkle proof for tx %s does not match the tx count of its block", hex.EncodeToString(p.TxHash))
+	}
+	if !types.VerifyMerkleProof(header.RootHash, p.TxHash, p.Proof) {
+		return fmt.Errorf("invalid merkle proof for tx %s", hex.EncodeToString(p.TxHash))
+	}
+	return nil
+}
+
+// VerifyPayment asks a full node for the inclusion proof of the tx and
+// checks it against our headers. The tx has to be in a finalized block, a
+// block after it can still be replaced by another branch.
+func (lc *LightClient) VerifyPayment(c FullNode, txHash []byte) error {
+	p, err := c.GetTxProof(context.Background(), &proto.TxProofRequest{TxHash: txHash})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(p.TxHash, txHash) {
+		return fmt.Errorf("peer sent a proof for another tx")
+	}
+	if int(p.Height) > lc.FinalizedHeight() {
+		return fmt.Errorf("tx %s is not final yet", hex.EncodeToString(txHash))
+	}
+	return lc.VerifyTxProof(p)
+}
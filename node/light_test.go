@@ -0,0 +1,189 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/consensus"
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLightClientVerifiesTxProof(t *testing.T) {
+	var (
+		chain  = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		staker = crypto.GeneratePrivateKey()
+		bond   = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	)
+	lc, err := NewLightClient(DefaultGenesis())
+	require.Nil(t, err)
+
+	addTxBlock(t, chain, bond)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	}
+	headers, err := chain.GetHeaders(1, maxHeaders)
+	require.Nil(t, err)
+	require.Len(t, headers, 4)
+	for _, sh := range headers {
+		require.Nil(t, lc.AddHeader(sh))
+	}
+	require.Equal(t, chain.Height(), lc.Height())
+
+	proof, err := chain.GetTxProof(types.HashTransaction(bond))
+	require.Nil(t, err)
+	require.Equal(t, int32(1), proof.Height)
+	require.Nil(t, lc.VerifyTxProof(proof))
+
+	proof.Height = 2
+	require.NotNil(t, lc.VerifyTxProof(proof))
+	proof.Height = 1
+	proof.Proof.Leaves++
+	require.NotNil(t, lc.VerifyTxProof(proof))
+
+	_, err = chain.GetTxProof(util.RandomHash())
+	require.NotNil(t, err)
+}
+
+func TestLightClientRejectsInvalidHeaders(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	lc, err := NewLightClient(DefaultGenesis())
+	require.Nil(t, err)
+
+	// only the genesis key is an authority
+	block := randomBlock(t, chain)
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+	require.NotNil(t, lc.AddHeader(&proto.SignedHeader{
+		Header:    block.Header,
+		PublicKey: block.PublicKey,
+		Signature: block.Signature,
+	}))
+
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(seed), block)
+	sh := &proto.SignedHeader{
+		Header:    block.Header,
+		PublicKey: block.PublicKey,
+		Signature: block.Signature,
+	}
+	require.Nil(t, lc.AddHeader(sh))
+	// the same header does not follow itself
+	require.NotNil(t, lc.AddHeader(sh))
+}
+
+func TestLightClientSwitchesToHeavierBranch(t *testing.T) {
+	var (
+		chain = powChain(t)
+		fork  = powChain(t)
+		a1    = sealBlock(t, chain)
+	)
+	lc, err := NewLightClient(&Genesis{ChainID: defaultChainID, Consensus: consensus.PoW, Difficulty: 1 << 8})
+	require.Nil(t, err)
+	require.Nil(t, chain.AddBlock(a1))
+	b1 := sealBlock(t, fork)
+	require.Nil(t, fork.AddBlock(b1))
+	b2 := sealBlock(t, fork)
+	require.Nil(t, fork.AddBlock(b2))
+
+	signed := func(b *proto.Block) *proto.SignedHeader {
+		return &proto.SignedHeader{Header: b.Header, PublicKey: b.PublicKey, Signature: b.Signature}
+	}
+	require.Nil(t, lc.AddHeader(signed(a1)))
+	// proof-of-work headers are not final until they are buried
+	require.Equal(t, 0, lc.FinalizedHeight())
+
+	// a branch with the same work does not replace the tip
+	require.Nil(t, lc.AddHeader(signed(b1)))
+	tip, err := lc.GetHeader(1)
+	require.Nil(t, err)
+	require.Equal(t, a1.Header, tip)
+
+	require.Nil(t, lc.AddHeader(signed(b2)))
+	require.Equal(t, 2, lc.Height())
+	tip, err = lc.GetHeader(1)
+	require.Nil(t, err)
+	require.Equal(t, b1.Header, tip)
+	require.NotNil(t, lc.AddHeader(signed(a1)))
+}
+
+// commitTxBlock adds a block proposed by the first key and precommitted by
+// all of them.
+func commitTxBlock(t *testing.T, chain *Chain, keys []*crypto.PrivateKey, txx ...*proto.Transaction) {
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, txx...)
+	setStateRoot(t, chain, block)
+	types.SignBlock(keys[0], block)
+	cert := &proto.CommitCertificate{
+		Height:    block.Header.Height,
+		BlockHash: types.HashBlock(block),
+	}
+	for _, key := range keys {
+		vote := &proto.Vote{
+			Type:      proto.VoteType_PRECOMMIT,
+			Height:    cert.Height,
+			BlockHash: cert.BlockHash,
+		}
+		types.SignVote(key, defaultChainID, vote)
+		cert.Precommits = append(cert.Precommits, vote)
+	}
+	require.Nil(t, chain.CommitBlock(block, cert))
+}
+
+func TestLightClientFollowsValidatorSet(t *testing.T) {
+	var (
+		chain      = posChain(t)
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		staker     = crypto.GeneratePrivateKey()
+		bond       = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), genesisStake)
+	)
+	lc, err := NewLightClient(PoSGenesis())
+	require.Nil(t, err)
+
+	// the staker joins the set at the end of the epoch and signs from then on
+	commitTxBlock(t, chain, []*crypto.PrivateKey{genesisKey}, bond)
+	for chain.Height()%epochLength != 0 {
+		commitTxBlock(t, chain, []*crypto.PrivateKey{genesisKey})
+	}
+	commitTxBlock(t, chain, []*crypto.PrivateKey{genesisKey, staker})
+	require.Equal(t, 2, chain.Validators().Len())
+
+	headers, err := chain.GetHeaders(1, maxHeaders)
+	require.Nil(t, err)
+	for _, sh := range headers {
+		require.Nil(t, lc.AddHeader(sh))
+	}
+	require.Equal(t, chain.Height(), lc.Height())
+	require.Equal(t, 2, lc.Validators().Len())
+
+	// a peer can not hand over to validators of its own
+	var (
+		forger = crypto.GeneratePrivateKey()
+		block  = randomBlock(t, chain)
+	)
+	types.SignBlock(forger, block)
+	vote := &proto.Vote{
+		Type:      proto.VoteType_PRECOMMIT,
+		Height:    block.Header.Height,
+		BlockHash: types.HashBlock(block),
+	}
+	types.SignVote(forger, defaultChainID, vote)
+	sh := &proto.SignedHeader{
+		Header:    block.Header,
+		PublicKey: block.PublicKey,
+		Signature: block.Signature,
+		Commit: &proto.CommitCertificate{
+			Height:     vote.Height,
+			BlockHash:  vote.BlockHash,
+			Precommits: []*proto.Vote{vote},
+		},
+		Validators: (&ValidatorSet{Validators: []*Validator{{PublicKey: forger.Public().Bytes(), Power: 1}}}).Proto(),
+	}
+	require.NotNil(t, lc.AddHeader(sh))
+
+	// nor leave out the commit
+	sh.Commit = nil
+	sh.Validators = nil
+	require.NotNil(t, lc.AddHeader(sh))
+	require.Equal(t, 2, lc.Validators().Len())
+}
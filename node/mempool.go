@@ -2,16 +2,33 @@ package node
 
 import (
 	"encoding/hex"
+	"errors"
 	"sync"
 
 	"github.com/koshkaj/bloq/proto"
 	"github.com/koshkaj/bloq/types"
 )
 
+const (
+	// time locked txs parked at most
+	maxParkedTxs = 4096
+	// time locked txs parked at most for a single peer
+	maxParkedPerPeer = 64
+)
+
 type Mempool struct {
 	// Binary tree would be more performant to search
 	mu  sync.RWMutex
 	txx map[string]*proto.Transaction
+	// time locked txs wait here until they can be included
+	parked map[string]*parkedTx
+	// parked txs by the peer they came from
+	parkedBy map[string]int
+}
+
+type parkedTx struct {
+	tx   *proto.Transaction
+	from string
 }
 
 func (pool *Mempool) Clear() []*proto.Transaction {
@@ -32,7 +49,21 @@ func (pool *Mempool) Has(tx *proto.Transaction) bool {
 	defer pool.mu.RUnlock()
 	hash := hex.EncodeToString(types.HashTransaction(tx))
 	_, ok := pool.txx[hash]
-	return ok
+	_, parked := pool.parked[hash]
+	return ok || parked
+}
+
+// Get returns the pooled or parked tx with the hex encoded hash.
+func (pool *Mempool) Get(hash string) (*proto.Transaction, bool) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if tx, ok := pool.txx[hash]; ok {
+		return tx, true
+	}
+	if p, ok := pool.parked[hash]; ok {
+		return p.tx, true
+	}
+	return nil, false
 }
 
 func (pool *Mempool) Add(tx *proto.Transaction) {
@@ -42,6 +73,63 @@ func (pool *Mempool) Add(tx *proto.Transaction) {
 	pool.txx[hash] = tx
 }
 
+func (pool *Mempool) Remove(tx *proto.Transaction) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	delete(pool.txx, hash)
+}
+
+// Park keeps the time locked tx the peer sent until it can be included. It
+// reports false once the pool or the peer has too many txs parked.
+func (pool *Mempool) Park(from string, tx *proto.Transaction) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	if _, ok := pool.parked[hash]; ok {
+		return true
+	}
+	if len(pool.parked) >= maxParkedTxs || pool.parkedBy[from] >= maxParkedPerPeer {
+		return false
+	}
+	pool.parked[hash] = &parkedTx{tx: tx, from: from}
+	pool.parkedBy[from]++
+	return true
+}
+
+// Unpark moves the parked txs that passed validation into the pool. Txs that
+// are still time locked stay parked, the others are dropped.
+func (pool *Mempool) Unpark(validate func(*proto.Transaction) error) []*proto.Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	ready := []*proto.Transaction{}
+	for hash, p := range pool.parked {
+		err := validate(p.tx)
+		if errors.Is(err, errTxLocked) {
+			continue
+		}
+		delete(pool.parked, hash)
+		if pool.parkedBy[p.from]--; pool.parkedBy[p.from] == 0 {
+			delete(pool.parkedBy, p.from)
+		}
+		if err == nil {
+			pool.txx[hash] = p.tx
+			ready = append(ready, p.tx)
+		}
+	}
+	return ready
+}
+
+func (pool *Mempool) List() []*proto.Transaction {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	txx := make([]*proto.Transaction, 0, len(pool.txx))
+	for _, tx := range pool.txx {
+		txx = append(txx, tx)
+	}
+	return txx
+}
+
 func (pool *Mempool) Len() int {
 	pool.mu.RLock()
 	defer pool.mu.RUnlock()
@@ -50,6 +138,8 @@ func (pool *Mempool) Len() int {
 
 func NewMempool() *Mempool {
 	return &Mempool{
-		txx: make(map[string]*proto.Transaction),
+		txx:      make(map[string]*proto.Transaction),
+		parked:   make(map[string]*parkedTx),
+		parkedBy: make(map[string]int),
 	}
 }
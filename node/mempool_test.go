@@ -0,0 +1,48 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMempoolUnpark(t *testing.T) {
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		mempool = NewMempool()
+		locked  = lockedTx(t, chain, 2, 0)
+		expired = lockedTx(t, chain, 2, 1)
+	)
+	mempool.Park("", locked)
+	mempool.Park("", expired)
+	require.True(t, mempool.Has(locked))
+	require.Equal(t, 0, mempool.Len())
+
+	// still locked, nothing moves
+	require.Empty(t, mempool.Unpark(chain.ValidateTransaction))
+	require.True(t, mempool.Has(expired))
+
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	require.Equal(t, locked, mempool.Unpark(chain.ValidateTransaction)[0])
+	require.Equal(t, 1, mempool.Len())
+	require.False(t, mempool.Has(expired))
+}
+
+func TestMempoolParkLimit(t *testing.T) {
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		mempool = NewMempool()
+	)
+	for i := 0; i < maxParkedPerPeer; i++ {
+		require.True(t, mempool.Park("a", lockedTx(t, chain, 2, 0)))
+	}
+	require.False(t, mempool.Park("a", lockedTx(t, chain, 2, 0)))
+	require.True(t, mempool.Park("b", lockedTx(t, chain, 2, 0)))
+
+	// released txs make room again
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	relayed := []any{}
+	updatePools(chain, randomBlock(t, chain), mempool, NewEvidencePool(), func(msg any) { relayed = append(relayed, msg) })
+	require.Len(t, relayed, maxParkedPerPeer+1)
+	require.True(t, mempool.Park("a", lockedTx(t, chain, 3, 0)))
+}
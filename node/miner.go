@@ -0,0 +1,204 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"go.uber.org/zap"
+)
+
+// newBlock returns an unsealed block on top of the chain holding the pending
+// evidence and every valid transaction of the mempool.
+func newBlock(chain *Chain, mempool *Mempool, evidence *EvidencePool) (*proto.Block, error) {
+	prevBlock, err := chain.GetBlockByHeight(chain.Height())
+	if err != nil {
+		return nil, err
+	}
+	// timestamps have to increase even if our clock is behind the parent's
+	timestamp := time.Now().UnixNano()
+	if timestamp <= prevBlock.Header.Timestamp {
+		timestamp = prevBlock.Header.Timestamp + 1
+	}
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Height:    prevBlock.Header.Height + 1,
+			PrevHash:  types.HashBlock(prevBlock),
+			Timestamp: timestamp,
+			ChainID:   chain.ChainID(),
+		},
+	}
+	if err := chain.Engine().Prepare(chain, block.Header); err != nil {
+		return nil, err
+	}
+	for _, ev := range evidence.Pending() {
+		tx := &proto.Transaction{
+			Version:  1,
+			Type:     proto.TxType_EVIDENCE,
+			Evidence: ev,
+		}
+		if err := chain.ValidateTransaction(tx); err != nil {
+			evidence.Remove(ev)
+			continue
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	var (
+		spent   = make(map[string]bool)
+		changes = make(stakeChanges)
+	)
+	for _, tx := range mempool.List() {
+		if err := chain.ValidateTransaction(tx); err != nil {
+			mempool.Remove(tx)
+			continue
+		}
+		// the stake an earlier tx of the block unbonded is gone for good
+		if err := chain.checkStakeChanges(tx, changes); err != nil {
+			mempool.Remove(tx)
+			continue
+		}
+		if conflicts(tx, spent) {
+			continue
+		}
+		changes.add(tx)
+		block.Transactions = append(block.Transactions, tx)
+	}
+	root, err := chain.NextStateRoot(block)
+	if err != nil {
+		return nil, err
+	}
+	block.Header.StateRoot = root
+	return block, nil
+}
+
+// conflicts reports whether the tx spends an output another tx of the block
+// already spends, otherwise its inputs are marked as spent.
+func conflicts(tx *proto.Transaction, spent map[string]bool) bool {
+	keys := make([]string, len(tx.Inputs))
+	for i, input := range tx.Inputs {
+		keys[i] = fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+		if spent[keys[i]] {
+			return true
+		}
+	}
+	for _, key := range keys {
+		spent[key] = true
+	}
+	return false
+}
+
+// time the miner waits before it tries again to create a block that failed
+const minerBackoff = time.Second
+
+// Miner keeps sealing blocks on top of the chain for proof-of-work chains.
+// Mining restarts whenever another node extends the chain first.
+type Miner struct {
+	privKey   *crypto.PrivateKey
+	chain     *Chain
+	mempool   *Mempool
+	evidence  *EvidencePool
+	logger    *zap.SugaredLogger
+	broadcast func(msg any)
+
+	tipCh  chan struct{}
+	quitCh chan struct{}
+}
+
+func NewMiner(chain *Chain, mempool *Mempool, evidence *EvidencePool, privKey *crypto.PrivateKey, logger *zap.SugaredLogger, broadcast func(msg any)) *Miner {
+	return &Miner{
+		privKey:   privKey,
+		chain:     chain,
+		mempool:   mempool,
+		evidence:  evidence,
+		logger:    logger,
+		broadcast: broadcast,
+		tipCh:     make(chan struct{}, 1),
+		quitCh:    make(chan struct{}),
+	}
+}
+
+// NewTip aborts the block being mined, it is stale once the chain moved on.
+func (m *Miner) NewTip() {
+	select {
+	case m.tipCh <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Miner) Stop() {
+	close(m.quitCh)
+}
+
+func (m *Miner) run() {
+	m.logger.Infow("starting miner", "pubkey", hex.EncodeToString(m.privKey.Public().Bytes()))
+	for {
+		select {
+		case <-m.quitCh:
+			return
+		default:
+		}
+		block, err := newBlock(m.chain, m.mempool, m.evidence)
+		if err != nil {
+			m.logger.Errorw("could not create block", "err", err)
+			// the chain may be in the middle of a reorg, a new tip is worth
+			// another try right away
+			select {
+			case <-time.After(minerBackoff):
+			case <-m.tipCh:
+			case <-m.quitCh:
+				return
+			}
+			continue
+		}
+		if err := m.mine(block); err != nil {
+			continue
+		}
+		if err := m.chain.AddBlock(block); err != nil {
+			m.logger.Debugw("mined block was rejected", "height", block.Header.Height, "err", err)
+			continue
+		}
+		updatePools(m.chain, block, m.mempool, m.evidence, m.broadcast)
+		m.logger.Infow("mined block",
+			"height", block.Header.Height,
+			"difficulty", block.Header.Difficulty,
+			"hash", hex.EncodeToString(types.HashBlock(block)),
+			"lenTx", len(block.Transactions))
+		m.broadcast(block)
+	}
+}
+
+func (m *Miner) mine(block *proto.Block) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.tipCh:
+		case <-m.quitCh:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return m.chain.Engine().Seal(ctx, block, m.privKey)
+}
+
+// updatePools drops everything the block included from the pools and
+// releases the parked txs that became valid with it, they are relayed now
+// that peers accept them.
+func updatePools(chain *Chain, block *proto.Block, mempool *Mempool, evidence *EvidencePool, broadcast func(msg any)) {
+	for _, tx := range block.Transactions {
+		if tx.Type == proto.TxType_EVIDENCE {
+			evidence.Remove(tx.Evidence)
+			continue
+		}
+		mempool.Remove(tx)
+	}
+	evidence.Prune(int(block.Header.Height))
+	for _, tx := range mempool.Unpark(chain.ValidateTransaction) {
+		broadcast(tx)
+	}
+}
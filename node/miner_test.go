@@ -0,0 +1,170 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/consensus"
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func powChain(t *testing.T) *Chain {
+	genesis := &Genesis{
+		ChainID:    defaultChainID,
+		Consensus:  consensus.PoW,
+		Difficulty: 1 << 8,
+	}
+	chain, err := NewChainFromGenesis(genesis, NewMemoryBlockStore(), NewMemoryTXStore())
+	require.Nil(t, err)
+	return chain
+}
+
+func TestUnknownConsensus(t *testing.T) {
+	_, err := NewChainFromGenesis(&Genesis{ChainID: defaultChainID, Consensus: "pox"}, NewMemoryBlockStore(), NewMemoryTXStore())
+	require.NotNil(t, err)
+}
+
+func TestMiner(t *testing.T) {
+	var (
+		chain  = powChain(t)
+		mined  = make(chan *proto.Block, 16)
+		logger = zap.NewNop().Sugar()
+		miner  = NewMiner(chain, NewMempool(), NewEvidencePool(), crypto.GeneratePrivateKey(), logger, func(msg any) {
+			mined <- msg.(*proto.Block)
+		})
+	)
+	go miner.run()
+	defer miner.Stop()
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case b := <-mined:
+			require.Equal(t, int32(i), b.Header.Height)
+			require.Equal(t, uint64(1<<8), b.Header.Difficulty)
+		case <-time.After(time.Second * 5):
+			t.Fatal("miner did not produce a block")
+		}
+	}
+}
+
+// failingBlockStore fails to read blocks while failing is set.
+type failingBlockStore struct {
+	*MemoryBlockStore
+	failing atomic.Bool
+}
+
+func (s *failingBlockStore) Get(hash string) (*proto.Block, error) {
+	if s.failing.Load() {
+		return nil, fmt.Errorf("store is down")
+	}
+	return s.MemoryBlockStore.Get(hash)
+}
+
+func TestMinerRetries(t *testing.T) {
+	var (
+		store  = &failingBlockStore{MemoryBlockStore: NewMemoryBlockStore()}
+		mined  = make(chan *proto.Block, 16)
+		logger = zap.NewNop().Sugar()
+	)
+	chain, err := NewChainFromGenesis(&Genesis{ChainID: defaultChainID, Consensus: consensus.PoW, Difficulty: 1 << 8}, store, NewMemoryTXStore())
+	require.Nil(t, err)
+	miner := NewMiner(chain, NewMempool(), NewEvidencePool(), crypto.GeneratePrivateKey(), logger, func(msg any) {
+		mined <- msg.(*proto.Block)
+	})
+	store.failing.Store(true)
+	go miner.run()
+	defer miner.Stop()
+
+	// the miner keeps going once the block can be created again
+	time.Sleep(time.Millisecond * 100)
+	store.failing.Store(false)
+	select {
+	case b := <-mined:
+		require.Equal(t, int32(1), b.Header.Height)
+	case <-time.After(minerBackoff * 5):
+		t.Fatal("miner did not produce a block")
+	}
+}
+
+func TestPoWRejectsWrongDifficulty(t *testing.T) {
+	var (
+		chain   = powChain(t)
+		privKey = crypto.GeneratePrivateKey()
+	)
+	block, err := newBlock(chain, NewMempool(), NewEvidencePool())
+	require.Nil(t, err)
+	// the block has to be mined at the difficulty the chain expects
+	block.Header.Difficulty = 1
+	require.Nil(t, chain.Engine().Seal(context.Background(), block, privKey))
+	require.NotNil(t, chain.AddBlock(block))
+
+	block, err = newBlock(chain, NewMempool(), NewEvidencePool())
+	require.Nil(t, err)
+	require.Nil(t, chain.Engine().Seal(context.Background(), block, privKey))
+	require.Nil(t, chain.AddBlock(block))
+}
+
+func sealBlock(t *testing.T, chain *Chain, txx ...*proto.Transaction) *proto.Block {
+	block, err := newBlock(chain, NewMempool(), NewEvidencePool())
+	require.Nil(t, err)
+	block.Transactions = append(block.Transactions, txx...)
+	setStateRoot(t, chain, block)
+	require.Nil(t, chain.Engine().Seal(context.Background(), block, crypto.GeneratePrivateKey()))
+	return block
+}
+
+func TestPoWReorg(t *testing.T) {
+	var (
+		chain  = powChain(t)
+		fork   = powChain(t)
+		staker = crypto.GeneratePrivateKey()
+		bond   = stakeTx(t, chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+		a1     = sealBlock(t, chain, bond)
+	)
+	require.Nil(t, chain.AddBlock(a1))
+	require.Equal(t, int64(minValidatorStake), chain.staking.SelfStake(staker.Public().Bytes()))
+
+	b1 := sealBlock(t, fork)
+	require.Nil(t, fork.AddBlock(b1))
+	b2 := sealBlock(t, fork)
+	require.Nil(t, fork.AddBlock(b2))
+
+	// a branch with the same work does not replace the tip
+	require.Nil(t, chain.AddBlock(b1))
+	tip, err := chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	require.Equal(t, a1, tip)
+
+	require.Nil(t, chain.AddBlock(b2))
+	require.Equal(t, 2, chain.Height())
+	tip, err = chain.GetBlockByHeight(2)
+	require.Nil(t, err)
+	require.Equal(t, b2, tip)
+	require.Equal(t, fork.StateRoot(), chain.StateRoot())
+
+	// everything the disconnected block did is undone
+	_, err = chain.txStore.Get(hex.EncodeToString(types.HashTransaction(bond)))
+	require.NotNil(t, err)
+	require.Equal(t, int64(0), chain.staking.SelfStake(staker.Public().Bytes()))
+	require.Nil(t, chain.ValidateTransaction(bond))
+}
+
+func TestReorgBelowFinalized(t *testing.T) {
+	var (
+		chain = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		side  = randomBlock(t, chain)
+	)
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	// authority chains finalize every block right away
+	require.Equal(t, 1, chain.FinalizedHeight())
+	require.NotNil(t, chain.AddBlock(side))
+	require.Equal(t, 1, chain.Height())
+}
@@ -2,27 +2,51 @@ package node
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
-	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/koshkaj/bloq/consensus"
 	"github.com/koshkaj/bloq/crypto"
 	"github.com/koshkaj/bloq/proto"
 	"github.com/koshkaj/bloq/types"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 )
 
-const blockTime = time.Second * 5
+const (
+	blockTime = time.Second * 5
+	// blocks fetched before they are validated together during sync
+	syncBatchSize = 64
+)
 
 type ServerConfig struct {
 	Version    string
 	ListenAddr string
 	PrivateKey *crypto.PrivateKey
+	// identity of the node towards its peers, it is loaded from NodeKeyPath
+	// or generated if not set
+	NodeKey     *crypto.PrivateKey
+	NodeKeyPath string
+	// defaults to the authority genesis
+	Genesis *Genesis
+	// light nodes only sync headers and verify payments with merkle proofs
+	Light bool
+	// where the address book is kept, it is not persisted if empty
+	AddrBookPath string
+	MaxInbound   int
+	MaxOutbound  int
+	// file listing the nodes to bootstrap from, one address per line
+	SeedsPath string
+	// defaults to TCP
+	Network Network
 }
 
 type Node struct {
@@ -30,8 +54,36 @@ type Node struct {
 	logger *zap.SugaredLogger
 
 	peerLock sync.RWMutex
-	peers    map[proto.NodeClient]*proto.Version
+	peers    map[string]*Peer
+	// addresses that turned out to be our own
+	selfAddrs    map[string]bool
+	peerTimeouts peerTimeouts
+	book         *AddrBook
+	limiter      *rateLimiter
+	creds        credentials.TransportCredentials
+	tlsConfig    *tls.Config
+	// addresses we bootstrap from, and start over from once all peers are gone
+	seeds []string
+	// serializes dialing new outbound peers
+	dialLock sync.Mutex
+	// only one sync with a peer that is ahead runs at a time
+	syncing atomic.Bool
+	// txs and blocks we received or announced
+	seen    *knownInventory
+	invLock sync.Mutex
+	// hashes we asked a peer for, by when we asked
+	requested map[string]time.Time
+	// txs rejected for the state of the chain
+	rejected map[string]rejection
+
+	server   *grpc.Server
+	quitCh   chan struct{}
 	mempool  *Mempool
+	evidence *EvidencePool
+	chain    *Chain
+	bft      *BFT
+	miner    *Miner
+	light    *LightClient
 
 	proto.UnimplementedNodeServer
 }
@@ -40,170 +92,425 @@ func New(cfg ServerConfig) *Node {
 	loggerconfig := zap.NewDevelopmentConfig()
 	loggerconfig.EncoderConfig.TimeKey = ""
 	logger, _ := loggerconfig.Build()
-	return &Node{
-		peers:        make(map[proto.NodeClient]*proto.Version),
+	if cfg.Genesis == nil {
+		cfg.Genesis = DefaultGenesis()
+	}
+	if cfg.MaxInbound == 0 {
+		cfg.MaxInbound = defaultMaxInbound
+	}
+	if cfg.MaxOutbound == 0 {
+		cfg.MaxOutbound = defaultMaxOutbound
+	}
+	if cfg.Network == nil {
+		cfg.Network = tcpNetwork{}
+	}
+	chain, err := NewChainFromGenesis(cfg.Genesis, NewMemoryBlockStore(), NewMemoryTXStore())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.NodeKey == nil {
+		cfg.NodeKey = crypto.GeneratePrivateKey()
+		if cfg.NodeKeyPath != "" {
+			if cfg.NodeKey, err = LoadNodeKey(cfg.NodeKeyPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	tlsConf, err := tlsConfig(cfg.NodeKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	book := NewAddrBook()
+	if cfg.AddrBookPath != "" {
+		if book, err = LoadAddrBook(cfg.AddrBookPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	seeds := []string{}
+	if cfg.SeedsPath != "" {
+		if seeds, err = LoadSeeds(cfg.SeedsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	n := &Node{
+		peers:        make(map[string]*Peer),
+		selfAddrs:    map[string]bool{cfg.ListenAddr: true},
+		peerTimeouts: defaultPeerTimeouts,
+		book:         book,
+		seeds:        seeds,
+		limiter:      newRateLimiter(),
+		seen:         newKnownInventory(maxSeenInventory),
+		requested:    make(map[string]time.Time),
+		rejected:     make(map[string]rejection),
+		creds:        credentials.NewTLS(tlsConf),
+		tlsConfig:    tlsConf,
+		quitCh:       make(chan struct{}),
 		logger:       logger.Sugar(),
 		mempool:      NewMempool(),
+		evidence:     NewEvidencePool(),
+		chain:        chain,
 		ServerConfig: cfg,
 	}
+	if cfg.Light {
+		if n.light, err = NewLightClient(cfg.Genesis); err != nil {
+			log.Fatal(err)
+		}
+		return n
+	}
+	n.bft = NewBFT(n.chain, n.mempool, n.evidence, cfg.PrivateKey, n.logger, n.broadcast)
+	if cfg.PrivateKey != nil {
+		n.miner = NewMiner(n.chain, n.mempool, n.evidence, cfg.PrivateKey, n.logger, n.broadcast)
+	}
+	return n
 }
 
-func (n *Node) bootstrapNetwork(addrs []string) error {
+// usesBFT reports whether blocks are agreed on through BFT rounds instead of
+// being broadcast by whoever sealed them.
+func (n *Node) usesBFT() bool {
+	return n.chain.Engine().Name() == consensus.PoS
+}
+
+func (n *Node) bootstrapNetwork(addrs []string) {
 	for _, addr := range addrs {
-		if !n.canConnectWith(addr) {
-			continue
-		}
-		c, v, err := n.dialRemote(addr)
-		if err != nil {
-			return err
-		}
-		n.addPeer(c, v)
+		n.book.Add(addr, n.ListenAddr)
 	}
-	return nil
+	n.fillPeers()
 }
 
 func (n *Node) getVersion() *proto.Version {
-	return &proto.Version{
+	v := &proto.Version{
 		Version:    "bloq-1",
-		Height:     0,
+		Height:     int32(n.height()),
 		ListenAddr: n.ListenAddr,
-		PeerList:   n.getPeerList(),
 	}
+	types.SignVersion(n.NodeKey, n.chain.ChainID(), v)
+	return v
 }
 
-func (n *Node) getPeerList() []string {
-	n.peerLock.RLock()
-	defer n.peerLock.RUnlock()
-
-	peers := []string{}
-	for _, version := range n.peers {
-		peers = append(peers, version.ListenAddr)
+// checkVersion verifies the handshake of the node at addr that authenticated
+// its connection with key.
+func (n *Node) checkVersion(v *proto.Version, key []byte, addr string) error {
+	if !types.VerifyVersion(n.chain.ChainID(), v) {
+		return fmt.Errorf("handshake of %s is not signed", addr)
 	}
-	return peers
+	if !sameKey(key, v.PublicKey) {
+		return fmt.Errorf("%s did not connect with the key of its handshake", addr)
+	}
+	if n.book.IsNodeBanned(key) {
+		return fmt.Errorf("%s is banned", addr)
+	}
+	if ka, ok := n.book.Get(addr); ok && ka.PublicKey != nil && !sameKey(key, ka.PublicKey) {
+		return fmt.Errorf("%s is pinned to another node key", addr)
+	}
+	return nil
+}
 
+// height is the height of the chain, or of the headers on light nodes.
+func (n *Node) height() int {
+	if n.light != nil {
+		return n.light.Height()
+	}
+	return n.chain.Height()
 }
 
 func (n *Node) Start(listenAddr string, bootstrapNodes []string) error {
 	n.ListenAddr = listenAddr
-	opts := []grpc.ServerOption{}
-	grpcServer := grpc.NewServer(opts...)
-	ln, err := net.Listen("tcp", listenAddr)
+	n.markSelf(listenAddr)
+	opts := []grpc.ServerOption{
+		grpc.Creds(n.creds),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Second * 15,
+			PermitWithoutStream: true,
+		}),
+		grpc.MaxRecvMsgSize(maxMsgSize),
+		grpc.MaxSendMsgSize(maxMsgSize),
+		grpc.MaxConcurrentStreams(maxConcurrentStreams),
+		grpc.UnaryInterceptor(n.guard),
+	}
+	n.server = grpc.NewServer(opts...)
+	ln, err := n.Network.Listen(listenAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	proto.RegisterNodeServer(grpcServer, n)
+	proto.RegisterNodeServer(n.server, n)
 
 	n.logger.Info("node running: ", n.ListenAddr)
-	if len(bootstrapNodes) > 0 {
-		go n.bootstrapNetwork(bootstrapNodes)
+	n.seeds = append(n.seeds, bootstrapNodes...)
+	if len(n.seeds) > 0 {
+		go n.bootstrapNetwork(n.seeds)
 	}
+	go n.pingLoop()
+	go n.addrLoop()
 
-	if n.PrivateKey != nil {
-		go n.validatorLoop()
+	// light nodes do not take part in consensus
+	if n.light == nil {
+		switch n.chain.Engine().Name() {
+		case consensus.PoS:
+			go n.bft.run()
+		case consensus.PoW:
+			if n.miner != nil {
+				go n.miner.run()
+			}
+		case consensus.Authority:
+			if n.PrivateKey != nil {
+				go n.validatorLoop()
+			}
+		}
 	}
 
-	return grpcServer.Serve(ln)
+	return n.server.Serve(ln)
 }
 
-func (n *Node) addPeer(c proto.NodeClient, v *proto.Version) {
-	n.peerLock.Lock()
-	defer n.peerLock.Unlock()
-	n.peers[c] = v
-
-	if len(v.PeerList) > 0 {
-		go n.bootstrapNetwork(v.PeerList)
+// Stop shuts the node down and disconnects from all peers.
+func (n *Node) Stop() {
+	close(n.quitCh)
+	if n.light == nil {
+		n.bft.Stop()
+		if n.miner != nil {
+			n.miner.Stop()
+		}
+	}
+	if n.server != nil {
+		n.server.Stop()
+	}
+	for _, p := range n.Peers() {
+		n.removePeer(p)
+	}
+	if err := n.book.Save(); err != nil {
+		n.logger.Errorw("could not save address book", "err", err)
 	}
-	n.logger.Debugw("new peer connected",
-		"we", n.ListenAddr,
-		"remoteNode", v.ListenAddr,
-		"height", v.Height)
 }
 
-func (n *Node) deletePeer(c proto.NodeClient) {
-	n.peerLock.Lock()
-	defer n.peerLock.Unlock()
-	delete(n.peers, c)
+func (n *Node) HandleTransaction(ctx context.Context, tx *proto.Transaction) (*proto.Ack, error) {
+	if err := n.receiveTx(callerAddr(ctx), tx); err != nil {
+		return nil, err
+	}
+	return &proto.Ack{}, nil
 }
 
-func (n *Node) canConnectWith(addr string) bool {
-	if n.ListenAddr == addr {
-		return false
+// receiveTx adds a tx that passed validation to the mempool and gossips it,
+// a tx that is still time locked is parked for the peer it came from.
+func (n *Node) receiveTx(from string, tx *proto.Transaction) error {
+	if n.light != nil {
+		return fmt.Errorf("light nodes do not relay transactions")
 	}
-	connectedPeers := n.getPeerList()
-	for _, connectedAddr := range connectedPeers {
-		if addr == connectedAddr {
-			return false
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+
+	if n.mempool.Has(tx) {
+		return nil
+	}
+	err := n.chain.ValidateTransaction(tx)
+	if errors.Is(err, errTxLocked) {
+		if !n.mempool.Park(from, tx) {
+			return fmt.Errorf("too many time locked txs are parked")
 		}
+		n.logger.Debugw("parked time locked tx", "hash", hash, "we", n.ListenAddr)
+		return nil
+	}
+	// only txs that can never be valid count as misbehavior, the sender
+	// may just be ahead of us or behind
+	if isStateError(err) {
+		n.rejectTx(hash)
+		return err
 	}
-	return true
+	if err != nil {
+		return invalid(err)
+	}
+	n.mempool.Add(tx)
+	n.logger.Debugw("received tx", "hash", hash, "we", n.ListenAddr)
+	n.broadcast(tx)
+	return nil
 }
 
-func (n *Node) HandleTransaction(ctx context.Context, tx *proto.Transaction) (*proto.Ack, error) {
-	peer, _ := peer.FromContext(ctx)
-	hash := hex.EncodeToString(types.HashTransaction(tx))
-
-	if !n.mempool.Has(tx) {
-		n.mempool.Add(tx)
-		n.logger.Debugw("received tx ", "from", peer.Addr, "hash", hash, "we", n.ListenAddr)
-		go func() {
-			if err := n.broadcast(tx); err != nil {
-				n.logger.Errorw("broadcast error", "err", err)
-			}
-		}()
-	}
-	return &proto.Ack{}, nil
+func (n *Node) GetValidators(ctx context.Context, req *proto.ValidatorSetRequest) (*proto.ValidatorSet, error) {
+	return n.chain.Validators().Proto(), nil
 }
 
-func (n *Node) Handshake(ctx context.Context, v *proto.Version) (*proto.Version, error) {
-	c, err := makeNodeClient(v.ListenAddr)
+func (n *Node) GetBlock(ctx context.Context, req *proto.BlockRequest) (*proto.CommittedBlock, error) {
+	height := int(req.Height)
+	block, err := n.chain.GetBlockByHeight(height)
 	if err != nil {
 		return nil, err
 	}
-	n.addPeer(c, v)
-	return n.getVersion(), nil
+	cb := &proto.CommittedBlock{
+		Block: block,
+	}
+	// only blocks agreed on through BFT carry a commit certificate
+	if n.usesBFT() {
+		commit, err := n.chain.GetCommit(height)
+		if err != nil {
+			return nil, err
+		}
+		cb.Commit = commit
+	}
+	return cb, nil
 }
 
-func (n *Node) broadcast(msg any) error {
-	for peer := range n.peers {
-		switch v := msg.(type) {
-		case *proto.Transaction:
-			_, err := peer.HandleTransaction(context.Background(), v)
-			if err != nil {
-				return err
+// syncWithPeer catches up with a peer that is ahead of us.
+func (n *Node) syncWithPeer(p *Peer, height int) {
+	if height <= n.height() || !n.syncing.CompareAndSwap(false, true) {
+		return
+	}
+	defer n.syncing.Store(false)
+	if n.light != nil {
+		if err := n.light.Sync(p); err != nil {
+			n.logger.Errorw("header sync error", "err", err)
+		}
+		return
+	}
+	n.syncWith(p, height)
+}
+
+// syncWith fetches the committed blocks we are missing from a peer that is
+// ahead of us.
+func (n *Node) syncWith(p *Peer, height int) {
+	batch := []*proto.Block{}
+	for h := n.chain.Height() + 1; h <= height; h++ {
+		ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call)
+		cb, err := p.GetBlock(ctx, &proto.BlockRequest{Height: int32(h)})
+		cancel()
+		n.callDone(p, err)
+		if err != nil {
+			n.logger.Errorw("sync error", "height", h, "err", err)
+			break
+		}
+		if n.usesBFT() {
+			n.bft.HandleCommit(cb)
+			continue
+		}
+		batch = append(batch, cb.Block)
+		if len(batch) == syncBatchSize {
+			if err := n.addBlocks(batch); err != nil {
+				n.misbehaved(p.key(), p.host, invalidBlockPoints, err)
+				return
 			}
+			batch = batch[:0]
 		}
 	}
+	if err := n.addBlocks(batch); err != nil {
+		n.misbehaved(p.key(), p.host, invalidBlockPoints, err)
+	}
+}
+
+// receiveBlock adds a block gossiped on chains that do not use BFT rounds,
+// light nodes take its header.
+func (n *Node) receiveBlock(b *proto.Block) error {
+	if b.Header == nil {
+		return invalid(fmt.Errorf("block has no header"))
+	}
+	if n.light != nil {
+		if n.light.hasHeader(b.Header) {
+			return nil
+		}
+		return n.light.AddHeader(&proto.SignedHeader{
+			Header:    b.Header,
+			PublicKey: b.PublicKey,
+			Signature: b.Signature,
+		})
+	}
+	if n.usesBFT() {
+		return fmt.Errorf("blocks are proposed through consensus on proof-of-stake chains")
+	}
+	if _, err := n.chain.GetBlockByHash(types.HashBlock(b)); err == nil {
+		return nil
+	}
+	// a block that is broken on its own is the sender's fault, one that does
+	// not fit our chain may just be early
+	if err := n.chain.checkBody(b); err != nil {
+		return invalid(err)
+	}
+	if err := n.addBlock(b); err != nil {
+		return err
+	}
+	n.logger.Debugw("received block", "height", b.Header.Height, "we", n.ListenAddr)
+	n.broadcast(b)
 	return nil
 }
 
-func (n *Node) validatorLoop() {
-	n.logger.Infow("starting validator loop", "pubkey", n.PrivateKey.Public(), "blocktime", blockTime)
-	ticker := time.NewTicker(blockTime)
+func (n *Node) GetHeaders(ctx context.Context, req *proto.HeadersRequest) (*proto.Headers, error) {
+	if n.light != nil {
+		return nil, fmt.Errorf("light nodes do not serve headers")
+	}
+	headers, err := n.chain.GetHeaders(int(req.From), int(req.Count))
+	if err != nil {
+		return nil, err
+	}
+	return &proto.Headers{Headers: headers}, nil
+}
 
-	for {
-		<-ticker.C
-		txx := n.mempool.Clear()
-		n.logger.Debugw("time to create a new block", "lenTx", len(txx))
+func (n *Node) GetTxProof(ctx context.Context, req *proto.TxProofRequest) (*proto.TxProof, error) {
+	if n.light != nil {
+		return nil, fmt.Errorf("light nodes do not serve proofs")
 	}
+	return n.chain.GetTxProof(req.TxHash)
+}
 
+// VerifyPayment checks with the connected full nodes that the tx is included
+// in the chain, it is meant for light nodes.
+func (n *Node) VerifyPayment(txHash []byte) error {
+	if n.light == nil {
+		_, err := n.chain.GetTxProof(txHash)
+		return err
+	}
+	for _, peer := range n.Peers() {
+		if err := n.light.VerifyPayment(peer, txHash); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no peer could prove tx %s", hex.EncodeToString(txHash))
 }
 
-func (n *Node) dialRemote(addr string) (proto.NodeClient, *proto.Version, error) {
-	c, err := makeNodeClient(addr)
-	if err != nil {
-		return nil, nil, err
+// addBlock adds a block sealed by someone else to a chain that does not use
+// BFT rounds.
+func (n *Node) addBlock(b *proto.Block) error {
+	if err := n.chain.AddBlock(b); err != nil {
+		return err
 	}
-	v, err := c.Handshake(context.Background(), n.getVersion())
-	if err != nil {
-		return nil, nil, err
+	updatePools(n.chain, b, n.mempool, n.evidence, n.broadcast)
+	if n.miner != nil {
+		n.miner.NewTip()
 	}
-	return c, v, nil
+	return nil
 }
 
-func makeNodeClient(listenAddr string) (proto.NodeClient, error) {
-	c, err := grpc.Dial(listenAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, err
+// addBlocks adds a run of blocks through the validation pipeline of the chain.
+func (n *Node) addBlocks(blocks []*proto.Block) error {
+	added, err := n.chain.AddBlocks(blocks)
+	for _, b := range blocks[:added] {
+		updatePools(n.chain, b, n.mempool, n.evidence, n.broadcast)
+	}
+	if added > 0 && n.miner != nil {
+		n.miner.NewTip()
+	}
+	return err
+}
+
+// validatorLoop seals a block every blockTime on authority chains.
+func (n *Node) validatorLoop() {
+	n.logger.Infow("starting validator loop", "pubkey", n.PrivateKey.Public(), "blocktime", blockTime)
+	ticker := time.NewTicker(blockTime)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quitCh:
+			return
+		}
+		block, err := newBlock(n.chain, n.mempool, n.evidence)
+		if err != nil {
+			n.logger.Errorw("could not create block", "err", err)
+			continue
+		}
+		if err := n.chain.Engine().Seal(context.Background(), block, n.PrivateKey); err != nil {
+			n.logger.Errorw("could not seal block", "err", err)
+			continue
+		}
+		if err := n.addBlock(block); err != nil {
+			n.logger.Errorw("sealed block was rejected", "err", err)
+			continue
+		}
+		n.logger.Debugw("created new block", "height", block.Header.Height, "lenTx", len(block.Transactions))
+		n.broadcast(block)
 	}
-	return proto.NewNodeClient(c), nil
 }
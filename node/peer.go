@@ -0,0 +1,653 @@
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// peers failing this many calls in a row are disconnected
+	maxPeerFailures = 3
+	// misbehavior points for serving a block that does not validate
+	invalidBlockPoints = 50
+	// envelopes waiting to be sent to a peer, per priority
+	peerQueueSize = 256
+
+	defaultMaxInbound  = 32
+	defaultMaxOutbound = 8
+)
+
+var errPeerClosed = status.Error(codes.Unavailable, "peer disconnected")
+
+type peerTimeouts struct {
+	// every peer is pinged this often
+	ping time.Duration
+	// calls to a peer that take longer have failed
+	call time.Duration
+	// redialing an address waits minBackoff, doubling after every failed attempt
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// a random peer is asked for addresses this often
+	addrRefresh time.Duration
+}
+
+var defaultPeerTimeouts = peerTimeouts{
+	ping:        time.Second * 10,
+	call:        time.Second * 5,
+	minBackoff:  time.Second,
+	maxBackoff:  time.Minute,
+	addrRefresh: time.Minute * 10,
+}
+
+// envelopeStream is the stream of a peer, whichever side dialed.
+type envelopeStream interface {
+	Send(*proto.Envelope) error
+	Recv() (*proto.Envelope, error)
+	Context() context.Context
+}
+
+// Peer is the stream to another node. Everything we send the peer goes
+// through its queues, a single writer drains them so that a slow peer only
+// holds up itself.
+type Peer struct {
+	stream envelopeStream
+	// outbound peers own the connection of their stream
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+	// the address we know the peer by
+	addr string
+	// the host the connection comes from or goes to, bans hold against it
+	host    string
+	version *proto.Version
+	// the peer dialed us
+	inbound bool
+	// the address is known to reach the peer, so it is handed out to others
+	listening bool
+	// calls in a row that did not reach the peer
+	failures atomic.Int32
+	// txs and blocks the peer has, they are not announced to it
+	known *knownInventory
+
+	// consensus messages and requests go out ahead of the rest
+	high      chan *proto.Envelope
+	low       chan *proto.Envelope
+	done      chan struct{}
+	closeOnce sync.Once
+
+	reqLock sync.Mutex
+	nextID  uint64
+	// requests waiting for their response, by request id
+	pending map[uint64]chan *proto.Envelope
+}
+
+func newPeer(stream envelopeStream, addr string, v *proto.Version, inbound bool) *Peer {
+	return &Peer{
+		stream:  stream,
+		addr:    addr,
+		host:    hostOf(addr),
+		version: v,
+		inbound: inbound,
+		known:   newKnownInventory(maxKnownInventory),
+		high:    make(chan *proto.Envelope, peerQueueSize),
+		low:     make(chan *proto.Envelope, peerQueueSize),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan *proto.Envelope),
+	}
+}
+
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+// Close ends the stream, the node drops the peer once it noticed.
+func (p *Peer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		if p.cancel != nil {
+			p.cancel()
+		}
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	})
+	return nil
+}
+
+func (p *Peer) key() []byte {
+	return p.version.PublicKey
+}
+
+func (p *Peer) queue(env *proto.Envelope) chan *proto.Envelope {
+	if urgent(env) {
+		return p.high
+	}
+	return p.low
+}
+
+// trySend queues the envelope if there is room, it reports whether there was.
+func (p *Peer) trySend(env *proto.Envelope) bool {
+	select {
+	case p.queue(env) <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue waits for room in the queue until ctx is done, this is how a peer
+// that does not keep up pushes back on us.
+func (p *Peer) enqueue(ctx context.Context, env *proto.Envelope) error {
+	select {
+	case p.queue(env) <- env:
+		return nil
+	case <-p.done:
+		return errPeerClosed
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (p *Peer) writeLoop() {
+	for {
+		var env *proto.Envelope
+		select {
+		case env = <-p.high:
+		default:
+			select {
+			case env = <-p.high:
+			case env = <-p.low:
+			case <-p.done:
+				return
+			}
+		}
+		if err := p.stream.Send(env); err != nil {
+			p.Close()
+			return
+		}
+	}
+}
+
+// request sends the envelope and waits for the response the peer echoes its
+// request id with.
+func (p *Peer) request(ctx context.Context, env *proto.Envelope) (*proto.Envelope, error) {
+	ch := make(chan *proto.Envelope, 1)
+	p.reqLock.Lock()
+	p.nextID++
+	env.RequestId = p.nextID
+	p.pending[env.RequestId] = ch
+	p.reqLock.Unlock()
+	defer func() {
+		p.reqLock.Lock()
+		delete(p.pending, env.RequestId)
+		p.reqLock.Unlock()
+	}()
+
+	if err := p.enqueue(ctx, env); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return nil, fmt.Errorf("%s: %s", p.Addr(), resp.Error)
+		}
+		return resp, nil
+	case <-p.done:
+		return nil, errPeerClosed
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// deliver hands a response to the request waiting for it.
+func (p *Peer) deliver(resp *proto.Envelope) {
+	p.reqLock.Lock()
+	defer p.reqLock.Unlock()
+	if ch, ok := p.pending[resp.RequestId]; ok {
+		ch <- resp
+		delete(p.pending, resp.RequestId)
+	}
+}
+
+// advertisedAddr completes the listen address a node advertised with the host
+// of its connection if it left the host out, like nodes that listen on ":3001".
+func advertisedAddr(listenAddr string, remote *peer.Peer) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("listen address %s has an invalid port", listenAddr)
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr, nil
+	}
+	if remote == nil || remote.Addr == nil {
+		return "", fmt.Errorf("listen address %s has no host", listenAddr)
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.Addr.String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(remoteHost, port), nil
+}
+
+// unreachable reports whether the call failed because the peer could not be
+// reached, rather than the peer rejecting what we sent.
+func unreachable(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+func (n *Node) dial(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr,
+		grpc.WithTransportCredentials(n.creds),
+		grpc.WithContextDialer(n.Network.Dial),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Second * 30,
+			Timeout:             time.Second * 10,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(maxMsgSize),
+			grpc.MaxCallSendMsgSize(maxMsgSize),
+		),
+	)
+}
+
+// Peers returns the peers we are connected to.
+func (n *Node) Peers() []*Peer {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (n *Node) peerCount(inbound bool) int {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+	count := 0
+	for _, p := range n.peers {
+		if p.inbound == inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// connect dials the node at addr and opens a stream to it, the node is added
+// as a peer once it accepted our version.
+func (n *Node) connect(addr string) error {
+	if n.book.IsHostBanned(hostOf(addr)) {
+		return fmt.Errorf("%s is banned", addr)
+	}
+	n.book.Attempt(addr)
+	conn, err := n.dial(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := n.openStream(ctx, conn, addr)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return err
+	}
+	p.conn, p.cancel = conn, cancel
+	if err := n.addPeer(p); err != nil {
+		p.Close()
+		return err
+	}
+	go n.servePeer(p)
+	return nil
+}
+
+func (n *Node) openStream(ctx context.Context, conn *grpc.ClientConn, addr string) (*Peer, error) {
+	stream, err := proto.NewNodeClient(conn).Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(versionEnvelope(n.getVersion())); err != nil {
+		return nil, err
+	}
+	env, err := recvTimeout(stream, n.peerTimeouts.call)
+	key := callerKey(stream.Context())
+	if sameKey(key, n.NodeKey.Public().Bytes()) {
+		n.markSelf(addr)
+		return nil, fmt.Errorf("%s is ourselves", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	v := env.GetVersion()
+	if v == nil {
+		return nil, fmt.Errorf("%s did not answer with its version", addr)
+	}
+	if err := n.checkVersion(v, key, addr); err != nil {
+		return nil, err
+	}
+	if err := n.book.Pin(addr, key); err != nil {
+		return nil, err
+	}
+	p := newPeer(stream, addr, v, false)
+	p.listening = true
+	return p, nil
+}
+
+// accept runs the checks on the version of a node that dialed us. The
+// address it advertises is completed with the host it connected from and
+// probed, a node that turns out to be behind a NAT is still accepted but
+// known by the address of its connection and not handed out to other nodes.
+func (n *Node) accept(ctx context.Context, stream envelopeStream, v *proto.Version) (*Peer, error) {
+	key := callerKey(ctx)
+	if sameKey(key, n.NodeKey.Public().Bytes()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "connected to ourselves")
+	}
+	remote, _ := peer.FromContext(ctx)
+	addr, err := advertisedAddr(v.ListenAddr, remote)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	if n.book.IsBanned(addr) || n.book.IsNodeBanned(key) || n.book.IsHostBanned(hostOf(remote.Addr.String())) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is banned", addr)
+	}
+	if n.peerCount(true) >= n.MaxInbound {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many inbound peers")
+	}
+	if err := n.checkVersion(v, key, addr); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	p := newPeer(stream, addr, v, true)
+	// the advertised address is up to the peer, the connection is not
+	p.host = hostOf(remote.Addr.String())
+	if err := n.probe(addr, key); err != nil {
+		n.logger.Infow("peer can not be dialed back", "we", n.ListenAddr, "peer", addr, "err", err)
+		p.addr = remote.Addr.String()
+		return p, nil
+	}
+	if err := n.book.Pin(addr, key); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	n.book.Add(addr, addr)
+	p.listening = true
+	return p, nil
+}
+
+// probe checks that the node with key listens at addr. It only takes a TLS
+// handshake, the connection is closed right away.
+func (n *Node) probe(addr string, key []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call/2)
+	defer cancel()
+	raw, err := n.Network.Dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(raw, n.tlsConfig)
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	if !sameKey(stateKey(conn.ConnectionState()), key) {
+		return fmt.Errorf("another node listens at %s", addr)
+	}
+	return nil
+}
+
+// servePeer runs the peer until its stream ends.
+func (n *Node) servePeer(p *Peer) {
+	go p.writeLoop()
+	go func() {
+		n.readLoop(p)
+		p.Close()
+	}()
+	<-p.done
+	n.removePeer(p)
+}
+
+// markSelf remembers that addr reaches ourselves, it is never dialed again.
+func (n *Node) markSelf(addr string) {
+	n.peerLock.Lock()
+	n.selfAddrs[addr] = true
+	n.peerLock.Unlock()
+	n.book.Remove(addr)
+}
+
+func (n *Node) isSelf(addr string) bool {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+	return n.selfAddrs[addr]
+}
+
+// dialer returns the key of the node that opened the stream of the peer.
+func (n *Node) dialer(p *Peer) []byte {
+	if p.inbound {
+		return p.key()
+	}
+	return n.NodeKey.Public().Bytes()
+}
+
+func (n *Node) addPeer(p *Peer) error {
+	n.peerLock.Lock()
+	// a dial that was underway when the node stopped
+	select {
+	case <-n.quitCh:
+		n.peerLock.Unlock()
+		return fmt.Errorf("node is stopped")
+	default:
+	}
+	for addr, old := range n.peers {
+		if addr != p.Addr() && !sameKey(p.key(), old.key()) {
+			continue
+		}
+		// two nodes that dialed each other at once both keep the stream the
+		// lower key opened, otherwise a node that restarted replaces its old,
+		// dead stream
+		if old.inbound != p.inbound && string(n.dialer(old)) < string(n.dialer(p)) {
+			n.peerLock.Unlock()
+			return fmt.Errorf("already connected to %s", addr)
+		}
+		delete(n.peers, addr)
+		old.Close()
+	}
+	n.peers[p.Addr()] = p
+	n.peerLock.Unlock()
+
+	if p.listening {
+		n.book.Connected(p.Addr())
+	}
+	// nodes we dialed tell us about others, the ones that dialed us could
+	// have made their answer up for us
+	if !p.inbound {
+		go n.exchangeAddrs(p)
+	}
+	go n.fillPeers()
+	go n.syncWithPeer(p, int(p.version.Height))
+	n.logger.Debugw("new peer connected",
+		"we", n.ListenAddr,
+		"remoteNode", p.Addr(),
+		"inbound", p.inbound,
+		"height", p.version.Height)
+	return nil
+}
+
+// removePeer disconnects the peer, unless it was replaced by a newer
+// connection to the same node meanwhile.
+func (n *Node) removePeer(p *Peer) {
+	n.peerLock.Lock()
+	defer n.peerLock.Unlock()
+	if n.peers[p.Addr()] == p {
+		delete(n.peers, p.Addr())
+		if p.listening {
+			n.book.Disconnected(p.Addr())
+		}
+	}
+	p.Close()
+}
+
+// fillPeers dials the best addresses of the book until we have as many
+// outbound peers as allowed. Addresses that failed are retried with backoff.
+func (n *Node) fillPeers() {
+	n.dialLock.Lock()
+	defer n.dialLock.Unlock()
+	missing := n.MaxOutbound - n.peerCount(false)
+	if missing <= 0 {
+		return
+	}
+	n.peerLock.RLock()
+	skip := make(map[string]bool, len(n.peers)+len(n.selfAddrs))
+	for addr := range n.peers {
+		skip[addr] = true
+	}
+	for addr := range n.selfAddrs {
+		skip[addr] = true
+	}
+	n.peerLock.RUnlock()
+	for _, addr := range n.book.Candidates(missing, skip, n.peerTimeouts.minBackoff, n.peerTimeouts.maxBackoff) {
+		if err := n.connect(addr); err != nil {
+			n.logger.Debugw("could not connect", "we", n.ListenAddr, "peer", addr, "err", err)
+		}
+	}
+}
+
+// misbehaved counts misbehavior against the node key and disconnects the
+// peers with the key once that got it banned. The host the misbehavior came
+// from is banned along with the key.
+func (n *Node) misbehaved(key []byte, host string, points int, err error) {
+	id := hex.EncodeToString(key)
+	n.logger.Infow("peer misbehaved", "we", n.ListenAddr, "peer", id, "points", points, "err", err)
+	if !n.book.Misbehaved(key, points) {
+		return
+	}
+	n.book.BanHost(host)
+	n.logger.Warnw("banned peer", "we", n.ListenAddr, "peer", id, "host", host)
+	for _, p := range n.Peers() {
+		if sameKey(p.key(), key) {
+			n.removePeer(p)
+		}
+	}
+}
+
+// callDone records the outcome of a request to the peer. Peers that did not
+// answer maxPeerFailures times in a row are disconnected, fillPeers dials
+// them again later.
+func (n *Node) callDone(p *Peer, err error) {
+	if err == nil || !unreachable(err) {
+		p.failures.Store(0)
+		return
+	}
+	if p.failures.Add(1) == maxPeerFailures {
+		n.logger.Infow("peer is unreachable", "we", n.ListenAddr, "peer", p.Addr(), "err", err)
+		n.removePeer(p)
+	}
+}
+
+// pingLoop checks on every peer each ping interval and catches up with the
+// ones that got ahead of us. It also tops up the outbound peers, forgets
+// undelivered requests, announces the mempool to a random peer and saves the
+// address book.
+func (n *Node) pingLoop() {
+	ticker := time.NewTicker(n.peerTimeouts.ping)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quitCh:
+			return
+		}
+		peers := n.Peers()
+		for _, p := range peers {
+			go n.ping(p)
+		}
+		go n.fillPeers()
+		n.forgetRequests()
+		if len(peers) > 0 {
+			n.announceMempool(peers[rand.Intn(len(peers))])
+		}
+		n.limiter.prune(limiterIdle)
+		if err := n.book.Save(); err != nil {
+			n.logger.Errorw("could not save address book", "err", err)
+		}
+	}
+}
+
+func (n *Node) ping(p *Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call)
+	defer cancel()
+	start := time.Now()
+	pong, err := p.Ping(ctx, &proto.PingRequest{
+		Nonce:  rand.Uint64(),
+		Height: int32(n.height()),
+	})
+	n.callDone(p, err)
+	if err != nil {
+		return
+	}
+	if p.listening {
+		n.book.Pinged(p.Addr(), time.Since(start))
+	}
+	n.syncWithPeer(p, int(pong.Height))
+}
+
+// broadcast announces a tx to the peers that do not know it yet, they fetch
+// it if they lack it. Blocks are pushed to them as compact blocks right away,
+// consensus messages are pushed whole.
+func (n *Node) broadcast(msg any) {
+	item, ok := inventoryItem(msg)
+	if !ok {
+		env := envelope(msg)
+		for _, p := range n.Peers() {
+			n.send(p, env)
+		}
+		return
+	}
+	hash := hex.EncodeToString(item.Hash)
+	n.seen.Add(hash)
+	env := &proto.Envelope{Payload: &proto.Envelope_Inventory{Inventory: &proto.Inventory{Items: []*proto.InvItem{item}}}}
+	if b, ok := msg.(*proto.Block); ok {
+		env = envelope(types.NewCompactBlock(b, rand.Uint64()))
+	}
+	for _, p := range n.Peers() {
+		if p.known.Add(hash) {
+			n.send(p, env)
+		}
+	}
+}
+
+// send queues the envelope for the peer without holding up the caller. Gossip
+// that finds the queue full is dropped, the rest waits for room for up to a
+// call timeout, a peer that does not make room by then is disconnected.
+func (n *Node) send(p *Peer, env *proto.Envelope) {
+	if p.trySend(env) {
+		return
+	}
+	if droppable(env) {
+		n.logger.Debugw("send queue full, dropped message", "we", n.ListenAddr, "peer", p.Addr())
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call)
+		defer cancel()
+		if err := p.enqueue(ctx, env); err != nil {
+			n.logger.Infow("peer does not keep up", "we", n.ListenAddr, "peer", p.Addr(), "err", err)
+			n.removePeer(p)
+		}
+	}()
+}
@@ -0,0 +1,325 @@
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var testPeerTimeouts = peerTimeouts{
+	ping:        time.Millisecond * 50,
+	call:        time.Millisecond * 200,
+	minBackoff:  time.Millisecond * 50,
+	maxBackoff:  time.Millisecond * 200,
+	addrRefresh: time.Millisecond * 500,
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func testNode(cfg ServerConfig, timeouts peerTimeouts) *Node {
+	n := New(cfg)
+	n.logger = zap.NewNop().Sugar()
+	n.peerTimeouts = timeouts
+	return n
+}
+
+func startNode(t *testing.T, timeouts peerTimeouts, addr string, bootstrap ...string) *Node {
+	n := testNode(ServerConfig{Version: "bloq-1", ListenAddr: addr}, timeouts)
+	go n.Start(addr, bootstrap)
+	return n
+}
+
+// asNode is the context of an inbound call from a node that authenticated
+// with key.
+func asNode(t *testing.T, key *crypto.PrivateKey) context.Context {
+	cert, err := nodeCertificate(key)
+	require.Nil(t, err)
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err)
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{x509Cert}},
+		},
+	})
+}
+
+func signedVersion(n *Node, key *crypto.PrivateKey, addr string) *proto.Version {
+	v := &proto.Version{Version: "bloq-1", ListenAddr: addr}
+	types.SignVersion(key, n.chain.ChainID(), v)
+	return v
+}
+
+func hasPeer(n *Node, addr string) bool {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+	_, ok := n.peers[addr]
+	return ok
+}
+
+func TestPeerReconnectsAfterRestart(t *testing.T) {
+	var (
+		addrA = freeAddr(t)
+		addrB = freeAddr(t)
+		// a keeps its identity across the restart, b pinned it
+		cfgA = ServerConfig{Version: "bloq-1", ListenAddr: addrA, NodeKey: crypto.GeneratePrivateKey()}
+		a    = testNode(cfgA, testPeerTimeouts)
+	)
+	go a.Start(addrA, nil)
+	// give a a moment to listen before b dials it
+	time.Sleep(time.Millisecond * 50)
+	b := startNode(t, testPeerTimeouts, addrB, addrA)
+	defer b.Stop()
+	require.Eventually(t, func() bool { return hasPeer(a, addrB) && hasPeer(b, addrA) }, time.Second*3, time.Millisecond*10)
+
+	a.Stop()
+	require.Eventually(t, func() bool { return len(b.Peers()) == 0 }, time.Second*3, time.Millisecond*10)
+
+	a = testNode(cfgA, testPeerTimeouts)
+	go a.Start(addrA, nil)
+	defer a.Stop()
+	require.Eventually(t, func() bool { return hasPeer(a, addrB) && hasPeer(b, addrA) }, time.Second*3, time.Millisecond*10)
+}
+
+func TestBroadcastSkipsDeadPeer(t *testing.T) {
+	var (
+		addrA = freeAddr(t)
+		addrB = freeAddr(t)
+		addrC = freeAddr(t)
+		a     = startNode(t, testPeerTimeouts, addrA)
+		c     = startNode(t, testPeerTimeouts, addrC)
+	)
+	defer c.Stop()
+	time.Sleep(time.Millisecond * 50)
+	// b does not ping, so it still believes a to be there once a is gone
+	timeouts := testPeerTimeouts
+	timeouts.ping = time.Hour
+	b := startNode(t, timeouts, addrB, addrA, addrC)
+	defer b.Stop()
+	require.Eventually(t, func() bool { return len(b.Peers()) == 2 }, time.Second*3, time.Millisecond*10)
+	a.Stop()
+
+	staker := crypto.GeneratePrivateKey()
+	tx := stakeTx(t, b.chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	b.mempool.Add(tx)
+	for i := 0; i < 3; i++ {
+		b.broadcast(tx)
+	}
+	require.Eventually(t, func() bool { return c.mempool.Has(tx) }, time.Second*3, time.Millisecond*10)
+	require.Eventually(t, func() bool { return len(b.Peers()) == 1 }, time.Second*3, time.Millisecond*10)
+}
+
+func TestHandshakeAuthentication(t *testing.T) {
+	var (
+		addr  = freeAddr(t)
+		m     = startNode(t, testPeerTimeouts, addr)
+		n     = testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+		key   = m.NodeKey
+		other = crypto.GeneratePrivateKey()
+	)
+	defer m.Stop()
+	defer n.Stop()
+	time.Sleep(time.Millisecond * 50)
+
+	unsigned := &proto.Version{Version: "bloq-1", ListenAddr: addr, PublicKey: key.Public().Bytes()}
+	_, err := n.accept(asNode(t, key), nil, unsigned)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a handshake replayed over a connection with another key
+	_, err = n.accept(asNode(t, other), nil, signedVersion(n, key, addr))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// claiming the address of another node fails the probe
+	p, err := n.accept(asNode(t, other), nil, signedVersion(n, other, addr))
+	require.Nil(t, err)
+	require.False(t, p.listening)
+	require.NotEqual(t, addr, p.Addr())
+
+	p, err = n.accept(asNode(t, key), nil, signedVersion(n, key, addr))
+	require.Nil(t, err)
+	require.True(t, p.listening)
+	require.Equal(t, addr, p.Addr())
+	ka, _ := n.book.Get(addr)
+	require.Equal(t, key.Public().Bytes(), ka.PublicKey)
+
+	// the address is pinned to key now
+	_, err = n.accept(asNode(t, other), nil, signedVersion(n, other, addr))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestAdvertisedAddr(t *testing.T) {
+	remote := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(172, 17, 0, 3), Port: 53124}}
+	for listenAddr, want := range map[string]string{
+		":3001":              "172.17.0.3:3001",
+		"0.0.0.0:3001":       "172.17.0.3:3001",
+		"[::]:3001":          "172.17.0.3:3001",
+		"10.0.0.1:3001":      "10.0.0.1:3001",
+		"node.example:3001":  "node.example:3001",
+		"172.17.0.3:0":       "",
+		"172.17.0.3:99999":   "",
+		"no port":            "",
+		"172.17.0.3:notport": "",
+	} {
+		addr, err := advertisedAddr(listenAddr, remote)
+		if want == "" {
+			require.NotNil(t, err, listenAddr)
+			continue
+		}
+		require.Nil(t, err, listenAddr)
+		require.Equal(t, want, addr)
+	}
+	_, err := advertisedAddr(":3001", nil)
+	require.NotNil(t, err)
+}
+
+func TestPeerBehindNAT(t *testing.T) {
+	var (
+		addrA = freeAddr(t)
+		a     = startNode(t, testPeerTimeouts, addrA)
+	)
+	defer a.Stop()
+	time.Sleep(time.Millisecond * 50)
+
+	// b advertises an address nobody can dial
+	b := testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t)}, testPeerTimeouts)
+	defer b.Stop()
+	b.ListenAddr = "127.0.0.1:1"
+	require.Nil(t, b.connect(addrA))
+
+	// a keeps b on the stream b opened, but does not hand out its address
+	require.True(t, hasPeer(b, addrA))
+	require.Eventually(t, func() bool { return len(a.Peers()) == 1 }, time.Second*3, time.Millisecond*10)
+	require.False(t, a.Peers()[0].listening)
+	require.Empty(t, a.book.Sample(maxAddrSample))
+	_, ok := a.book.Get("127.0.0.1:1")
+	require.False(t, ok)
+
+	// and gossip reaches b all the same
+	staker := crypto.GeneratePrivateKey()
+	tx := stakeTx(t, a.chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+	require.Nil(t, a.receiveTx("", tx))
+	require.Eventually(t, func() bool { return b.mempool.Has(tx) }, time.Second*3, time.Millisecond*10)
+}
+
+func TestSingleStreamPerPeer(t *testing.T) {
+	var (
+		addrA = freeAddr(t)
+		addrB = freeAddr(t)
+	)
+	// both dial each other at once
+	a := startNode(t, testPeerTimeouts, addrA, addrB)
+	b := startNode(t, testPeerTimeouts, addrB, addrA)
+	defer a.Stop()
+	defer b.Stop()
+	require.Eventually(t, func() bool { return hasPeer(a, addrB) && hasPeer(b, addrA) }, time.Second*3, time.Millisecond*10)
+	time.Sleep(testPeerTimeouts.ping * 3)
+	require.Len(t, a.Peers(), 1)
+	require.Len(t, b.Peers(), 1)
+	// one side dialed, the other accepted
+	require.NotEqual(t, a.Peers()[0].inbound, b.Peers()[0].inbound)
+}
+
+// blockedStream holds every send until it is released.
+type blockedStream struct {
+	envelopeStream
+	release chan struct{}
+	sent    chan *proto.Envelope
+}
+
+func (s *blockedStream) Send(env *proto.Envelope) error {
+	<-s.release
+	s.sent <- env
+	return nil
+}
+
+func TestPeerQueues(t *testing.T) {
+	stream := &blockedStream{
+		release: make(chan struct{}),
+		sent:    make(chan *proto.Envelope, peerQueueSize*2),
+	}
+	p := newPeer(stream, "127.0.0.1:3000", &proto.Version{}, false)
+	defer p.Close()
+
+	// the writer picks the first tx and blocks on it
+	tx := envelope(&proto.Transaction{Version: 1})
+	require.True(t, p.trySend(tx))
+	go p.writeLoop()
+	time.Sleep(time.Millisecond * 20)
+	for i := 0; i < peerQueueSize; i++ {
+		require.True(t, p.trySend(tx))
+	}
+	// a full queue drops gossip, and pushes back on the rest
+	require.False(t, p.trySend(tx))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(p.enqueue(ctx, envelope(&proto.Block{}))))
+
+	// votes skip the queued txs
+	require.True(t, p.trySend(envelope(&proto.Vote{})))
+	close(stream.release)
+	require.NotNil(t, (<-stream.sent).GetTransaction())
+	require.NotNil(t, (<-stream.sent).GetVote())
+}
+
+func TestSelfConnection(t *testing.T) {
+	addr := freeAddr(t)
+	// a different spelling of our own address
+	alias := strings.Replace(addr, "127.0.0.1", "localhost", 1)
+	n := startNode(t, testPeerTimeouts, addr, alias)
+	defer n.Stop()
+	require.Eventually(t, func() bool { return n.isSelf(alias) }, time.Second*3, time.Millisecond*10)
+	require.Empty(t, n.Peers())
+	_, ok := n.book.Get(alias)
+	require.False(t, ok)
+}
+
+func TestMaxPeers(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	nodes := []*Node{}
+	for _, addr := range addrs {
+		n := startNode(t, testPeerTimeouts, addr)
+		defer n.Stop()
+		nodes = append(nodes, n)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	addr := freeAddr(t)
+	n := testNode(ServerConfig{Version: "bloq-1", ListenAddr: addr, MaxOutbound: 1}, testPeerTimeouts)
+	go n.Start(addr, addrs)
+	defer n.Stop()
+	require.Eventually(t, func() bool { return len(n.Peers()) == 1 }, time.Second*3, time.Millisecond*10)
+	// the rest are known but not dialed
+	time.Sleep(testPeerTimeouts.ping * 3)
+	require.Len(t, n.Peers(), 1)
+	require.Equal(t, len(addrs), n.book.Len())
+
+	// nodes that are full turn away inbound peers
+	full := testNode(ServerConfig{Version: "bloq-1", ListenAddr: freeAddr(t), MaxInbound: 1}, testPeerTimeouts)
+	key := nodes[0].NodeKey
+	p, err := full.accept(asNode(t, key), nil, signedVersion(full, key, addrs[0]))
+	require.Nil(t, err)
+	require.Nil(t, full.addPeer(p))
+	key = nodes[1].NodeKey
+	_, err = full.accept(asNode(t, key), nil, signedVersion(full, key, addrs[1]))
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	full.Stop()
+}
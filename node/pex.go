@@ -0,0 +1,108 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/koshkaj/bloq/proto"
+)
+
+// addresses a single peer exchange hands out at most
+const maxAddrSample = 250
+
+// LoadSeeds reads the seed list at path, one address per line. Blank lines
+// and lines starting with # are skipped.
+func LoadSeeds(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seeds := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			return nil, fmt.Errorf("seed %q in %s: %w", line, path, err)
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, scanner.Err()
+}
+
+// GetAddrs hands out a random sample of the addresses we know to be good.
+func (n *Node) GetAddrs(ctx context.Context, req *proto.AddrRequest) (*proto.Addrs, error) {
+	max := int(req.Max)
+	if max == 0 || max > maxAddrSample {
+		max = maxAddrSample
+	}
+	return &proto.Addrs{Addrs: n.book.Sample(max)}, nil
+}
+
+func (p *Peer) GetAddrs(ctx context.Context, req *proto.AddrRequest) (*proto.Addrs, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_AddrRequest{AddrRequest: req}})
+	if err != nil {
+		return nil, err
+	}
+	if addrs := resp.GetAddrList(); addrs != nil {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with addresses", p.Addr())
+}
+
+// exchangeAddrs asks the peer for addresses and adds them to the book.
+func (n *Node) exchangeAddrs(p *Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call)
+	defer cancel()
+	resp, err := p.GetAddrs(ctx, &proto.AddrRequest{Max: maxAddrSample})
+	n.callDone(p, err)
+	if err != nil {
+		n.logger.Debugw("could not get addresses", "we", n.ListenAddr, "peer", p.Addr(), "err", err)
+		return
+	}
+	if len(resp.Addrs) > maxAddrSample {
+		n.penalize(p.key(), p.host, "addrRequest", invalid(fmt.Errorf("peer sent %d addresses, at most %d are allowed", len(resp.Addrs), maxAddrSample)))
+		return
+	}
+	added := 0
+	for _, addr := range resp.Addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil || n.isSelf(addr) {
+			continue
+		}
+		if n.book.Add(addr, p.Addr()) {
+			added++
+		}
+	}
+	if added > 0 {
+		go n.fillPeers()
+	}
+}
+
+// addrLoop refreshes the address book from a random peer every refresh
+// interval. A node that lost all of its peers starts over from the seeds.
+func (n *Node) addrLoop() {
+	ticker := time.NewTicker(n.peerTimeouts.addrRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quitCh:
+			return
+		}
+		peers := n.Peers()
+		if len(peers) == 0 {
+			n.bootstrapNetwork(n.seeds)
+			continue
+		}
+		n.exchangeAddrs(peers[rand.Intn(len(peers))])
+	}
+}
@@ -0,0 +1,47 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.txt")
+	require.Nil(t, os.WriteFile(path, []byte("# testnet\n127.0.0.1:3000\n\n  seed.example.org:3000 \n"), 0o644))
+	seeds, err := LoadSeeds(path)
+	require.Nil(t, err)
+	require.Equal(t, []string{"127.0.0.1:3000", "seed.example.org:3000"}, seeds)
+
+	require.Nil(t, os.WriteFile(path, []byte("no port\n"), 0o644))
+	_, err = LoadSeeds(path)
+	require.NotNil(t, err)
+}
+
+func TestPeerExchange(t *testing.T) {
+	var (
+		addrA = freeAddr(t)
+		addrB = freeAddr(t)
+		addrC = freeAddr(t)
+		a     = startNode(t, testPeerTimeouts, addrA)
+	)
+	defer a.Stop()
+	time.Sleep(time.Millisecond * 50)
+	b := startNode(t, testPeerTimeouts, addrB, addrA)
+	defer b.Stop()
+	require.Eventually(t, func() bool { return hasPeer(b, addrA) }, time.Second*3, time.Millisecond*10)
+
+	// c only knows b, which tells it about a
+	seeds := filepath.Join(t.TempDir(), "seeds.txt")
+	require.Nil(t, os.WriteFile(seeds, []byte(addrB+"\n"), 0o644))
+	c := testNode(ServerConfig{Version: "bloq-1", ListenAddr: addrC, SeedsPath: seeds}, testPeerTimeouts)
+	go c.Start(addrC, nil)
+	defer c.Stop()
+	require.Eventually(t, func() bool { return hasPeer(c, addrA) && hasPeer(c, addrB) }, time.Second*3, time.Millisecond*10)
+	ka, ok := c.book.Get(addrA)
+	require.True(t, ok)
+	require.Equal(t, addrB, ka.Source)
+}
@@ -0,0 +1,120 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+)
+
+// spendChain returns n blocks holding txs transfers each. The first block
+// splits the genesis output, every block after spends the outputs of the one
+// before it.
+func spendChain(tb testing.TB, n, txs int) []*proto.Block {
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		address = privKey.Public().Address().Bytes()
+		blocks  = make([]*proto.Block, n)
+	)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(tb, err)
+	split := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: types.HashTransaction(genesis.Transactions[0]),
+				PublicKey:  privKey.Public().Bytes(),
+			},
+		},
+	}
+	for j := 0; j < txs; j++ {
+		split.Outputs = append(split.Outputs, &proto.TxOutput{Amount: 1, Address: address})
+	}
+	split.Inputs[0].Signature = types.SignTransaction(privKey, defaultChainID, split).Bytes()
+
+	prev := make([]*proto.TxInput, txs)
+	for j := range prev {
+		prev[j] = &proto.TxInput{PrevTxHash: types.HashTransaction(split), PrevOutIndex: uint32(j)}
+	}
+	for i := range blocks {
+		block := randomBlock(tb, chain)
+		if i == 0 {
+			block.Transactions = append(block.Transactions, split)
+		} else {
+			for j := range prev {
+				tx := &proto.Transaction{
+					Version: 1,
+					Inputs: []*proto.TxInput{
+						{
+							PrevTxHash:   prev[j].PrevTxHash,
+							PrevOutIndex: prev[j].PrevOutIndex,
+							PublicKey:    privKey.Public().Bytes(),
+						},
+					},
+					Outputs: []*proto.TxOutput{{Amount: 1, Address: address}},
+				}
+				tx.Inputs[0].Signature = types.SignTransaction(privKey, defaultChainID, tx).Bytes()
+				block.Transactions = append(block.Transactions, tx)
+				prev[j] = &proto.TxInput{PrevTxHash: types.HashTransaction(tx)}
+			}
+		}
+		setStateRoot(tb, chain, block)
+		types.SignBlock(privKey, block)
+		require.Nil(tb, chain.AddBlock(block))
+		blocks[i] = block
+	}
+	return blocks
+}
+
+func TestAddBlocks(t *testing.T) {
+	var (
+		blocks = spendChain(t, 8, 20)
+		chain  = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	)
+	added, err := chain.AddBlocks(blocks[:3])
+	require.Nil(t, err)
+	require.Equal(t, 3, added)
+
+	// the blocks before a broken one are kept
+	blocks[5].Transactions[7].Inputs[0].Signature = blocks[5].Transactions[8].Inputs[0].Signature
+	added, err = chain.AddBlocks(blocks[3:])
+	require.NotNil(t, err)
+	require.Equal(t, 2, added)
+	require.Equal(t, 5, chain.Height())
+}
+
+func benchmarkSync(b *testing.B, txs int, add func(*Chain, []*proto.Block) error) {
+	blocks := spendChain(b, 20, txs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		if err := add(chain, blocks); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(blocks))/b.Elapsed().Seconds(), "blocks/s")
+}
+
+func sequential(chain *Chain, blocks []*proto.Block) error {
+	for _, block := range blocks {
+		if err := chain.AddBlock(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pipelined(chain *Chain, blocks []*proto.Block) error {
+	_, err := chain.AddBlocks(blocks)
+	return err
+}
+
+func BenchmarkSyncSequential10(b *testing.B)   { benchmarkSync(b, 10, sequential) }
+func BenchmarkSyncPipeline10(b *testing.B)     { benchmarkSync(b, 10, pipelined) }
+func BenchmarkSyncSequential100(b *testing.B)  { benchmarkSync(b, 100, sequential) }
+func BenchmarkSyncPipeline100(b *testing.B)    { benchmarkSync(b, 100, pipelined) }
+func BenchmarkSyncSequential1000(b *testing.B) { benchmarkSync(b, 1000, sequential) }
+func BenchmarkSyncPipeline1000(b *testing.B)   { benchmarkSync(b, 1000, pipelined) }
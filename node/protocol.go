@@ -0,0 +1,338 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Connect runs the stream of a node that dialed us until either side ends it.
+func (n *Node) Connect(stream proto.Node_ConnectServer) error {
+	env, err := recvTimeout(stream, n.peerTimeouts.call)
+	if err != nil {
+		return err
+	}
+	v := env.GetVersion()
+	if v == nil {
+		return invalid(fmt.Errorf("the first message has to be a version"))
+	}
+	p, err := n.accept(stream.Context(), stream, v)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(versionEnvelope(n.getVersion())); err != nil {
+		return err
+	}
+	if err := n.addPeer(p); err != nil {
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	n.servePeer(p)
+	return nil
+}
+
+// recvTimeout waits for the next envelope of the stream, the caller has to end
+// the stream if it times out.
+func recvTimeout(stream envelopeStream, timeout time.Duration) (*proto.Envelope, error) {
+	type result struct {
+		env *proto.Envelope
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		env, err := stream.Recv()
+		ch <- result{env, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.env, r.err
+	case <-timer.C:
+		return nil, status.Error(codes.DeadlineExceeded, "peer did not answer in time")
+	}
+}
+
+func versionEnvelope(v *proto.Version) *proto.Envelope {
+	return &proto.Envelope{Payload: &proto.Envelope_Version{Version: v}}
+}
+
+// envelope wraps a message we gossip.
+func envelope(msg any) *proto.Envelope {
+	env := &proto.Envelope{}
+	switch v := msg.(type) {
+	case *proto.Transaction:
+		env.Payload = &proto.Envelope_Transaction{Transaction: v}
+	case *proto.Block:
+		env.Payload = &proto.Envelope_Block{Block: v}
+	case *proto.Proposal:
+		env.Payload = &proto.Envelope_Proposal{Proposal: v}
+	case *proto.Vote:
+		env.Payload = &proto.Envelope_Vote{Vote: v}
+	case *proto.Evidence:
+		env.Payload = &proto.Envelope_Evidence{Evidence: v}
+	case *proto.CompactBlock:
+		env.Payload = &proto.Envelope_CompactBlock{CompactBlock: v}
+	default:
+		panic(fmt.Sprintf("can not gossip %T", msg))
+	}
+	return env
+}
+
+// urgent reports whether the envelope goes out ahead of the rest of the queue.
+// Consensus stalls on late proposals and votes, and requests are small while
+// someone waits for their response.
+func urgent(env *proto.Envelope) bool {
+	switch env.Payload.(type) {
+	case *proto.Envelope_Proposal, *proto.Envelope_Vote:
+		return true
+	}
+	return env.RequestId != 0 && !env.Response
+}
+
+// droppable reports whether the envelope may be dropped when the peer does
+// not keep up, the peer learns about dropped txs from others or a block.
+func droppable(env *proto.Envelope) bool {
+	switch env.Payload.(type) {
+	case *proto.Envelope_Transaction, *proto.Envelope_Inventory:
+		return true
+	}
+	return false
+}
+
+// envelopeKind names the message of the envelope, rate limits and
+// misbehavior points are looked up by it.
+func envelopeKind(env *proto.Envelope) string {
+	switch env.Payload.(type) {
+	case *proto.Envelope_Version:
+		return "version"
+	case *proto.Envelope_Transaction:
+		return "transaction"
+	case *proto.Envelope_Block:
+		return "block"
+	case *proto.Envelope_Proposal:
+		return "proposal"
+	case *proto.Envelope_Vote:
+		return "vote"
+	case *proto.Envelope_Evidence:
+		return "evidence"
+	case *proto.Envelope_Ping:
+		return "ping"
+	case *proto.Envelope_Inventory:
+		return "inventory"
+	case *proto.Envelope_GetData:
+		return "getData"
+	case *proto.Envelope_BlockRequest:
+		return "blockRequest"
+	case *proto.Envelope_HeadersRequest:
+		return "headersRequest"
+	case *proto.Envelope_TxProofRequest:
+		return "txProofRequest"
+	case *proto.Envelope_ValidatorSetRequest:
+		return "validatorSetRequest"
+	case *proto.Envelope_CompactBlock:
+		return "compactBlock"
+	case *proto.Envelope_BlockTxsRequest:
+		return "blockTxsRequest"
+	case *proto.Envelope_AddrRequest:
+		return "addrRequest"
+	}
+	return "unknown"
+}
+
+func (n *Node) readLoop(p *Peer) {
+	for {
+		env, err := p.stream.Recv()
+		if err != nil {
+			return
+		}
+		if env.Response {
+			p.deliver(env)
+			continue
+		}
+		kind := envelopeKind(env)
+		if err := n.handleEnvelope(p, env); err != nil {
+			n.penalize(p.key(), p.host, kind, err)
+		}
+	}
+}
+
+// handleEnvelope dispatches a message of the peer. A malformed message that
+// makes a handler panic fails like an invalid one instead of taking the node
+// down.
+func (n *Node) handleEnvelope(p *Peer, env *proto.Envelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.logger.Errorw("recovered from panic", "kind", envelopeKind(env), "peer", p.Addr(), "panic", r)
+			err = invalid(fmt.Errorf("message made us panic"))
+		}
+	}()
+	if err := n.allow(p.Addr(), envelopeKind(env)); err != nil {
+		return err
+	}
+	switch m := env.Payload.(type) {
+	case *proto.Envelope_Transaction:
+		n.received(p, hex.EncodeToString(types.HashTransaction(m.Transaction)))
+		return n.receiveTx(p.Addr(), m.Transaction)
+	case *proto.Envelope_Block:
+		if m.Block.Header != nil {
+			n.received(p, hex.EncodeToString(types.HashBlock(m.Block)))
+		}
+		return n.receiveBlock(m.Block)
+	case *proto.Envelope_CompactBlock:
+		return n.receiveCompactBlock(p, m.CompactBlock)
+	case *proto.Envelope_Inventory:
+		return n.receiveInventory(p, m.Inventory)
+	case *proto.Envelope_GetData:
+		return n.serveData(p, m.GetData)
+	case *proto.Envelope_Proposal:
+		if !n.usesBFT() {
+			return fmt.Errorf("%s chains do not vote on blocks", n.chain.Engine().Name())
+		}
+		n.bft.HandleProposal(m.Proposal)
+	case *proto.Envelope_Vote:
+		if !n.usesBFT() {
+			return fmt.Errorf("%s chains do not vote on blocks", n.chain.Engine().Name())
+		}
+		n.bft.HandleVote(m.Vote)
+	case *proto.Envelope_Evidence:
+		n.receiveEvidence(m.Evidence)
+	case *proto.Envelope_Version:
+		return invalid(fmt.Errorf("handshake is over"))
+	default:
+		if env.RequestId == 0 {
+			return invalid(fmt.Errorf("unknown message"))
+		}
+		return n.serve(p, env)
+	}
+	return nil
+}
+
+func (n *Node) receiveEvidence(ev *proto.Evidence) {
+	if n.evidence.Add(ev) {
+		n.logger.Warnw("received double-sign evidence", "validator", hex.EncodeToString(ev.PublicKey))
+		n.broadcast(ev)
+	}
+}
+
+// serve answers a request of the peer. The reader waits until the response
+// is queued, so a peer that does not read its responses stops being served.
+func (n *Node) serve(p *Peer, req *proto.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.peerTimeouts.call)
+	defer cancel()
+	resp := &proto.Envelope{RequestId: req.RequestId, Response: true}
+	var err error
+	switch m := req.Payload.(type) {
+	case *proto.Envelope_Ping:
+		resp.Payload = &proto.Envelope_Pong{Pong: &proto.Pong{Nonce: m.Ping.Nonce, Height: int32(n.height())}}
+	case *proto.Envelope_BlockRequest:
+		var cb *proto.CommittedBlock
+		if cb, err = n.GetBlock(ctx, m.BlockRequest); err == nil {
+			resp.Payload = &proto.Envelope_CommittedBlock{CommittedBlock: cb}
+		}
+	case *proto.Envelope_HeadersRequest:
+		var headers *proto.Headers
+		if headers, err = n.GetHeaders(ctx, m.HeadersRequest); err == nil {
+			resp.Payload = &proto.Envelope_HeaderList{HeaderList: headers}
+		}
+	case *proto.Envelope_TxProofRequest:
+		var proof *proto.TxProof
+		if proof, err = n.GetTxProof(ctx, m.TxProofRequest); err == nil {
+			resp.Payload = &proto.Envelope_TxProof{TxProof: proof}
+		}
+	case *proto.Envelope_ValidatorSetRequest:
+		var vs *proto.ValidatorSet
+		if vs, err = n.GetValidators(ctx, m.ValidatorSetRequest); err == nil {
+			resp.Payload = &proto.Envelope_ValidatorSet{ValidatorSet: vs}
+		}
+	case *proto.Envelope_BlockTxsRequest:
+		var txs *proto.BlockTxs
+		if txs, err = n.blockTxs(m.BlockTxsRequest); err == nil {
+			resp.Payload = &proto.Envelope_BlockTxs{BlockTxs: txs}
+		}
+	case *proto.Envelope_AddrRequest:
+		var addrs *proto.Addrs
+		if addrs, err = n.GetAddrs(ctx, m.AddrRequest); err == nil {
+			resp.Payload = &proto.Envelope_AddrList{AddrList: addrs}
+		}
+	default:
+		return invalid(fmt.Errorf("unknown request"))
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return p.enqueue(ctx, resp)
+}
+
+// Ping and the requests below are what peers serve each other, they make a
+// peer the FullNode light nodes sync with.
+func (p *Peer) Ping(ctx context.Context, req *proto.PingRequest) (*proto.Pong, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_Ping{Ping: req}})
+	if err != nil {
+		return nil, err
+	}
+	if pong := resp.GetPong(); pong != nil {
+		return pong, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with a pong", p.Addr())
+}
+
+func (p *Peer) GetBlock(ctx context.Context, req *proto.BlockRequest) (*proto.CommittedBlock, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_BlockRequest{BlockRequest: req}})
+	if err != nil {
+		return nil, err
+	}
+	if cb := resp.GetCommittedBlock(); cb != nil {
+		return cb, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with a block", p.Addr())
+}
+
+func (p *Peer) GetHeaders(ctx context.Context, req *proto.HeadersRequest) (*proto.Headers, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_HeadersRequest{HeadersRequest: req}})
+	if err != nil {
+		return nil, err
+	}
+	if headers := resp.GetHeaderList(); headers != nil {
+		return headers, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with headers", p.Addr())
+}
+
+func (p *Peer) GetTxProof(ctx context.Context, req *proto.TxProofRequest) (*proto.TxProof, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_TxProofRequest{TxProofRequest: req}})
+	if err != nil {
+		return nil, err
+	}
+	if proof := resp.GetTxProof(); proof != nil {
+		return proof, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with a proof", p.Addr())
+}
+
+func (p *Peer) GetValidators(ctx context.Context, req *proto.ValidatorSetRequest) (*proto.ValidatorSet, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_ValidatorSetRequest{ValidatorSetRequest: req}})
+	if err != nil {
+		return nil, err
+	}
+	if vs := resp.GetValidatorSet(); vs != nil {
+		return vs, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with validators", p.Addr())
+}
+
+func (p *Peer) GetBlockTxs(ctx context.Context, req *proto.BlockTxsRequest) (*proto.BlockTxs, error) {
+	resp, err := p.request(ctx, &proto.Envelope{Payload: &proto.Envelope_BlockTxsRequest{BlockTxsRequest: req}})
+	if err != nil {
+		return nil, err
+	}
+	if txs := resp.GetBlockTxs(); txs != nil {
+		return txs, nil
+	}
+	return nil, fmt.Errorf("%s did not answer with block txs", p.Addr())
+}
@@ -0,0 +1,476 @@
+package node
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+)
+
+// simSeed replaces the seed of every sim, to replay the faults of a failed
+// run.
+var simSeed = flag.Int64("sim.seed", 0, "seed of the simulated network")
+
+// simNet is an in-memory network that runs many nodes in one test. Links get
+// a latency, the network can be split into partitions and writes on it get
+// lost at the loss rate. A lost write resets its link, like a connection that
+// drops, so whatever is still in flight on it is lost too and the nodes have
+// to reconnect.
+//
+// Every link draws from its own source, seeded from the seed, the two ends
+// and how many links the two had before. So the same seed loses the same
+// writes of the same links and gives the links the same latencies, no matter
+// how the goroutines of the nodes are scheduled. What a node happens to
+// write at a time still depends on the scheduling.
+type simNet struct {
+	mu        sync.Mutex
+	seed      int64
+	listeners map[string]*simListener
+	// partition of every address, nodes only reach the ones in their own
+	group   map[string]int
+	conns   []*simConn
+	links   map[string]int
+	latency time.Duration
+	loss    float64
+}
+
+func newSimNet(t *testing.T, seed int64) *simNet {
+	if *simSeed != 0 {
+		seed = *simSeed
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("sim seed %d, replay with -sim.seed=%d", seed, seed)
+		}
+	})
+	return &simNet{
+		seed:      seed,
+		listeners: make(map[string]*simListener),
+		group:     make(map[string]int),
+		links:     make(map[string]int),
+	}
+}
+
+func (s *simNet) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+func (s *simNet) SetLoss(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loss = rate
+}
+
+// Partition splits the network into the groups, the links between them are
+// cut. Addresses in no group form a group of their own.
+func (s *simNet) Partition(groups ...[]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group = make(map[string]int)
+	for i, addrs := range groups {
+		for _, addr := range addrs {
+			s.group[addr] = i + 1
+		}
+	}
+	conns := s.conns[:0]
+	for _, c := range s.conns {
+		if s.group[c.from] != s.group[c.to] {
+			c.Close()
+			continue
+		}
+		conns = append(conns, c)
+	}
+	s.conns = conns
+}
+
+// Heal joins the partitions again.
+func (s *simNet) Heal() {
+	s.Partition()
+}
+
+func (s *simNet) lossRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loss
+}
+
+// linkRand returns the source of the next link from the dialer to addr, and
+// one for each of its ends. The caller holds the lock.
+func (s *simNet) linkRand(from, to string) (*rand.Rand, *rand.Rand) {
+	key := from + ">" + to
+	s.links[key]++
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%d", s.seed, key, s.links[key])
+	link := rand.New(rand.NewSource(int64(h.Sum64())))
+	return rand.New(rand.NewSource(link.Int63())), rand.New(rand.NewSource(link.Int63()))
+}
+
+// network is the view of the node at addr.
+func (s *simNet) network(addr string) Network {
+	return &simNetwork{sim: s, self: addr}
+}
+
+type simNetwork struct {
+	sim  *simNet
+	self string
+}
+
+func (n *simNetwork) Listen(addr string) (net.Listener, error) {
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	if _, ok := n.sim.listeners[addr]; ok {
+		return nil, fmt.Errorf("%s is in use", addr)
+	}
+	l := &simListener{
+		sim:   n.sim,
+		addr:  simAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	n.sim.listeners[addr] = l
+	return l, nil
+}
+
+func (n *simNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.sim.mu.Lock()
+	l, ok := n.sim.listeners[addr]
+	latency := n.sim.latency
+	reachable := n.sim.group[n.self] == n.sim.group[addr]
+	if !ok || !reachable {
+		n.sim.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	localRand, remoteRand := n.sim.linkRand(n.self, addr)
+	n.sim.mu.Unlock()
+	// links differ in latency by up to a half, so the order in which
+	// messages of different links arrive follows the seed as well
+	latency += time.Duration(localRand.Int63n(int64(latency)/2 + 1))
+	client, server := net.Pipe()
+	var (
+		local  = newSimConn(n.sim, client, n.self, addr, latency, localRand)
+		remote = newSimConn(n.sim, server, addr, n.self, latency, remoteRand)
+	)
+	select {
+	case l.conns <- remote:
+	case <-l.done:
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	case <-ctx.Done():
+		local.Close()
+		remote.Close()
+		return nil, ctx.Err()
+	}
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	// the network may have been split while we dialed
+	if n.sim.group[n.self] != n.sim.group[addr] {
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("dial %s: connection reset", addr)
+	}
+	n.sim.conns = append(n.sim.conns, local, remote)
+	return local, nil
+}
+
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+type simListener struct {
+	sim       *simNet
+	addr      simAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *simListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.sim.mu.Lock()
+		delete(l.sim.listeners, string(l.addr))
+		l.sim.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return l.addr
+}
+
+// simConn is one end of a link. Writes return right away and reach the other
+// end after the latency of the link, in order, unless the write is lost.
+type simConn struct {
+	net.Conn
+	sim      *simNet
+	from, to string
+	latency  time.Duration
+	queue    chan simWrite
+	done     chan struct{}
+	once     sync.Once
+
+	// draws whether the next write is lost
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+type simWrite struct {
+	data []byte
+	at   time.Time
+}
+
+func newSimConn(sim *simNet, c net.Conn, from, to string, latency time.Duration, rng *rand.Rand) *simConn {
+	sc := &simConn{
+		Conn:    c,
+		sim:     sim,
+		from:    from,
+		to:      to,
+		latency: latency,
+		queue:   make(chan simWrite, 1024),
+		done:    make(chan struct{}),
+		rand:    rng,
+	}
+	go sc.deliver()
+	return sc
+}
+
+func (c *simConn) deliver() {
+	for {
+		select {
+		case w := <-c.queue:
+			time.Sleep(time.Until(w.at))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// lost reports whether the next write on the link is lost. Every write draws,
+// so the draws of a link stay in step whatever the loss rate is.
+func (c *simConn) lost() bool {
+	c.randLock.Lock()
+	defer c.randLock.Unlock()
+	return c.rand.Float64() < c.sim.lossRate()
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	// the writer does not learn about a lost write, only about the reset
+	if c.lost() {
+		c.Close()
+		return len(b), nil
+	}
+	w := simWrite{data: append([]byte(nil), b...), at: time.Now().Add(c.latency)}
+	select {
+	case c.queue <- w:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *simConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr  { return simAddr(c.from) }
+func (c *simConn) RemoteAddr() net.Addr { return simAddr(c.to) }
+
+// startSim starts n nodes on the network, every node bootstraps from the one
+// before it and finds the rest through peer exchange. setup can change the
+// node before it starts.
+func startSim(t *testing.T, sim *simNet, n int, setup func(i int, node *Node)) []*Node {
+	nodes := make([]*Node, n)
+	for i := range nodes {
+		addr := simNodeAddr(i)
+		node := testNode(ServerConfig{Version: "bloq-1", ListenAddr: addr, Network: sim.network(addr)}, testPeerTimeouts)
+		if setup != nil {
+			setup(i, node)
+		}
+		bootstrap := []string{}
+		if i > 0 {
+			bootstrap = append(bootstrap, simNodeAddr(i-1))
+		}
+		go node.Start(addr, bootstrap)
+		nodes[i] = node
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	})
+	return nodes
+}
+
+func simNodeAddr(i int) string {
+	return fmt.Sprintf("10.0.0.%d:3000", i+1)
+}
+
+// simNodeAddrs returns the addresses of the nodes from up to to.
+func simNodeAddrs(from, to int) []string {
+	addrs := []string{}
+	for i := from; i < to; i++ {
+		addrs = append(addrs, simNodeAddr(i))
+	}
+	return addrs
+}
+
+// requireConnected waits until every node has a peer.
+func requireConnected(t *testing.T, nodes []*Node) {
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if len(n.Peers()) == 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*10)
+}
+
+// requireMempoolsConverge waits until every node holds every tx.
+func requireMempoolsConverge(t *testing.T, nodes []*Node, txx []*proto.Transaction) {
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			for _, tx := range txx {
+				if !n.mempool.Has(tx) {
+					return false
+				}
+			}
+		}
+		return true
+	}, time.Second*10, time.Millisecond*20)
+}
+
+// requireTipsConverge waits until every node reached the height the nodes
+// got to so far, and then checks that they all agree on the block there.
+func requireTipsConverge(t *testing.T, nodes []*Node) {
+	target := 0
+	for _, n := range nodes {
+		if h := n.chain.Height(); h > target {
+			target = h
+		}
+	}
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.chain.Height() < target {
+				return false
+			}
+		}
+		return true
+	}, time.Second*10, time.Millisecond*20)
+	want, err := nodes[0].chain.GetBlockByHeight(target)
+	require.Nil(t, err)
+	for i, n := range nodes[1:] {
+		b, err := n.chain.GetBlockByHeight(target)
+		require.Nil(t, err)
+		require.Equal(t, types.HashBlock(want), types.HashBlock(b), "node %d", i+1)
+	}
+}
+
+func TestSimGossipConverges(t *testing.T) {
+	sim := newSimNet(t, 1)
+	sim.SetLatency(time.Millisecond * 5)
+	nodes := startSim(t, sim, 8, nil)
+	requireConnected(t, nodes)
+	sim.SetLoss(0.02)
+
+	var (
+		rng = rand.New(rand.NewSource(1))
+		txx = []*proto.Transaction{}
+	)
+	for i := 0; i < 20; i++ {
+		staker := crypto.GeneratePrivateKey()
+		tx := stakeTx(t, nodes[0].chain, proto.TxType_BOND, staker, staker.Public().Bytes(), minValidatorStake)
+		require.Nil(t, nodes[rng.Intn(len(nodes))].receiveTx("", tx))
+		txx = append(txx, tx)
+	}
+	requireMempoolsConverge(t, nodes, txx)
+}
+
+func TestSimPartitionHeals(t *testing.T) {
+	sim := newSimNet(t, 2)
+	sim.SetLatency(time.Millisecond * 5)
+	nodes := startSim(t, sim, 6, nil)
+	requireConnected(t, nodes)
+
+	// txs stay on their side of the partition until it heals
+	sim.Partition(simNodeAddrs(0, 3), simNodeAddrs(3, len(nodes)))
+	var (
+		alice = crypto.GeneratePrivateKey()
+		bob   = crypto.GeneratePrivateKey()
+		left  = stakeTx(t, nodes[0].chain, proto.TxType_BOND, alice, alice.Public().Bytes(), minValidatorStake)
+		right = stakeTx(t, nodes[0].chain, proto.TxType_BOND, bob, bob.Public().Bytes(), minValidatorStake)
+	)
+	require.Nil(t, nodes[0].receiveTx("", left))
+	require.Nil(t, nodes[5].receiveTx("", right))
+	requireMempoolsConverge(t, nodes[:3], []*proto.Transaction{left})
+	requireMempoolsConverge(t, nodes[3:], []*proto.Transaction{right})
+	require.False(t, nodes[5].mempool.Has(left))
+	require.False(t, nodes[0].mempool.Has(right))
+
+	sim.Heal()
+	requireMempoolsConverge(t, nodes, []*proto.Transaction{left, right})
+}
+
+func TestSimConsensusConverges(t *testing.T) {
+	keys := make([]*crypto.PrivateKey, 4)
+	keys[0] = crypto.NewPrivateKeyFromSeedStr(seed)
+	for i := 1; i < len(keys); i++ {
+		keys[i] = crypto.GeneratePrivateKey()
+	}
+	var (
+		chains = validatorChains(t, keys)
+		sim    = newSimNet(t, 3)
+	)
+	sim.SetLatency(time.Millisecond * 2)
+	sim.SetLoss(0.002)
+	nodes := startSim(t, sim, len(keys), func(i int, n *Node) {
+		n.PrivateKey = keys[i]
+		n.chain = chains[i]
+		n.bft = NewBFT(n.chain, n.mempool, n.evidence, keys[i], n.logger, n.broadcast)
+		n.bft.timeouts = testTimeouts
+	})
+	start := chains[0].Height()
+	require.Eventually(t, func() bool { return nodes[0].chain.Height() >= start+3 }, time.Second*10, time.Millisecond*20)
+	requireTipsConverge(t, nodes)
+
+	// three of four validators keep committing without the fourth, which
+	// catches up once it is back
+	sim.Partition(simNodeAddrs(0, 3), simNodeAddrs(3, len(nodes)))
+	cut := nodes[3].chain.Height()
+	require.Eventually(t, func() bool { return nodes[0].chain.Height() >= cut+3 }, time.Second*10, time.Millisecond*20)
+	require.Less(t, nodes[3].chain.Height(), cut+2)
+
+	sim.Heal()
+	requireTipsConverge(t, nodes)
+}
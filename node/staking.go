@@ -0,0 +1,353 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/koshkaj/bloq/proto"
+)
+
+const (
+	// the validator set is recomputed every epochLength blocks
+	epochLength = 10
+	// number of blocks unbonded coins stay locked before they can be spent
+	unbondingDelay    = 20
+	minValidatorStake = 100
+	maxValidators     = 100
+	// percentage of the stake bonded to a validator that is burned when it
+	// gets caught double-signing
+	slashPercent = 5
+	// evidence older than this many blocks is no longer accepted
+	evidenceMaxAge = 100
+)
+
+type Validator struct {
+	PublicKey []byte
+	Power     int64
+}
+
+type ValidatorSet struct {
+	Epoch      int
+	Height     int
+	Validators []*Validator
+}
+
+func (vs *ValidatorSet) Len() int {
+	return len(vs.Validators)
+}
+
+func (vs *ValidatorSet) TotalPower() int64 {
+	var total int64
+	for _, v := range vs.Validators {
+		total += v.Power
+	}
+	return total
+}
+
+func (vs *ValidatorSet) Get(pubKey []byte) (*Validator, bool) {
+	for _, v := range vs.Validators {
+		if bytes.Equal(v.PublicKey, pubKey) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Proposer rotates the right to propose through the validators on every
+// height and round.
+func (vs *ValidatorSet) Proposer(height, round int) *Validator {
+	if len(vs.Validators) == 0 {
+		return nil
+	}
+	return vs.Validators[(height+round)%len(vs.Validators)]
+}
+
+// Without returns a copy of the set that excludes the given validator.
+func (vs *ValidatorSet) Without(pubKey []byte) *ValidatorSet {
+	validators := make([]*Validator, 0, len(vs.Validators))
+	for _, v := range vs.Validators {
+		if !bytes.Equal(v.PublicKey, pubKey) {
+			validators = append(validators, v)
+		}
+	}
+	return &ValidatorSet{
+		Epoch:      vs.Epoch,
+		Height:     vs.Height,
+		Validators: validators,
+	}
+}
+
+func (vs *ValidatorSet) Proto() *proto.ValidatorSet {
+	validators := make([]*proto.Validator, len(vs.Validators))
+	for i, v := range vs.Validators {
+		validators[i] = &proto.Validator{
+			PublicKey: v.PublicKey,
+			Power:     v.Power,
+		}
+	}
+	return &proto.ValidatorSet{
+		Epoch:      int32(vs.Epoch),
+		Height:     int32(vs.Height),
+		Validators: validators,
+	}
+}
+
+// Staking keeps track of the coins bonded to every validator, including the
+// ones delegated to it by other stakers.
+type Staking struct {
+	mu sync.RWMutex
+	// validator pubkey -> staker pubkey -> bonded amount
+	stakes map[string]map[string]int64
+	// slashed validators are removed from the set for good
+	jailed map[string]bool
+	// validator pubkey -> stake that left it and is not spendable yet
+	unbonding map[string][]*unbonding
+}
+
+// unbonding is stake that left a validator through an unbond tx. Until its
+// outputs mature it can still be slashed for what the validator did while it
+// was bonded.
+type unbonding struct {
+	txHash   string
+	outputs  int
+	amount   int64
+	maturity int
+}
+
+// outputKeys returns the utxo keys of the unbonded coins.
+func (u *unbonding) outputKeys() []string {
+	keys := make([]string, u.outputs)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s_%d", u.txHash, i)
+	}
+	return keys
+}
+
+func NewStaking() *Staking {
+	return &Staking{
+		stakes:    make(map[string]map[string]int64),
+		jailed:    make(map[string]bool),
+		unbonding: make(map[string][]*unbonding),
+	}
+}
+
+func (s *Staking) Bonded(validator, staker []byte) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stakes[hex.EncodeToString(validator)][hex.EncodeToString(staker)]
+}
+
+func (s *Staking) SelfStake(validator []byte) int64 {
+	return s.Bonded(validator, validator)
+}
+
+func (s *Staking) Bond(validator, staker []byte, amount int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(validator)
+	if _, ok := s.stakes[key]; !ok {
+		s.stakes[key] = make(map[string]int64)
+	}
+	s.stakes[key][hex.EncodeToString(staker)] += amount
+}
+
+func (s *Staking) Unbond(validator, staker []byte, amount int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		key       = hex.EncodeToString(validator)
+		stakerKey = hex.EncodeToString(staker)
+		bonded    = s.stakes[key][stakerKey]
+	)
+	if bonded < amount {
+		return fmt.Errorf("cannot unbond %d, only %d is bonded", amount, bonded)
+	}
+	if bonded == amount {
+		delete(s.stakes[key], stakerKey)
+	} else {
+		s.stakes[key][stakerKey] = bonded - amount
+	}
+	if len(s.stakes[key]) == 0 {
+		delete(s.stakes, key)
+	}
+	return nil
+}
+
+// AddUnbonding keeps the coins an unbond tx took out of the validator
+// slashable until they mature.
+func (s *Staking) AddUnbonding(validator []byte, u *unbonding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(validator)
+	s.unbonding[key] = append(s.unbonding[key], u)
+}
+
+func (s *Staking) RemoveUnbonding(validator []byte, txHash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		key     = hex.EncodeToString(validator)
+		entries = s.unbonding[key][:0]
+	)
+	for _, u := range s.unbonding[key] {
+		if u.txHash != txHash {
+			entries = append(entries, u)
+		}
+	}
+	if len(entries) == 0 {
+		delete(s.unbonding, key)
+	} else {
+		s.unbonding[key] = entries
+	}
+}
+
+// Unbonding returns the stake that left the validator and does not mature
+// before the given height.
+func (s *Staking) Unbonding(validator []byte, height int) []*unbonding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []*unbonding{}
+	for _, u := range s.unbonding[hex.EncodeToString(validator)] {
+		if u.maturity > height {
+			entries = append(entries, u)
+		}
+	}
+	return entries
+}
+
+// PruneUnbonding forgets the stake that matured at or before the height. Only
+// finalized heights are pruned, a reorg never needs the stake again then.
+func (s *Staking) PruneUnbonding(height int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entries := range s.unbonding {
+		kept := entries[:0]
+		for _, u := range entries {
+			if u.maturity > height {
+				kept = append(kept, u)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.unbonding, key)
+		} else {
+			s.unbonding[key] = kept
+		}
+	}
+}
+
+// Slashable returns the stake that answers for the validator at the given
+// height, the bonded stake and the stake that is still unbonding.
+func (s *Staking) Slashable(validator []byte, height int) int64 {
+	var total int64
+	for _, u := range s.Unbonding(validator, height) {
+		total += u.amount
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, amount := range s.stakes[hex.EncodeToString(validator)] {
+		total += amount
+	}
+	return total
+}
+
+func (s *Staking) Jailed(validator []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.jailed[hex.EncodeToString(validator)]
+}
+
+// Slash burns slashPercent of every stake bonded to the validator and jails
+// it. It returns the amount burned. The stake that is still unbonding sits in
+// outputs of the chain, which burns its share of them.
+func (s *Staking) Slash(validator []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(validator)
+	if s.jailed[key] {
+		return 0
+	}
+	s.jailed[key] = true
+	var burned int64
+	for staker, amount := range s.stakes[key] {
+		penalty := amount * slashPercent / 100
+		s.stakes[key][staker] = amount - penalty
+		burned += penalty
+	}
+	return burned
+}
+
+// stakeSnapshot holds everything Slash changes about a validator.
+type stakeSnapshot struct {
+	stakes map[string]int64
+	jailed bool
+}
+
+func (s *Staking) snapshot(validator []byte) *stakeSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := hex.EncodeToString(validator)
+	snap := &stakeSnapshot{
+		stakes: make(map[string]int64, len(s.stakes[key])),
+		jailed: s.jailed[key],
+	}
+	for staker, amount := range s.stakes[key] {
+		snap.stakes[staker] = amount
+	}
+	return snap
+}
+
+func (s *Staking) restore(validator []byte, snap *stakeSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(validator)
+	if len(snap.stakes) == 0 {
+		delete(s.stakes, key)
+	} else {
+		s.stakes[key] = snap.stakes
+	}
+	if snap.jailed {
+		s.jailed[key] = true
+	} else {
+		delete(s.jailed, key)
+	}
+}
+
+// ValidatorSet returns the validators with the most voting power. Only
+// validators holding at least minValidatorStake of their own coins qualify,
+// delegations count towards their power.
+func (s *Staking) ValidatorSet(height int) *ValidatorSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	validators := []*Validator{}
+	for key, stakers := range s.stakes {
+		if stakers[key] < minValidatorStake || s.jailed[key] {
+			continue
+		}
+		pubKey, _ := hex.DecodeString(key)
+		var power int64
+		for _, amount := range stakers {
+			power += amount
+		}
+		validators = append(validators, &Validator{
+			PublicKey: pubKey,
+			Power:     power,
+		})
+	}
+	sort.Slice(validators, func(i, j int) bool {
+		if validators[i].Power != validators[j].Power {
+			return validators[i].Power > validators[j].Power
+		}
+		return bytes.Compare(validators[i].PublicKey, validators[j].PublicKey) < 0
+	})
+	if len(validators) > maxValidators {
+		validators = validators[:maxValidators]
+	}
+	return &ValidatorSet{
+		Epoch:      height / epochLength,
+		Height:     height,
+		Validators: validators,
+	}
+}
@@ -0,0 +1,211 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/types"
+	"github.com/stretchr/testify/require"
+)
+
+func addTxBlock(t *testing.T, chain *Chain, txx ...*proto.Transaction) {
+	privKey := crypto.NewPrivateKeyFromSeedStr(seed)
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, txx...)
+	setStateRoot(t, chain, block)
+	types.SignBlock(privKey, block)
+	require.Nil(t, chain.AddBlock(block))
+}
+
+func fillEpoch(t *testing.T, chain *Chain) {
+	for chain.Height()%epochLength != 0 {
+		require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	}
+}
+
+func stakeTx(t *testing.T, chain *Chain, txType proto.TxType, staker *crypto.PrivateKey, validator []byte, amount int64) *proto.Transaction {
+	genesisKey := crypto.NewPrivateKeyFromSeedStr(seed)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	tx := &proto.Transaction{
+		Version: 1,
+		Type:    txType,
+		Stake: &proto.Stake{
+			Validator: validator,
+			Amount:    amount,
+			PublicKey: staker.Public().Bytes(),
+		},
+	}
+	if txType != proto.TxType_UNBOND {
+		// the staker is funded straight from the genesis output
+		tx.Inputs = []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(genesis.Transactions[0]),
+				PrevOutIndex: 0,
+				PublicKey:    genesisKey.Public().Bytes(),
+			},
+		}
+	}
+	tx.Stake.Signature = types.SignTransaction(staker, defaultChainID, tx).Bytes()
+	for _, input := range tx.Inputs {
+		input.Signature = types.SignTransaction(genesisKey, defaultChainID, tx).Bytes()
+	}
+	return tx
+}
+
+func TestGenesisValidatorSet(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	genesisKey := crypto.NewPrivateKeyFromSeedStr(seed)
+
+	validators := chain.Validators()
+	require.Equal(t, 1, validators.Len())
+	v, ok := validators.Get(genesisKey.Public().Bytes())
+	require.True(t, ok)
+	require.Equal(t, int64(genesisStake), v.Power)
+}
+
+func TestBondValidator(t *testing.T) {
+	var (
+		chain        = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		validatorKey = crypto.GeneratePrivateKey()
+		pubKey       = validatorKey.Public().Bytes()
+	)
+	addTxBlock(t, chain, stakeTx(t, chain, proto.TxType_BOND, validatorKey, pubKey, 500))
+	require.Equal(t, int64(500), chain.staking.SelfStake(pubKey))
+
+	// the validator set only changes at epoch boundaries
+	_, ok := chain.Validators().Get(pubKey)
+	require.False(t, ok)
+
+	fillEpoch(t, chain)
+	validators := chain.Validators()
+	require.Equal(t, 2, validators.Len())
+	require.Equal(t, 1, validators.Epoch)
+	v, ok := validators.Get(pubKey)
+	require.True(t, ok)
+	require.Equal(t, int64(500), v.Power)
+	require.Equal(t, int64(genesisStake+500), validators.TotalPower())
+}
+
+func TestBondBelowMinimumStake(t *testing.T) {
+	var (
+		chain        = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		validatorKey = crypto.GeneratePrivateKey()
+		block        = randomBlock(t, chain)
+	)
+	block.Transactions = append(block.Transactions, stakeTx(t, chain, proto.TxType_BOND, validatorKey, validatorKey.Public().Bytes(), minValidatorStake-1))
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(seed), block)
+	require.NotNil(t, chain.AddBlock(block))
+}
+
+func TestDelegate(t *testing.T) {
+	var (
+		chain        = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey   = crypto.NewPrivateKeyFromSeedStr(seed)
+		delegatorKey = crypto.GeneratePrivateKey()
+		validator    = genesisKey.Public().Bytes()
+	)
+	addTxBlock(t, chain, stakeTx(t, chain, proto.TxType_DELEGATE, delegatorKey, validator, 300))
+	require.Equal(t, int64(300), chain.staking.Bonded(validator, delegatorKey.Public().Bytes()))
+
+	fillEpoch(t, chain)
+	v, ok := chain.Validators().Get(validator)
+	require.True(t, ok)
+	require.Equal(t, int64(genesisStake+300), v.Power)
+}
+
+func TestDelegateToUnknownValidator(t *testing.T) {
+	var (
+		chain        = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		delegatorKey = crypto.GeneratePrivateKey()
+		unknown      = crypto.GeneratePrivateKey().Public().Bytes()
+	)
+	tx := stakeTx(t, chain, proto.TxType_DELEGATE, delegatorKey, unknown, 300)
+	require.NotNil(t, chain.ValidateTransaction(tx))
+}
+
+func TestUnbond(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		validator  = genesisKey.Public().Bytes()
+	)
+	unbond := stakeTx(t, chain, proto.TxType_UNBOND, genesisKey, validator, genesisStake)
+	unbond.Outputs = []*proto.TxOutput{
+		{
+			Amount:  genesisStake,
+			Address: genesisKey.Public().Address().Bytes(),
+		},
+	}
+	unbond.Stake.Signature = types.SignTransaction(genesisKey, defaultChainID, unbond).Bytes()
+	addTxBlock(t, chain, unbond)
+	unbondHeight := chain.Height()
+	require.Equal(t, int64(0), chain.staking.SelfStake(validator))
+
+	// the unbonded coins are locked for unbondingDelay blocks
+	spend := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(unbond),
+				PrevOutIndex: 0,
+				PublicKey:    genesisKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  genesisStake,
+				Address: crypto.GeneratePrivateKey().Public().Address().Bytes(),
+			},
+		},
+	}
+	spend.Inputs[0].Signature = types.SignTransaction(genesisKey, defaultChainID, spend).Bytes()
+	require.NotNil(t, chain.ValidateTransaction(spend))
+
+	for chain.Height() < unbondHeight+unbondingDelay-1 {
+		require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	}
+	require.Nil(t, chain.ValidateTransaction(spend))
+
+	fillEpoch(t, chain)
+	require.Equal(t, 0, chain.Validators().Len())
+}
+
+func TestUnbondMoreThanBonded(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+	)
+	tx := stakeTx(t, chain, proto.TxType_UNBOND, genesisKey, genesisKey.Public().Bytes(), genesisStake+1)
+	require.NotNil(t, chain.ValidateTransaction(tx))
+}
+
+func TestUnbondTwiceInOneBlock(t *testing.T) {
+	var (
+		chain      = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		genesisKey = crypto.NewPrivateKeyFromSeedStr(seed)
+		validator  = genesisKey.Public().Bytes()
+		first      = stakeTx(t, chain, proto.TxType_UNBOND, genesisKey, validator, genesisStake/2+1)
+		second     = stakeTx(t, chain, proto.TxType_UNBOND, genesisKey, validator, genesisStake/2+2)
+	)
+	// each unbond is fine on its own, together they take out more than is bonded
+	require.Nil(t, chain.ValidateTransaction(first))
+	require.Nil(t, chain.ValidateTransaction(second))
+
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, first, second)
+	types.SignBlock(genesisKey, block)
+	require.NotNil(t, chain.ValidateBlock(block))
+
+	mempool := NewMempool()
+	mempool.Add(first)
+	mempool.Add(second)
+	block, err := newBlock(chain, mempool, NewEvidencePool())
+	require.Nil(t, err)
+	require.Len(t, block.Transactions, 1)
+	require.Equal(t, 1, mempool.Len())
+	types.SignBlock(genesisKey, block)
+	require.Nil(t, chain.AddBlock(block))
+}
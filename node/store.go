@@ -12,6 +12,7 @@ import (
 type UTXOStorer interface {
 	Put(*UTXO) error
 	Get(string) (*UTXO, error)
+	Delete(string) error
 }
 
 type MemoryUTXOStore struct {
@@ -36,6 +37,13 @@ func (s *MemoryUTXOStore) Put(utxo *UTXO) error {
 	s.data[key] = utxo
 	return nil
 }
+func (s *MemoryUTXOStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
 func NewMemoryUTXOStore() *MemoryUTXOStore {
 	return &MemoryUTXOStore{
 		data: make(map[string]*UTXO),
@@ -45,6 +53,7 @@ func NewMemoryUTXOStore() *MemoryUTXOStore {
 type TXStorer interface {
 	Put(*proto.Transaction) error
 	Get(string) (*proto.Transaction, error)
+	Delete(string) error
 }
 
 type MemoryTXStore struct {
@@ -77,6 +86,13 @@ func (s *MemoryTXStore) Get(hash string) (*proto.Transaction, error) {
 	return tx, nil
 }
 
+func (s *MemoryTXStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.txx, hash)
+	return nil
+}
+
 type BlockStorer interface {
 	Put(*proto.Block) error
 	Get(string) (*proto.Block, error)
@@ -110,3 +126,37 @@ func (s *MemoryBlockStore) Get(hash string) (*proto.Block, error) {
 	}
 	return block, nil
 }
+
+type CommitStorer interface {
+	Put(*proto.CommitCertificate) error
+	Get(string) (*proto.CommitCertificate, error)
+}
+
+type MemoryCommitStore struct {
+	mu      sync.RWMutex
+	commits map[string]*proto.CommitCertificate
+}
+
+func NewMemoryCommitStore() *MemoryCommitStore {
+	return &MemoryCommitStore{
+		commits: make(map[string]*proto.CommitCertificate),
+	}
+}
+
+func (s *MemoryCommitStore) Put(cert *proto.CommitCertificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := hex.EncodeToString(cert.BlockHash)
+	s.commits[hash] = cert
+	return nil
+}
+
+func (s *MemoryCommitStore) Get(hash string) (*proto.CommitCertificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert, ok := s.commits[hash]
+	if !ok {
+		return nil, fmt.Errorf("commit for block [%s] does not exist", hash)
+	}
+	return cert, nil
+}
@@ -0,0 +1,170 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/koshkaj/bloq/crypto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// LoadNodeKey reads the identity key kept at path, a new key is generated and
+// written there if there is none yet.
+func LoadNodeKey(path string) (*crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := crypto.GeneratePrivateKey()
+		seed := hex.EncodeToString(key.Bytes()[:crypto.SeedLen])
+		if err := os.WriteFile(path, []byte(seed), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != crypto.SeedLen {
+		return nil, fmt.Errorf("node key in %s has %d bytes, want %d", path, len(seed), crypto.SeedLen)
+	}
+	return crypto.NewPrivateKeyFromSeed(seed), nil
+}
+
+func nodeCertificate(key *crypto.PrivateKey) (tls.Certificate, error) {
+	privKey := ed25519.PrivateKey(key.Bytes())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365 * 10),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privKey.Public(), privKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  privKey,
+	}, nil
+}
+
+// verifyNodeCertificate accepts any certificate that is signed by the
+// ed25519 key it is issued for.
+func verifyNodeCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := cert.PublicKey.(ed25519.PublicKey); !ok {
+		return fmt.Errorf("certificate is not for an ed25519 key")
+	}
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+}
+
+// tlsConfig secures the connections of a node with mutual TLS, for both the
+// server and the dialing side. Every node presents a self-signed certificate
+// for its identity key. There is no certificate authority: the certificate
+// only proves that the other end holds the key, which node the key belongs
+// to is up to the signed handshake and the keys the address book pinned.
+func tlsConfig(key *crypto.PrivateKey) (*tls.Config, error) {
+	cert, err := nodeCertificate(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// there is no authority to verify against, verifyNodeCertificate
+		// checks the certificates instead
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyNodeCertificate,
+		MinVersion:            tls.VersionTLS13,
+		NextProtos:            []string{"h2"},
+	}, nil
+}
+
+// Network is what nodes listen and dial on. Tests run many nodes on one
+// in-memory network instead of TCP.
+type Network interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+type tcpNetwork struct{}
+
+func (tcpNetwork) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// Dial connects to a node as a client that holds key, wallets and tools can
+// use a throwaway key.
+func Dial(addr string, key *crypto.PrivateKey, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	cfg, err := tlsConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	creds := credentials.NewTLS(cfg)
+	return grpc.Dial(addr, append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, opts...)...)
+}
+
+// peerKey returns the key the other end of the connection authenticated with.
+func peerKey(p *peer.Peer) []byte {
+	if p == nil {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return stateKey(info.State)
+}
+
+// stateKey returns the key of the certificate the other end of a TLS
+// connection presented.
+func stateKey(state tls.ConnectionState) []byte {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	key, ok := state.PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil
+	}
+	return key
+}
+
+// callerKey returns the key the caller of an inbound call authenticated with.
+func callerKey(ctx context.Context) []byte {
+	p, _ := peer.FromContext(ctx)
+	return peerKey(p)
+}
+
+// sameKey reports whether key is set and equal to other.
+func sameKey(key, other []byte) bool {
+	return len(key) != 0 && bytes.Equal(key, other)
+}
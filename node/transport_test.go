@@ -0,0 +1,36 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadNodeKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	key, err := LoadNodeKey(path)
+	require.Nil(t, err)
+
+	// the same identity after a restart
+	loaded, err := LoadNodeKey(path)
+	require.Nil(t, err)
+	require.Equal(t, key.Public().Bytes(), loaded.Public().Bytes())
+
+	require.Nil(t, os.WriteFile(path, []byte("abcd"), 0o600))
+	_, err = LoadNodeKey(path)
+	require.NotNil(t, err)
+}
+
+func TestVerifyNodeCertificate(t *testing.T) {
+	cert, err := nodeCertificate(crypto.GeneratePrivateKey())
+	require.Nil(t, err)
+	require.Nil(t, verifyNodeCertificate(cert.Certificate, nil))
+
+	tampered := append([]byte{}, cert.Certificate[0]...)
+	tampered[len(tampered)-1] ^= 1
+	require.NotNil(t, verifyNodeCertificate([][]byte{tampered}, nil))
+	require.NotNil(t, verifyNodeCertificate(nil, nil))
+}
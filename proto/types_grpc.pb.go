@@ -22,8 +22,15 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type NodeClient interface {
-	Handshake(ctx context.Context, in *Version, opts ...grpc.CallOption) (*Version, error)
+	// peers talk over a single stream, the first envelope each side sends
+	// is its version
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Node_ConnectClient, error)
 	HandleTransaction(ctx context.Context, in *Transaction, opts ...grpc.CallOption) (*Ack, error)
+	GetValidators(ctx context.Context, in *ValidatorSetRequest, opts ...grpc.CallOption) (*ValidatorSet, error)
+	GetBlock(ctx context.Context, in *BlockRequest, opts ...grpc.CallOption) (*CommittedBlock, error)
+	GetHeaders(ctx context.Context, in *HeadersRequest, opts ...grpc.CallOption) (*Headers, error)
+	GetTxProof(ctx context.Context, in *TxProofRequest, opts ...grpc.CallOption) (*TxProof, error)
+	GetAddrs(ctx context.Context, in *AddrRequest, opts ...grpc.CallOption) (*Addrs, error)
 }
 
 type nodeClient struct {
@@ -34,13 +41,35 @@ func NewNodeClient(cc grpc.ClientConnInterface) NodeClient {
 	return &nodeClient{cc}
 }
 
-func (c *nodeClient) Handshake(ctx context.Context, in *Version, opts ...grpc.CallOption) (*Version, error) {
-	out := new(Version)
-	err := c.cc.Invoke(ctx, "/Node/Handshake", in, out, opts...)
+func (c *nodeClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Node_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Node_ServiceDesc.Streams[0], "/Node/Connect", opts...)
 	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	x := &nodeConnectClient{stream}
+	return x, nil
+}
+
+type Node_ConnectClient interface {
+	Send(*Envelope) error
+	Recv() (*Envelope, error)
+	grpc.ClientStream
+}
+
+type nodeConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *nodeConnectClient) Send(m *Envelope) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *nodeConnectClient) Recv() (*Envelope, error) {
+	m := new(Envelope)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 func (c *nodeClient) HandleTransaction(ctx context.Context, in *Transaction, opts ...grpc.CallOption) (*Ack, error) {
@@ -52,12 +81,64 @@ func (c *nodeClient) HandleTransaction(ctx context.Context, in *Transaction, opt
 	return out, nil
 }
 
+func (c *nodeClient) GetValidators(ctx context.Context, in *ValidatorSetRequest, opts ...grpc.CallOption) (*ValidatorSet, error) {
+	out := new(ValidatorSet)
+	err := c.cc.Invoke(ctx, "/Node/GetValidators", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetBlock(ctx context.Context, in *BlockRequest, opts ...grpc.CallOption) (*CommittedBlock, error) {
+	out := new(CommittedBlock)
+	err := c.cc.Invoke(ctx, "/Node/GetBlock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetHeaders(ctx context.Context, in *HeadersRequest, opts ...grpc.CallOption) (*Headers, error) {
+	out := new(Headers)
+	err := c.cc.Invoke(ctx, "/Node/GetHeaders", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetTxProof(ctx context.Context, in *TxProofRequest, opts ...grpc.CallOption) (*TxProof, error) {
+	out := new(TxProof)
+	err := c.cc.Invoke(ctx, "/Node/GetTxProof", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetAddrs(ctx context.Context, in *AddrRequest, opts ...grpc.CallOption) (*Addrs, error) {
+	out := new(Addrs)
+	err := c.cc.Invoke(ctx, "/Node/GetAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // NodeServer is the server API for Node service.
 // All implementations must embed UnimplementedNodeServer
 // for forward compatibility
 type NodeServer interface {
-	Handshake(context.Context, *Version) (*Version, error)
+	// peers talk over a single stream, the first envelope each side sends
+	// is its version
+	Connect(Node_ConnectServer) error
 	HandleTransaction(context.Context, *Transaction) (*Ack, error)
+	GetValidators(context.Context, *ValidatorSetRequest) (*ValidatorSet, error)
+	GetBlock(context.Context, *BlockRequest) (*CommittedBlock, error)
+	GetHeaders(context.Context, *HeadersRequest) (*Headers, error)
+	GetTxProof(context.Context, *TxProofRequest) (*TxProof, error)
+	GetAddrs(context.Context, *AddrRequest) (*Addrs, error)
 	mustEmbedUnimplementedNodeServer()
 }
 
@@ -65,12 +146,27 @@ type NodeServer interface {
 type UnimplementedNodeServer struct {
 }
 
-func (UnimplementedNodeServer) Handshake(context.Context, *Version) (*Version, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method Handshake not implemented")
+func (UnimplementedNodeServer) Connect(Node_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
 }
 func (UnimplementedNodeServer) HandleTransaction(context.Context, *Transaction) (*Ack, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HandleTransaction not implemented")
 }
+func (UnimplementedNodeServer) GetValidators(context.Context, *ValidatorSetRequest) (*ValidatorSet, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetValidators not implemented")
+}
+func (UnimplementedNodeServer) GetBlock(context.Context, *BlockRequest) (*CommittedBlock, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlock not implemented")
+}
+func (UnimplementedNodeServer) GetHeaders(context.Context, *HeadersRequest) (*Headers, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHeaders not implemented")
+}
+func (UnimplementedNodeServer) GetTxProof(context.Context, *TxProofRequest) (*TxProof, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTxProof not implemented")
+}
+func (UnimplementedNodeServer) GetAddrs(context.Context, *AddrRequest) (*Addrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAddrs not implemented")
+}
 func (UnimplementedNodeServer) mustEmbedUnimplementedNodeServer() {}
 
 // UnsafeNodeServer may be embedded to opt out of forward compatibility for this service.
@@ -84,38 +180,136 @@ func RegisterNodeServer(s grpc.ServiceRegistrar, srv NodeServer) {
 	s.RegisterService(&Node_ServiceDesc, srv)
 }
 
-func _Node_Handshake_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(Version)
+func _Node_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(NodeServer).Connect(&nodeConnectServer{stream})
+}
+
+type Node_ConnectServer interface {
+	Send(*Envelope) error
+	Recv() (*Envelope, error)
+	grpc.ServerStream
+}
+
+type nodeConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *nodeConnectServer) Send(m *Envelope) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *nodeConnectServer) Recv() (*Envelope, error) {
+	m := new(Envelope)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Node_HandleTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Transaction)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(NodeServer).Handshake(ctx, in)
+		return srv.(NodeServer).HandleTransaction(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/Node/Handshake",
+		FullMethod: "/Node/HandleTransaction",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(NodeServer).Handshake(ctx, req.(*Version))
+		return srv.(NodeServer).HandleTransaction(ctx, req.(*Transaction))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Node_HandleTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(Transaction)
+func _Node_GetValidators_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidatorSetRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(NodeServer).HandleTransaction(ctx, in)
+		return srv.(NodeServer).GetValidators(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/Node/HandleTransaction",
+		FullMethod: "/Node/GetValidators",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(NodeServer).HandleTransaction(ctx, req.(*Transaction))
+		return srv.(NodeServer).GetValidators(ctx, req.(*ValidatorSetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetBlock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetBlock(ctx, req.(*BlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetHeaders_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeadersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetHeaders(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetHeaders",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetHeaders(ctx, req.(*HeadersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetTxProof_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxProofRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetTxProof(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetTxProof",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetTxProof(ctx, req.(*TxProofRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddrRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetAddrs(ctx, req.(*AddrRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -127,15 +321,38 @@ var Node_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "Node",
 	HandlerType: (*NodeServer)(nil),
 	Methods: []grpc.MethodDesc{
-		{
-			MethodName: "Handshake",
-			Handler:    _Node_Handshake_Handler,
-		},
 		{
 			MethodName: "HandleTransaction",
 			Handler:    _Node_HandleTransaction_Handler,
 		},
+		{
+			MethodName: "GetValidators",
+			Handler:    _Node_GetValidators_Handler,
+		},
+		{
+			MethodName: "GetBlock",
+			Handler:    _Node_GetBlock_Handler,
+		},
+		{
+			MethodName: "GetHeaders",
+			Handler:    _Node_GetHeaders_Handler,
+		},
+		{
+			MethodName: "GetTxProof",
+			Handler:    _Node_GetTxProof_Handler,
+		},
+		{
+			MethodName: "GetAddrs",
+			Handler:    _Node_GetAddrs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Node_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/types.proto",
 }
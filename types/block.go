@@ -3,61 +3,51 @@ package types
 import (
 	"bytes"
 	"crypto/sha256"
-	"log"
 
-	"github.com/cbergoon/merkletree"
-	pb "github.com/golang/protobuf/proto"
 	"github.com/koshkaj/bloq/crypto"
 	"github.com/koshkaj/bloq/proto"
 )
 
-type TxHash struct {
-	hash []byte
-}
-
-func NewTxHash(hash []byte) TxHash {
-	return TxHash{
-		hash: hash,
-	}
-}
-
-func (h TxHash) CalculateHash() ([]byte, error) {
-	return h.hash, nil
+func VerifyBlock(b *proto.Block) bool {
+	return VerifyBody(b) && VerifyHeader(b.Header, b.PublicKey, b.Signature)
 }
 
-func (h TxHash) Equals(other merkletree.Content) (bool, error) {
-	equals := bytes.Equal(h.hash, other.(TxHash).hash)
-	return equals, nil
+// VerifyBody checks that the header commits to the transactions of the block.
+func VerifyBody(b *proto.Block) bool {
+	return VerifyRootHash(b) && int(b.Header.TxCount) == len(b.Transactions)
 }
 
-func VerifyBlock(b *proto.Block) bool {
-	if len(b.Transactions) > 0 {
-		if !VerifyRootHash(b) {
-			return false
-		}
+// VerifyHeader checks the signature over the header and that the signer is
+// the proposer the header names. Headers carry their chain id, the chain
+// makes sure it is its own.
+func VerifyHeader(header *proto.Header, pubKey, signature []byte) bool {
+	if len(pubKey) != crypto.PubKeyLen {
+		return false
 	}
-	if len(b.PublicKey) != crypto.PubKeyLen {
+	if len(signature) != crypto.SignatureLen {
 		return false
 	}
-	if len(b.Signature) != crypto.SignatureLen {
+	var (
+		sig = crypto.SignatureFromBytes(signature)
+		pub = crypto.PublicKeyFromBytes(pubKey)
+	)
+	if !bytes.Equal(header.Proposer, pub.Address().Bytes()) {
 		return false
 	}
-	sig := crypto.SignatureFromBytes(b.Signature)
-	pubKey := crypto.PublicKeyFromBytes(b.PublicKey)
-	hash := HashBlock(b)
-	return sig.Verify(pubKey, hash)
+	return sig.Verify(pub, signingMessage(domainBlock, header.ChainID, HashHeader(header)))
+}
+
+// FillHeader sets the header fields that follow from the transactions and
+// the signer of the block.
+func FillHeader(pubKey *crypto.PublicKey, b *proto.Block) {
+	b.Header.RootHash = NewBlockMerkleTree(b).Root()
+	b.Header.TxCount = uint32(len(b.Transactions))
+	b.Header.Proposer = pubKey.Address().Bytes()
 }
 
 func SignBlock(pk *crypto.PrivateKey, b *proto.Block) *crypto.Signature {
-	if len(b.Transactions) > 0 {
-		tree, err := GetMerkleTree(b)
-		if err != nil {
-			log.Fatal(err)
-		}
-		b.Header.RootHash = tree.MerkleRoot()
-	}
-	hash := HashBlock(b)
-	sig := pk.Sign(hash)
+	FillHeader(pk.Public(), b)
+	sig := pk.Sign(signingMessage(domainBlock, b.Header.ChainID, HashBlock(b)))
 	b.PublicKey = pk.Public().Bytes()
 	b.Signature = sig.Bytes()
 	return sig
@@ -69,38 +59,16 @@ func HashBlock(block *proto.Block) []byte {
 }
 
 func VerifyRootHash(b *proto.Block) bool {
-	tree, err := GetMerkleTree(b)
-	if err != nil {
-		return false
-	}
-	valid, err := tree.VerifyTree()
-	if err != nil {
-		return false
-	}
-	if !valid {
-		return false
-	}
-	return bytes.Equal(b.Header.RootHash, tree.MerkleRoot())
+	return bytes.Equal(b.Header.RootHash, NewBlockMerkleTree(b).Root())
 }
 
-func GetMerkleTree(b *proto.Block) (*merkletree.MerkleTree, error) {
-	list := make([]merkletree.Content, len(b.Transactions))
-	for i := 0; i < len(b.Transactions); i++ {
-		list[i] = NewTxHash(HashTransaction(b.Transactions[i]))
-	}
-	t, err := merkletree.NewTree(list)
-	if err != nil {
-		return nil, err
-	}
-	b.Header.RootHash = t.MerkleRoot()
-	return t, nil
+// GetMerkleProof returns the branch proving that the tx at the given index
+// is part of the merkle root of the block.
+func GetMerkleProof(b *proto.Block, index int) (*proto.MerkleProof, error) {
+	return NewBlockMerkleTree(b).Proof(index)
 }
 
 func HashHeader(header *proto.Header) []byte {
-	b, err := pb.Marshal(header)
-	if err != nil {
-		log.Fatal(err)
-	}
-	hash := sha256.Sum256(b)
+	hash := sha256.Sum256(EncodeHeader(header))
 	return hash[:]
 }
@@ -37,7 +37,7 @@ func TestSignVerifyBlock(t *testing.T) {
 	)
 	sig := SignBlock(privKey, block)
 	assert.Equal(t, 64, len(sig.Bytes()))
-	assert.True(t, sig.Verify(pubKey, HashBlock(block)))
+	assert.True(t, sig.Verify(pubKey, signingMessage(domainBlock, block.Header.ChainID, HashBlock(block))))
 
 	assert.Equal(t, block.PublicKey, pubKey.Bytes())
 	assert.Equal(t, block.Signature, sig.Bytes())
@@ -49,3 +49,41 @@ func TestSignVerifyBlock(t *testing.T) {
 
 	assert.False(t, VerifyBlock(block))
 }
+
+func TestVerifyBlockHeaderFields(t *testing.T) {
+	var (
+		block   = util.RandomBlock()
+		privKey = crypto.GeneratePrivateKey()
+	)
+	block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1})
+	SignBlock(privKey, block)
+	assert.Equal(t, uint32(1), block.Header.TxCount)
+	assert.Equal(t, privKey.Public().Address().Bytes(), block.Header.Proposer)
+	assert.True(t, VerifyBlock(block))
+
+	block.Header.TxCount = 2
+	assert.False(t, VerifyBlock(block))
+
+	block.Header.TxCount = 1
+	block.Header.Proposer = crypto.GeneratePrivateKey().Public().Address().Bytes()
+	assert.False(t, VerifyBlock(block))
+}
+
+func TestMerkleProof(t *testing.T) {
+	var (
+		block   = util.RandomBlock()
+		privKey = crypto.GeneratePrivateKey()
+	)
+	for i := 0; i < 5; i++ {
+		block.Transactions = append(block.Transactions, &proto.Transaction{Version: int32(i)})
+	}
+	SignBlock(privKey, block)
+	for i, tx := range block.Transactions {
+		proof, err := GetMerkleProof(block, i)
+		assert.Nil(t, err)
+		assert.True(t, VerifyMerkleProof(block.Header.RootHash, HashTransaction(tx), proof))
+		assert.False(t, VerifyMerkleProof(block.Header.RootHash, HashTransaction(&proto.Transaction{Version: 99}), proof))
+	}
+	_, err := GetMerkleProof(block, 5)
+	assert.NotNil(t, err)
+}
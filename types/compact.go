@@ -0,0 +1,39 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/koshkaj/bloq/proto"
+)
+
+// ShortIDLen is the length of the ids that stand in for the txs of a compact
+// block.
+const ShortIDLen = 6
+
+// ShortTxID shortens the hash of a tx for a compact block. The salt is picked
+// by the sender, so no one can make txs that collide for every compact block.
+func ShortTxID(salt uint64, txHash []byte) []byte {
+	buf := binary.BigEndian.AppendUint64(nil, salt)
+	hash := sha256.Sum256(append(buf, txHash...))
+	return hash[:ShortIDLen]
+}
+
+// NewCompactBlock replaces the txs of the block with their short ids. Evidence
+// txs are made by the proposer, they are never gossiped and go along whole.
+func NewCompactBlock(b *proto.Block, salt uint64) *proto.CompactBlock {
+	cb := &proto.CompactBlock{
+		Header:    b.Header,
+		PublicKey: b.PublicKey,
+		Signature: b.Signature,
+		Salt:      salt,
+		ShortIds:  make([][]byte, len(b.Transactions)),
+	}
+	for i, tx := range b.Transactions {
+		cb.ShortIds[i] = ShortTxID(salt, HashTransaction(tx))
+		if tx.Type == proto.TxType_EVIDENCE {
+			cb.Prefilled = append(cb.Prefilled, &proto.PrefilledTx{Index: uint32(i), Transaction: tx})
+		}
+	}
+	return cb
+}
@@ -0,0 +1,33 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortTxID(t *testing.T) {
+	hash := HashTransaction(&proto.Transaction{Version: 1})
+	assert.Equal(t, ShortIDLen, len(ShortTxID(1, hash)))
+	assert.Equal(t, ShortTxID(1, hash), ShortTxID(1, hash))
+	assert.NotEqual(t, ShortTxID(1, hash), ShortTxID(2, hash))
+}
+
+func TestNewCompactBlock(t *testing.T) {
+	var (
+		block    = util.RandomBlock()
+		tx       = &proto.Transaction{Version: 1}
+		evidence = &proto.Transaction{Version: 1, Type: proto.TxType_EVIDENCE}
+	)
+	block.Transactions = []*proto.Transaction{tx, evidence}
+	cb := NewCompactBlock(block, 7)
+	assert.Equal(t, block.Header, cb.Header)
+	assert.Equal(t, ShortTxID(7, HashTransaction(tx)), cb.ShortIds[0])
+	assert.Equal(t, 2, len(cb.ShortIds))
+	// only the evidence goes along whole
+	assert.Equal(t, 1, len(cb.Prefilled))
+	assert.Equal(t, uint32(1), cb.Prefilled[0].Index)
+	assert.Equal(t, evidence, cb.Prefilled[0].Transaction)
+}
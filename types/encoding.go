@@ -0,0 +1,189 @@
+package types
+
+import (
+	"encoding/binary"
+
+	"github.com/koshkaj/bloq/proto"
+)
+
+// The canonical encoding is what every hash in the chain is taken over. It
+// does not depend on any protobuf implementation:
+//
+//   - integers are fixed size big-endian, signed ones in two's complement
+//   - byte strings and strings are prefixed with their length as uint32
+//   - lists are prefixed with their length as uint32
+//   - optional messages are prefixed with a 0 or 1 byte
+//   - fields are written in the order of their field numbers
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) present(ok bool) bool {
+	if ok {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+	return ok
+}
+
+func (e *encoder) header(h *proto.Header) {
+	e.uint32(uint32(h.Version))
+	e.uint32(uint32(h.Height))
+	e.bytes(h.PrevHash)
+	e.bytes(h.RootHash)
+	e.uint64(uint64(h.Timestamp))
+	e.uint64(h.Nonce)
+	e.uint64(h.Difficulty)
+	e.bytes(h.Proposer)
+	e.bytes([]byte(h.ChainID))
+	e.bytes(h.StateRoot)
+	e.uint32(h.TxCount)
+}
+
+// signatures and the rest of the input witnesses are left out of the
+// messages their signers sign
+func (e *encoder) transaction(tx *proto.Transaction, signatures bool) {
+	e.uint32(uint32(tx.Version))
+	e.uint32(uint32(len(tx.Inputs)))
+	for _, input := range tx.Inputs {
+		e.bytes(input.PrevTxHash)
+		e.uint32(input.PrevOutIndex)
+		e.bytes(input.PublicKey)
+		if signatures {
+			e.bytes(input.Signature)
+			e.uint32(uint32(len(input.Witnesses)))
+			for _, w := range input.Witnesses {
+				e.bytes(w.PublicKey)
+				e.bytes(w.Signature)
+			}
+			e.bytes(input.Preimage)
+		}
+	}
+	e.uint32(uint32(len(tx.Outputs)))
+	for _, output := range tx.Outputs {
+		e.uint64(uint64(output.Amount))
+		e.bytes(output.Address)
+		if e.present(output.Predicate != nil) {
+			e.predicate(output.Predicate)
+		}
+	}
+	e.uint32(uint32(tx.Type))
+	if e.present(tx.Stake != nil) {
+		e.bytes(tx.Stake.Validator)
+		e.uint64(uint64(tx.Stake.Amount))
+		e.bytes(tx.Stake.PublicKey)
+		if signatures {
+			e.bytes(tx.Stake.Signature)
+		}
+	}
+	if e.present(tx.Evidence != nil) {
+		e.evidence(tx.Evidence)
+	}
+	e.uint64(tx.LockTime)
+	e.uint64(tx.Expiry)
+}
+
+func (e *encoder) predicate(p *proto.Predicate) {
+	e.uint32(uint32(p.Type))
+	e.uint32(p.Threshold)
+	e.uint32(uint32(len(p.PublicKeys)))
+	for _, key := range p.PublicKeys {
+		e.bytes(key)
+	}
+	e.bytes(p.Hash)
+	e.uint64(p.LockTime)
+	e.uint32(uint32(len(p.Predicates)))
+	for _, sub := range p.Predicates {
+		e.predicate(sub)
+	}
+}
+
+func (e *encoder) evidence(ev *proto.Evidence) {
+	if e.present(ev.HeaderA != nil) {
+		e.header(ev.HeaderA)
+	}
+	e.bytes(ev.SignatureA)
+	if e.present(ev.HeaderB != nil) {
+		e.header(ev.HeaderB)
+	}
+	e.bytes(ev.SignatureB)
+	e.bytes(ev.PublicKey)
+}
+
+func (e *encoder) version(v *proto.Version) {
+	e.bytes([]byte(v.Version))
+	e.uint32(uint32(v.Height))
+	e.bytes([]byte(v.ListenAddr))
+	e.bytes(v.PublicKey)
+}
+
+func (e *encoder) vote(v *proto.Vote, signature bool) {
+	e.uint32(uint32(v.Type))
+	e.uint32(uint32(v.Height))
+	e.uint32(uint32(v.Round))
+	e.bytes(v.BlockHash)
+	e.bytes(v.PublicKey)
+	if signature {
+		e.bytes(v.Signature)
+	}
+}
+
+func (e *encoder) proposal(p *proto.Proposal, signature bool) {
+	if e.present(p.Block != nil && p.Block.Header != nil) {
+		e.uint32(uint32(p.Block.Header.Height))
+		e.bytes(HashBlock(p.Block))
+	}
+	e.uint32(uint32(p.Round))
+	e.bytes(p.PublicKey)
+	if signature {
+		e.bytes(p.Signature)
+	}
+}
+
+func EncodeHeader(h *proto.Header) []byte {
+	e := &encoder{}
+	e.header(h)
+	return e.buf
+}
+
+func EncodeTransaction(tx *proto.Transaction) []byte {
+	e := &encoder{}
+	e.transaction(tx, true)
+	return e.buf
+}
+
+func EncodePredicate(p *proto.Predicate) []byte {
+	e := &encoder{}
+	e.predicate(p)
+	return e.buf
+}
+
+func EncodeEvidence(ev *proto.Evidence) []byte {
+	e := &encoder{}
+	e.evidence(ev)
+	return e.buf
+}
+
+func EncodeVote(v *proto.Vote) []byte {
+	e := &encoder{}
+	e.vote(v, true)
+	return e.buf
+}
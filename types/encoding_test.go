@@ -0,0 +1,138 @@
+package types
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/koshkaj/bloq/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func fill(b byte, n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = b
+	}
+	return buf
+}
+
+func goldenHeader() *proto.Header {
+	return &proto.Header{
+		Version:    1,
+		Height:     42,
+		PrevHash:   fill(0x11, 32),
+		RootHash:   fill(0x22, 32),
+		Timestamp:  1700000000000000000,
+		Nonce:      7,
+		Difficulty: 1 << 16,
+		Proposer:   fill(0x33, 20),
+		ChainID:    "bloq",
+		StateRoot:  fill(0x44, 32),
+		TxCount:    2,
+	}
+}
+
+func goldenTransaction() *proto.Transaction {
+	return &proto.Transaction{
+		Version: 1,
+		Type:    proto.TxType_DELEGATE,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash:   fill(0x55, 32),
+				PrevOutIndex: 3,
+				PublicKey:    fill(0x66, 32),
+				Signature:    fill(0x77, 64),
+			},
+			{
+				PrevTxHash:   fill(0x55, 32),
+				PrevOutIndex: 4,
+				Witnesses: []*proto.Witness{
+					{PublicKey: fill(0x66, 32), Signature: fill(0x77, 64)},
+				},
+				Preimage: []byte("secret"),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  8888,
+				Address: fill(0x88, 20),
+			},
+			{
+				Amount: 1,
+				Predicate: &proto.Predicate{
+					Type: proto.PredicateType_ANY,
+					Predicates: []*proto.Predicate{
+						{Type: proto.PredicateType_MULTISIG, Threshold: 1, PublicKeys: [][]byte{fill(0x66, 32)}},
+						{Type: proto.PredicateType_HASH_LOCK, Hash: fill(0xbb, 32)},
+					},
+				},
+			},
+		},
+		Stake: &proto.Stake{
+			Validator: fill(0x99, 32),
+			Amount:    100,
+			PublicKey: fill(0x66, 32),
+			Signature: fill(0xaa, 64),
+		},
+	}
+}
+
+// golden vectors, other implementations have to produce the same bytes
+func TestEncodeHeaderGolden(t *testing.T) {
+	var (
+		header = goldenHeader()
+		want   = "00000001" + "0000002a" +
+			"00000020" + hex.EncodeToString(fill(0x11, 32)) +
+			"00000020" + hex.EncodeToString(fill(0x22, 32)) +
+			"17979cfe362a0000" + "0000000000000007" + "0000000000010000" +
+			"00000014" + hex.EncodeToString(fill(0x33, 20)) +
+			"00000004" + hex.EncodeToString([]byte("bloq")) +
+			"00000020" + hex.EncodeToString(fill(0x44, 32)) +
+			"00000002"
+	)
+	assert.Equal(t, want, hex.EncodeToString(EncodeHeader(header)))
+	assert.Equal(t, "4d45e217d470d04e8db691b5b9e1c455c95342975ff1d5270943ae5ec85d46bd", hex.EncodeToString(HashHeader(header)))
+}
+
+func TestEncodeTransactionGolden(t *testing.T) {
+	tx := goldenTransaction()
+	assert.Equal(t, "2bf63b54dfda75889e9300261effd8ff4821fdd783d6ac5eeb61b573e511feb1", hex.EncodeToString(HashTransaction(tx)))
+	assert.Equal(t, "517e8ee44f6547e1a254a0433b80f01d815a248851fa251fab6fb605383f55a8", hex.EncodeToString(signingHash(tx)))
+}
+
+func TestEncodeVoteGolden(t *testing.T) {
+	vote := &proto.Vote{
+		Type:      proto.VoteType_PRECOMMIT,
+		Height:    42,
+		Round:     1,
+		BlockHash: fill(0x11, 32),
+		PublicKey: fill(0x66, 32),
+		Signature: fill(0x77, 64),
+	}
+	assert.Equal(t, "95796d08f9d477d17f77ce97dae5384d18abe51104084c710cee7a05ea7b0e0a", hex.EncodeToString(HashVote(vote)))
+}
+
+func TestEncodeEvidenceGolden(t *testing.T) {
+	headerB := goldenHeader()
+	headerB.Timestamp++
+	ev := &proto.Evidence{
+		HeaderA:    goldenHeader(),
+		SignatureA: fill(0x77, 64),
+		HeaderB:    headerB,
+		SignatureB: fill(0xaa, 64),
+		PublicKey:  fill(0x66, 32),
+	}
+	assert.Equal(t, "768aaa1e0484cc10b910069a0245f22c0fb313ec059bcb96333bcae69bda69bc", hex.EncodeToString(HashEvidence(ev)))
+}
+
+// signatures are not part of what is signed, but they are part of the tx id
+func TestSigningHashIgnoresSignatures(t *testing.T) {
+	var (
+		a = goldenTransaction()
+		b = goldenTransaction()
+	)
+	b.Inputs[0].Signature = nil
+	b.Stake.Signature = fill(0xbb, 64)
+	assert.Equal(t, signingHash(a), signingHash(b))
+	assert.NotEqual(t, HashTransaction(a), HashTransaction(b))
+}
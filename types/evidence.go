@@ -0,0 +1,48 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/koshkaj/bloq/proto"
+)
+
+// NewEvidence returns the proof that the signer of both blocks signed two
+// different headers at the same height, or nil if the blocks don't conflict.
+func NewEvidence(a, b *proto.Block) *proto.Evidence {
+	ev := &proto.Evidence{
+		HeaderA:    a.Header,
+		SignatureA: a.Signature,
+		HeaderB:    b.Header,
+		SignatureB: b.Signature,
+		PublicKey:  a.PublicKey,
+	}
+	// order the headers so the same offence always yields the same evidence
+	if bytes.Compare(HashHeader(a.Header), HashHeader(b.Header)) > 0 {
+		ev.HeaderA, ev.HeaderB = ev.HeaderB, ev.HeaderA
+		ev.SignatureA, ev.SignatureB = ev.SignatureB, ev.SignatureA
+	}
+	if !bytes.Equal(a.PublicKey, b.PublicKey) || !VerifyEvidence(ev) {
+		return nil
+	}
+	return ev
+}
+
+func VerifyEvidence(ev *proto.Evidence) bool {
+	if ev.HeaderA == nil || ev.HeaderB == nil {
+		return false
+	}
+	if ev.HeaderA.Height != ev.HeaderB.Height {
+		return false
+	}
+	if bytes.Equal(HashHeader(ev.HeaderA), HashHeader(ev.HeaderB)) {
+		return false
+	}
+	return VerifyHeader(ev.HeaderA, ev.PublicKey, ev.SignatureA) &&
+		VerifyHeader(ev.HeaderB, ev.PublicKey, ev.SignatureB)
+}
+
+func HashEvidence(ev *proto.Evidence) []byte {
+	hash := sha256.Sum256(EncodeEvidence(ev))
+	return hash[:]
+}
@@ -0,0 +1,48 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEvidence(t *testing.T) {
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		a       = util.RandomBlock()
+		b       = util.RandomBlock()
+	)
+	b.Header.Height = a.Header.Height
+	SignBlock(privKey, a)
+	SignBlock(privKey, b)
+
+	ev := NewEvidence(a, b)
+	assert.NotNil(t, ev)
+	assert.True(t, VerifyEvidence(ev))
+	assert.Equal(t, privKey.Public().Bytes(), ev.PublicKey)
+	// the same offence yields the same evidence regardless of the order
+	assert.Equal(t, HashEvidence(ev), HashEvidence(NewEvidence(b, a)))
+
+	// signing the same header twice is not an offence
+	assert.Nil(t, NewEvidence(a, a))
+
+	ev.HeaderA.Timestamp++
+	assert.False(t, VerifyEvidence(ev))
+
+	b.Header.Height++
+	SignBlock(privKey, b)
+	assert.Nil(t, NewEvidence(a, b))
+}
+
+func TestNewEvidenceDifferentSigners(t *testing.T) {
+	var (
+		a = util.RandomBlock()
+		b = util.RandomBlock()
+	)
+	b.Header.Height = a.Header.Height
+	SignBlock(crypto.GeneratePrivateKey(), a)
+	SignBlock(crypto.GeneratePrivateKey(), b)
+	assert.Nil(t, NewEvidence(a, b))
+}
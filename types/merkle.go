@@ -0,0 +1,141 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/koshkaj/bloq/proto"
+)
+
+// prefixes keep leaves and inner nodes from ever hashing to the same value,
+// so an inner node can not be passed off as a leaf
+const (
+	leafPrefix  byte = 0x00
+	innerPrefix byte = 0x01
+)
+
+// EmptyRoot is the merkle root of a block without transactions.
+var EmptyRoot = func() []byte {
+	hash := sha256.Sum256(nil)
+	return hash[:]
+}()
+
+// MerkleTree is built bottom up. A node without a sibling is moved up a level
+// as it is instead of being paired with a copy of itself, so no two lists of
+// leaves share a root.
+type MerkleTree struct {
+	leaves int
+	// levels[0] holds the leaf hashes, the last level the root
+	levels [][][]byte
+}
+
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+	if len(leaves) == 0 {
+		return &MerkleTree{
+			levels: [][][]byte{{EmptyRoot}},
+		}
+	}
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = hashLeaf(leaf)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, hashInner(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &MerkleTree{
+		leaves: len(leaves),
+		levels: levels,
+	}
+}
+
+// NewBlockMerkleTree returns the tree over the hashes of the block's
+// transactions.
+func NewBlockMerkleTree(b *proto.Block) *MerkleTree {
+	leaves := make([][]byte, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		leaves[i] = HashTransaction(tx)
+	}
+	return NewMerkleTree(leaves)
+}
+
+func (t *MerkleTree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Proof returns the hashes needed to get from the leaf at the given index to
+// the root.
+func (t *MerkleTree) Proof(index int) (*proto.MerkleProof, error) {
+	if index < 0 || index >= t.leaves {
+		return nil, fmt.Errorf("tree has no leaf at index %d", index)
+	}
+	proof := &proto.MerkleProof{
+		Index:  uint32(index),
+		Leaves: uint32(t.leaves),
+	}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks that the leaf is part of the tree with the given
+// root.
+func VerifyMerkleProof(root, leaf []byte, proof *proto.MerkleProof) bool {
+	if proof == nil || proof.Index >= proof.Leaves {
+		return false
+	}
+	var (
+		hash   = hashLeaf(leaf)
+		hashes = proof.Hashes
+		index  = proof.Index
+		width  = proof.Leaves
+	)
+	for width > 1 {
+		switch {
+		case index%2 == 1:
+			if len(hashes) == 0 {
+				return false
+			}
+			hash = hashInner(hashes[0], hash)
+			hashes = hashes[1:]
+		case index+1 < width:
+			if len(hashes) == 0 {
+				return false
+			}
+			hash = hashInner(hash, hashes[0])
+			hashes = hashes[1:]
+		}
+		index /= 2
+		width = (width + 1) / 2
+	}
+	return len(hashes) == 0 && bytes.Equal(hash, root)
+}
+
+func hashLeaf(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{leafPrefix}, data...))
+	return hash[:]
+}
+
+func hashInner(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, innerPrefix)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
@@ -0,0 +1,79 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("leaf %d", i))
+	}
+	return leaves
+}
+
+func TestMerkleEmptyRoot(t *testing.T) {
+	assert.Equal(t, EmptyRoot, NewMerkleTree(nil).Root())
+	_, err := NewMerkleTree(nil).Proof(0)
+	assert.NotNil(t, err)
+
+	block := util.RandomBlock()
+	SignBlock(crypto.GeneratePrivateKey(), block)
+	assert.Equal(t, EmptyRoot, block.Header.RootHash)
+	assert.True(t, VerifyBlock(block))
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var (
+			leaves = testLeaves(n)
+			tree   = NewMerkleTree(leaves)
+		)
+		for i, leaf := range leaves {
+			proof, err := tree.Proof(i)
+			require.Nil(t, err)
+			assert.True(t, VerifyMerkleProof(tree.Root(), leaf, proof), "leaf %d of %d", i, n)
+			assert.False(t, VerifyMerkleProof(tree.Root(), []byte("other"), proof))
+
+			if n > 1 {
+				proof.Index = uint32((i + 1) % n)
+				assert.False(t, VerifyMerkleProof(tree.Root(), leaf, proof))
+			}
+		}
+		_, err := tree.Proof(n)
+		assert.NotNil(t, err)
+	}
+}
+
+// the last leaf is not duplicated, so appending a copy of it changes the root
+func TestMerkleNoDuplicateLeaf(t *testing.T) {
+	leaves := testLeaves(3)
+	assert.NotEqual(t, NewMerkleTree(leaves).Root(), NewMerkleTree(append(leaves, leaves[2])).Root())
+}
+
+// an inner node can not be used as a leaf
+func TestMerkleDomainSeparation(t *testing.T) {
+	var (
+		leaves = testLeaves(4)
+		tree   = NewMerkleTree(leaves)
+		inner  = append(append([]byte{}, tree.levels[1][0]...), tree.levels[1][1]...)
+	)
+	assert.NotEqual(t, tree.Root(), NewMerkleTree([][]byte{inner}).Root())
+	assert.NotEqual(t, tree.Root(), hashLeaf(inner))
+}
+
+func TestVerifyRootHashHasNoSideEffects(t *testing.T) {
+	block := util.RandomBlock()
+	block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1})
+	root := block.Header.RootHash
+	assert.False(t, VerifyRootHash(block))
+	assert.Equal(t, root, block.Header.RootHash)
+	assert.False(t, VerifyBlock(block))
+}
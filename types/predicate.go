@@ -0,0 +1,201 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+)
+
+// Outputs with a predicate are spent by satisfying it instead of signing with
+// the key of an address. Predicates only look at the spending tx and input,
+// so every node evaluates them the same way.
+const (
+	// lock times below it are block heights, the others unix times
+	LockTimeThreshold = 500000000
+
+	maxPredicateDepth = 4
+	maxPredicateKeys  = 16
+)
+
+func NewMultisig(threshold int, keys ...*crypto.PublicKey) *proto.Predicate {
+	p := &proto.Predicate{
+		Type:      proto.PredicateType_MULTISIG,
+		Threshold: uint32(threshold),
+	}
+	for _, key := range keys {
+		p.PublicKeys = append(p.PublicKeys, key.Bytes())
+	}
+	return p
+}
+
+// AddWitness signs the tx for an input that spends a predicate output. The
+// witnesses are kept sorted by public key, which is the only order the chain
+// accepts.
+func AddWitness(pk *crypto.PrivateKey, chainID string, tx *proto.Transaction, input *proto.TxInput) {
+	w := &proto.Witness{
+		PublicKey: pk.Public().Bytes(),
+		Signature: SignTransaction(pk, chainID, tx).Bytes(),
+	}
+	i := sort.Search(len(input.Witnesses), func(i int) bool {
+		return bytes.Compare(input.Witnesses[i].PublicKey, w.PublicKey) >= 0
+	})
+	input.Witnesses = append(input.Witnesses, nil)
+	copy(input.Witnesses[i+1:], input.Witnesses[i:])
+	input.Witnesses[i] = w
+}
+
+// ValidatePredicate checks that the predicate is well formed, so that outputs
+// can not be locked by predicates nobody is able to evaluate. Every way of
+// satisfying it has to take a signature, a preimage or a lock time alone is
+// public once spent and anyone could take the coins.
+func ValidatePredicate(p *proto.Predicate) error {
+	if err := validatePredicate(p, 0); err != nil {
+		return err
+	}
+	if !needsSignature(p) {
+		return fmt.Errorf("predicate can be satisfied without a signature")
+	}
+	return nil
+}
+
+// needsSignature reports whether every branch of a well formed predicate
+// includes a multisig.
+func needsSignature(p *proto.Predicate) bool {
+	switch p.Type {
+	case proto.PredicateType_MULTISIG:
+		return true
+	case proto.PredicateType_ALL:
+		for _, sub := range p.Predicates {
+			if needsSignature(sub) {
+				return true
+			}
+		}
+	case proto.PredicateType_ANY:
+		for _, sub := range p.Predicates {
+			if !needsSignature(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func validatePredicate(p *proto.Predicate, depth int) error {
+	if p == nil {
+		return fmt.Errorf("missing predicate")
+	}
+	if depth >= maxPredicateDepth {
+		return fmt.Errorf("predicate is nested too deep")
+	}
+	switch p.Type {
+	case proto.PredicateType_MULTISIG:
+		if len(p.PublicKeys) == 0 || len(p.PublicKeys) > maxPredicateKeys {
+			return fmt.Errorf("multisig needs between 1 and %d keys", maxPredicateKeys)
+		}
+		if p.Threshold == 0 || int(p.Threshold) > len(p.PublicKeys) {
+			return fmt.Errorf("invalid multisig threshold %d of %d", p.Threshold, len(p.PublicKeys))
+		}
+		seen := make(map[string]bool)
+		for _, key := range p.PublicKeys {
+			if len(key) != crypto.PubKeyLen {
+				return fmt.Errorf("invalid multisig key")
+			}
+			if seen[string(key)] {
+				return fmt.Errorf("duplicate multisig key")
+			}
+			seen[string(key)] = true
+		}
+	case proto.PredicateType_HASH_LOCK:
+		if len(p.Hash) != sha256.Size {
+			return fmt.Errorf("invalid hash lock")
+		}
+	case proto.PredicateType_TIME_LOCK:
+		if p.LockTime == 0 {
+			return fmt.Errorf("invalid time lock")
+		}
+	case proto.PredicateType_ALL, proto.PredicateType_ANY:
+		if len(p.Predicates) == 0 || len(p.Predicates) > maxPredicateKeys {
+			return fmt.Errorf("%s needs between 1 and %d predicates", p.Type, maxPredicateKeys)
+		}
+		for _, sub := range p.Predicates {
+			if err := validatePredicate(sub, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown predicate type %d", p.Type)
+	}
+	return nil
+}
+
+// EvalPredicate reports whether the input satisfies the predicate of the output
+// it spends. The witness signatures are verified by VerifyTransaction.
+func EvalPredicate(p *proto.Predicate, tx *proto.Transaction, input *proto.TxInput) bool {
+	switch p.Type {
+	case proto.PredicateType_MULTISIG:
+		signed := 0
+		for _, key := range p.PublicKeys {
+			if hasWitness(input, key) {
+				signed++
+			}
+		}
+		return signed >= int(p.Threshold)
+	case proto.PredicateType_HASH_LOCK:
+		hash := sha256.Sum256(input.Preimage)
+		return len(input.Preimage) > 0 && bytes.Equal(hash[:], p.Hash)
+	case proto.PredicateType_TIME_LOCK:
+		// the chain does not accept the tx before its own lock time, which has
+		// to be of the same kind and not before the one of the predicate
+		sameKind := (tx.LockTime < LockTimeThreshold) == (p.LockTime < LockTimeThreshold)
+		return sameKind && tx.LockTime >= p.LockTime
+	case proto.PredicateType_ALL:
+		for _, sub := range p.Predicates {
+			if !EvalPredicate(sub, tx, input) {
+				return false
+			}
+		}
+		return true
+	case proto.PredicateType_ANY:
+		for _, sub := range p.Predicates {
+			if EvalPredicate(sub, tx, input) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SatisfiesPredicate reports whether the input satisfies the predicate with
+// nothing to spare. A witness or preimage the predicate does not need could
+// be dropped by whoever relays the tx, which changes its hash.
+func SatisfiesPredicate(p *proto.Predicate, tx *proto.Transaction, input *proto.TxInput) bool {
+	if !EvalPredicate(p, tx, input) {
+		return false
+	}
+	if len(input.Preimage) > 0 && EvalPredicate(p, tx, &proto.TxInput{Witnesses: input.Witnesses}) {
+		return false
+	}
+	for i := range input.Witnesses {
+		rest := make([]*proto.Witness, 0, len(input.Witnesses)-1)
+		rest = append(rest, input.Witnesses[:i]...)
+		rest = append(rest, input.Witnesses[i+1:]...)
+		if EvalPredicate(p, tx, &proto.TxInput{Witnesses: rest, Preimage: input.Preimage}) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasWitness(input *proto.TxInput, key []byte) bool {
+	for _, w := range input.Witnesses {
+		if bytes.Equal(w.PublicKey, key) {
+			return true
+		}
+	}
+	return false
+}
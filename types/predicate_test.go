@@ -0,0 +1,126 @@
+package types
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePredicate(t *testing.T) {
+	var (
+		a = crypto.GeneratePrivateKey().Public()
+		b = crypto.GeneratePrivateKey().Public()
+	)
+	assert.Nil(t, ValidatePredicate(NewMultisig(2, a, b)))
+	assert.NotNil(t, ValidatePredicate(NewMultisig(3, a, b)))
+	assert.NotNil(t, ValidatePredicate(NewMultisig(0, a, b)))
+	assert.NotNil(t, ValidatePredicate(NewMultisig(1, a, a)))
+	assert.NotNil(t, ValidatePredicate(&proto.Predicate{Type: proto.PredicateType_HASH_LOCK, Hash: []byte("short")}))
+	assert.NotNil(t, ValidatePredicate(&proto.Predicate{Type: proto.PredicateType_ALL}))
+	assert.NotNil(t, ValidatePredicate(&proto.Predicate{Type: 42}))
+
+	// locks alone can be met by anyone who saw the spend
+	var (
+		hashLock = &proto.Predicate{Type: proto.PredicateType_HASH_LOCK, Hash: make([]byte, 32)}
+		timeLock = &proto.Predicate{Type: proto.PredicateType_TIME_LOCK, LockTime: 100}
+	)
+	assert.NotNil(t, ValidatePredicate(hashLock))
+	assert.NotNil(t, ValidatePredicate(timeLock))
+	assert.NotNil(t, ValidatePredicate(&proto.Predicate{Type: proto.PredicateType_ALL, Predicates: []*proto.Predicate{hashLock, timeLock}}))
+	assert.NotNil(t, ValidatePredicate(&proto.Predicate{Type: proto.PredicateType_ANY, Predicates: []*proto.Predicate{NewMultisig(1, a), timeLock}}))
+	assert.Nil(t, ValidatePredicate(&proto.Predicate{Type: proto.PredicateType_ALL, Predicates: []*proto.Predicate{NewMultisig(1, a), hashLock}}))
+
+	deep := NewMultisig(1, a)
+	for i := 0; i < maxPredicateDepth; i++ {
+		deep = &proto.Predicate{Type: proto.PredicateType_ALL, Predicates: []*proto.Predicate{deep}}
+	}
+	assert.NotNil(t, ValidatePredicate(deep))
+}
+
+func TestMultisigPredicate(t *testing.T) {
+	var (
+		keys = []*crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+		p    = NewMultisig(2, keys[0].Public(), keys[1].Public(), keys[2].Public())
+		in   = &proto.TxInput{PrevTxHash: util.RandomHash()}
+		tx   = &proto.Transaction{Version: 1, Inputs: []*proto.TxInput{in}}
+	)
+	AddWitness(keys[0], "devnet", tx, in)
+	assert.True(t, VerifyTransaction("devnet", tx))
+	assert.False(t, EvalPredicate(p, tx, in))
+
+	// signing twice with the same key does not count twice and is rejected
+	AddWitness(keys[0], "devnet", tx, in)
+	assert.False(t, EvalPredicate(p, tx, in))
+	assert.False(t, VerifyTransaction("devnet", tx))
+	in.Witnesses = in.Witnesses[1:]
+
+	AddWitness(keys[2], "devnet", tx, in)
+	assert.True(t, VerifyTransaction("devnet", tx))
+	assert.True(t, EvalPredicate(p, tx, in))
+	assert.True(t, SatisfiesPredicate(p, tx, in))
+
+	// witnesses out of order could be reordered by anyone relaying the tx
+	in.Witnesses[0], in.Witnesses[1] = in.Witnesses[1], in.Witnesses[0]
+	assert.False(t, VerifyTransaction("devnet", tx))
+	in.Witnesses[0], in.Witnesses[1] = in.Witnesses[1], in.Witnesses[0]
+
+	// so could a witness or preimage that is not needed be dropped
+	needed := in.Witnesses
+	AddWitness(keys[1], "devnet", tx, in)
+	assert.True(t, EvalPredicate(p, tx, in))
+	assert.False(t, SatisfiesPredicate(p, tx, in))
+	in.Witnesses = needed
+	in.Preimage = []byte("secret")
+	assert.False(t, SatisfiesPredicate(p, tx, in))
+	in.Preimage = nil
+
+	// witnesses that do not sign the tx make it invalid
+	in.Witnesses[0].Signature = in.Witnesses[1].Signature
+	assert.False(t, VerifyTransaction("devnet", tx))
+}
+
+func TestHashTimeLockPredicate(t *testing.T) {
+	var (
+		hash     = sha256.Sum256([]byte("secret"))
+		receiver = crypto.GeneratePrivateKey().Public()
+		sender   = crypto.GeneratePrivateKey().Public()
+		// the receiver claims with the secret, the sender refunds after height 100
+		p = &proto.Predicate{
+			Type: proto.PredicateType_ANY,
+			Predicates: []*proto.Predicate{
+				{
+					Type: proto.PredicateType_ALL,
+					Predicates: []*proto.Predicate{
+						NewMultisig(1, receiver),
+						{Type: proto.PredicateType_HASH_LOCK, Hash: hash[:]},
+					},
+				},
+				{
+					Type: proto.PredicateType_ALL,
+					Predicates: []*proto.Predicate{
+						NewMultisig(1, sender),
+						{Type: proto.PredicateType_TIME_LOCK, LockTime: 100},
+					},
+				},
+			},
+		}
+		claim  = &proto.TxInput{Witnesses: []*proto.Witness{{PublicKey: receiver.Bytes()}}}
+		refund = &proto.TxInput{Witnesses: []*proto.Witness{{PublicKey: sender.Bytes()}}}
+	)
+	assert.Nil(t, ValidatePredicate(p))
+
+	assert.False(t, EvalPredicate(p, &proto.Transaction{}, claim))
+	claim.Preimage = []byte("guess")
+	assert.False(t, EvalPredicate(p, &proto.Transaction{}, claim))
+	claim.Preimage = []byte("secret")
+	assert.True(t, EvalPredicate(p, &proto.Transaction{}, claim))
+
+	assert.False(t, EvalPredicate(p, &proto.Transaction{LockTime: 99}, refund))
+	assert.True(t, EvalPredicate(p, &proto.Transaction{LockTime: 100}, refund))
+	// a unix time lock does not satisfy a height lock
+	assert.False(t, EvalPredicate(p, &proto.Transaction{LockTime: LockTimeThreshold + 100}, refund))
+}
@@ -0,0 +1,117 @@
+package types
+
+import (
+	"crypto/sha256"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/koshkaj/bloq/crypto"
+)
+
+// below this many signatures spinning up workers costs more than it saves
+const minParallelChecks = 16
+
+type sigCheck struct {
+	pubKey    []byte
+	signature []byte
+	msg       []byte
+}
+
+func (s sigCheck) verify() bool {
+	if len(s.signature) != crypto.SignatureLen || len(s.pubKey) != crypto.PubKeyLen {
+		return false
+	}
+	return crypto.SignatureFromBytes(s.signature).Verify(crypto.PublicKeyFromBytes(s.pubKey), s.msg)
+}
+
+func (s sigCheck) key() [32]byte {
+	e := &encoder{}
+	e.bytes(s.pubKey)
+	e.bytes(s.signature)
+	e.bytes(s.msg)
+	return sha256.Sum256(e.buf)
+}
+
+// verifyParallel verifies the signatures on a pool of workers and stops at the
+// first invalid one.
+func verifyParallel(checks []sigCheck) bool {
+	workers := runtime.NumCPU()
+	if len(checks) < minParallelChecks || workers == 1 {
+		for _, check := range checks {
+			if !check.verify() {
+				return false
+			}
+		}
+		return true
+	}
+	var (
+		next   atomic.Int64
+		failed atomic.Bool
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				i := int(next.Add(1)) - 1
+				if i >= len(checks) {
+					return
+				}
+				if !checks[i].verify() {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return !failed.Load()
+}
+
+// SigCache remembers signatures that verified, so that a tx verified when it
+// entered the mempool is not verified again when it arrives in a block. Once
+// full, a random entry makes room for the new one.
+type SigCache struct {
+	mu      sync.RWMutex
+	size    int
+	entries map[[32]byte]struct{}
+}
+
+func NewSigCache(size int) *SigCache {
+	return &SigCache{
+		size:    size,
+		entries: make(map[[32]byte]struct{}, size),
+	}
+}
+
+func (c *SigCache) has(check sigCheck) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.entries[check.key()]
+	return ok
+}
+
+func (c *SigCache) add(check sigCheck) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[check.key()] = struct{}{}
+}
+
+func (c *SigCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func signedTxs(n int) []*proto.Transaction {
+	txx := make([]*proto.Transaction, n)
+	for i := range txx {
+		privKey := crypto.GeneratePrivateKey()
+		input := &proto.TxInput{
+			PrevTxHash: util.RandomHash(),
+			PublicKey:  privKey.Public().Bytes(),
+		}
+		txx[i] = &proto.Transaction{
+			Version: 1,
+			Inputs:  []*proto.TxInput{input},
+			Outputs: []*proto.TxOutput{{Amount: 1, Address: privKey.Public().Address().Bytes()}},
+		}
+		input.Signature = SignTransaction(privKey, "devnet", txx[i]).Bytes()
+	}
+	return txx
+}
+
+func TestVerifyTransactionsParallel(t *testing.T) {
+	txx := signedTxs(100)
+	assert.True(t, VerifyTransactions("devnet", txx, nil))
+	assert.False(t, VerifyTransactions("testnet", txx, nil))
+
+	txx[77].Inputs[0].Signature = txx[13].Inputs[0].Signature
+	assert.False(t, VerifyTransactions("devnet", txx, nil))
+}
+
+func TestSigCache(t *testing.T) {
+	var (
+		cache = NewSigCache(100)
+		txx   = signedTxs(10)
+	)
+	txx[9].Outputs[0].Amount = 2
+	assert.False(t, VerifyTransactions("devnet", txx, cache))
+	// verifying alone caches nothing, the txs may fail other checks
+	assert.True(t, VerifyTransactions("devnet", txx[:9], cache))
+	assert.Equal(t, 0, cache.Len())
+
+	CacheTransactions("devnet", txx[:9], cache)
+	assert.Equal(t, 9, cache.Len())
+	for _, tx := range txx[:9] {
+		checks, ok := txSignatures("devnet", tx)
+		assert.True(t, ok)
+		assert.True(t, cache.has(checks[0]))
+	}
+	// the signature is cached for its chain only
+	checks, _ := txSignatures("testnet", txx[0])
+	assert.False(t, cache.has(checks[0]))
+
+	small := NewSigCache(4)
+	CacheTransactions("devnet", txx[:9], small)
+	assert.Equal(t, 4, small.Len())
+}
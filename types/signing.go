@@ -0,0 +1,24 @@
+package types
+
+import "crypto/sha256"
+
+// Every signature covers a signing domain and the chain id besides the
+// digest of the message. The domain keeps a signature made for one kind of
+// message from being valid for another, the chain id keeps it from being
+// replayed on other chains that share keys.
+const (
+	domainTx       = "bloq/tx"
+	domainBlock    = "bloq/block"
+	domainVote     = "bloq/vote"
+	domainProposal = "bloq/proposal"
+	domainVersion  = "bloq/version"
+)
+
+func signingMessage(domain, chainID string, digest []byte) []byte {
+	e := &encoder{}
+	e.bytes([]byte(domain))
+	e.bytes([]byte(chainID))
+	e.bytes(digest)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
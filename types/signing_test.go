@@ -0,0 +1,29 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningDomains(t *testing.T) {
+	digest := util.RandomHash()
+	assert.NotEqual(t, signingMessage(domainTx, "devnet", digest), signingMessage(domainBlock, "devnet", digest))
+	assert.NotEqual(t, signingMessage(domainTx, "devnet", digest), signingMessage(domainTx, "testnet", digest))
+}
+
+// a block signed for one chain is not valid once it claims another
+func TestBlockSignatureChainID(t *testing.T) {
+	var (
+		block   = util.RandomBlock()
+		privKey = crypto.GeneratePrivateKey()
+	)
+	block.Header.ChainID = "devnet"
+	SignBlock(privKey, block)
+	assert.True(t, VerifyBlock(block))
+
+	block.Header.ChainID = "testnet"
+	assert.False(t, VerifyBlock(block))
+}
@@ -1,41 +1,110 @@
 package types
 
 import (
+	"bytes"
 	"crypto/sha256"
-	"log"
 
-	pb "github.com/golang/protobuf/proto"
 	"github.com/koshkaj/bloq/crypto"
 	"github.com/koshkaj/bloq/proto"
 )
 
-func SignTransaction(pk *crypto.PrivateKey, tx *proto.Transaction) *crypto.Signature {
-	return pk.Sign(HashTransaction(tx))
+func SignTransaction(pk *crypto.PrivateKey, chainID string, tx *proto.Transaction) *crypto.Signature {
+	return pk.Sign(signingMessage(domainTx, chainID, signingHash(tx)))
 }
 
 func HashTransaction(tx *proto.Transaction) []byte {
-	b, err := pb.Marshal(tx)
-	if err != nil {
-		log.Fatal(err)
-	}
-	hash := sha256.Sum256(b)
+	hash := sha256.Sum256(EncodeTransaction(tx))
+	return hash[:]
+}
+
+// every signer of the tx (inputs and the staker) signs the hash of the tx
+// with all of the signatures stripped
+func signingHash(tx *proto.Transaction) []byte {
+	e := &encoder{}
+	e.transaction(tx, false)
+	hash := sha256.Sum256(e.buf)
 	return hash[:]
+}
 
+// VerifyTransaction checks the signatures of the tx. Inputs without a public
+// key spend predicate outputs and are signed by their witnesses, whether those
+// satisfy the predicate is up to the chain.
+func VerifyTransaction(chainID string, tx *proto.Transaction) bool {
+	return VerifyTransactions(chainID, []*proto.Transaction{tx}, nil)
 }
 
-func VerifyTransaction(tx *proto.Transaction) bool {
-	for _, inp := range tx.Inputs {
-		if len(inp.Signature) == 0 {
-			log.Fatal("the transaction has no signature")
-		}
-		var (
-			sig    = crypto.SignatureFromBytes(inp.Signature)
-			pubKey = crypto.PublicKeyFromBytes(inp.PublicKey)
-		)
-		inp.Signature = nil
-		if !sig.Verify(pubKey, HashTransaction(tx)) {
+// VerifyTransactions checks the signatures of all txs at once, spread over
+// all cpus. Signatures found in the cache are not verified again. Nothing is
+// added to the cache, a tx with valid signatures may still be invalid, see
+// CacheTransactions. The cache may be nil.
+func VerifyTransactions(chainID string, txx []*proto.Transaction, cache *SigCache) bool {
+	checks := []sigCheck{}
+	for _, tx := range txx {
+		txChecks, ok := txSignatures(chainID, tx)
+		if !ok {
 			return false
 		}
+		for _, check := range txChecks {
+			if !cache.has(check) {
+				checks = append(checks, check)
+			}
+		}
+	}
+	return verifyParallel(checks)
+}
+
+// CacheTransactions adds the signatures of txs that were verified and found
+// valid to the cache.
+func CacheTransactions(chainID string, txx []*proto.Transaction, cache *SigCache) {
+	for _, tx := range txx {
+		checks, ok := txSignatures(chainID, tx)
+		if !ok {
+			continue
+		}
+		for _, check := range checks {
+			cache.add(check)
+		}
+	}
+}
+
+// txSignatures returns every signature the tx has to carry, it fails if the tx
+// is missing any of them.
+func txSignatures(chainID string, tx *proto.Transaction) ([]sigCheck, bool) {
+	var (
+		hash   = signingMessage(domainTx, chainID, signingHash(tx))
+		checks = []sigCheck{}
+	)
+	for _, inp := range tx.Inputs {
+		// the tx hash covers the witness data, a relayer must not be able to
+		// change it by adding to it or reordering it
+		if len(inp.PublicKey) == 0 {
+			if len(inp.Signature) > 0 {
+				return nil, false
+			}
+			for i, w := range inp.Witnesses {
+				if i > 0 && bytes.Compare(inp.Witnesses[i-1].PublicKey, w.PublicKey) >= 0 {
+					return nil, false
+				}
+				checks = append(checks, sigCheck{w.PublicKey, w.Signature, hash})
+			}
+			continue
+		}
+		if len(inp.Witnesses) > 0 || len(inp.Preimage) > 0 {
+			return nil, false
+		}
+		checks = append(checks, sigCheck{inp.PublicKey, inp.Signature, hash})
+	}
+	switch tx.Type {
+	case proto.TxType_TRANSFER:
+	case proto.TxType_EVIDENCE:
+		if tx.Evidence == nil || !VerifyEvidence(tx.Evidence) {
+			return nil, false
+		}
+	default:
+		if tx.Stake == nil {
+			return nil, false
+		}
+		checks = append(checks, sigCheck{tx.Stake.PublicKey, tx.Stake.Signature, hash})
 	}
-	return true
+	return checks, true
 }
@@ -38,8 +38,10 @@ func TestNewTransaction(t *testing.T) {
 		Inputs:  []*proto.TxInput{input},
 		Outputs: []*proto.TxOutput{output_1, output_2},
 	}
-	sig := SignTransaction(fromPrivKey, tx)
+	sig := SignTransaction(fromPrivKey, "devnet", tx)
 	input.Signature = sig.Bytes()
-	assert.True(t, VerifyTransaction(tx))
+	assert.True(t, VerifyTransaction("devnet", tx))
+	// the signature can not be replayed on another chain
+	assert.False(t, VerifyTransaction("testnet", tx))
 
 }
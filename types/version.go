@@ -0,0 +1,38 @@
+package types
+
+import (
+	"crypto/sha256"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+)
+
+// returns SHA256 of the handshake version without its signature
+func HashVersion(v *proto.Version) []byte {
+	e := &encoder{}
+	e.version(v)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+// SignVersion signs the version with the identity key of the node.
+func SignVersion(pk *crypto.PrivateKey, chainID string, v *proto.Version) *crypto.Signature {
+	v.PublicKey = pk.Public().Bytes()
+	sig := pk.Sign(signingMessage(domainVersion, chainID, HashVersion(v)))
+	v.Signature = sig.Bytes()
+	return sig
+}
+
+func VerifyVersion(chainID string, v *proto.Version) bool {
+	if len(v.PublicKey) != crypto.PubKeyLen {
+		return false
+	}
+	if len(v.Signature) != crypto.SignatureLen {
+		return false
+	}
+	var (
+		sig    = crypto.SignatureFromBytes(v.Signature)
+		pubKey = crypto.PublicKeyFromBytes(v.PublicKey)
+	)
+	return sig.Verify(pubKey, signingMessage(domainVersion, chainID, HashVersion(v)))
+}
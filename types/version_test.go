@@ -0,0 +1,33 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerifyVersion(t *testing.T) {
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		v       = &proto.Version{
+			Version:    "bloq-1",
+			Height:     10,
+			ListenAddr: "127.0.0.1:3000",
+		}
+	)
+	SignVersion(privKey, "devnet", v)
+	assert.Equal(t, privKey.Public().Bytes(), v.PublicKey)
+	assert.True(t, VerifyVersion("devnet", v))
+	assert.False(t, VerifyVersion("testnet", v))
+
+	// a node can not claim the address of another
+	v.ListenAddr = "127.0.0.1:3002"
+	assert.False(t, VerifyVersion("devnet", v))
+
+	// nor sign for a key it does not hold
+	v.ListenAddr = "127.0.0.1:3000"
+	v.PublicKey = crypto.GeneratePrivateKey().Public().Bytes()
+	assert.False(t, VerifyVersion("devnet", v))
+}
@@ -0,0 +1,70 @@
+package types
+
+import (
+	"crypto/sha256"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+)
+
+// returns SHA256 of the vote without its signature
+func HashVote(vote *proto.Vote) []byte {
+	e := &encoder{}
+	e.vote(vote, false)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+func SignVote(pk *crypto.PrivateKey, chainID string, vote *proto.Vote) *crypto.Signature {
+	vote.PublicKey = pk.Public().Bytes()
+	sig := pk.Sign(signingMessage(domainVote, chainID, HashVote(vote)))
+	vote.Signature = sig.Bytes()
+	return sig
+}
+
+func VerifyVote(chainID string, vote *proto.Vote) bool {
+	if len(vote.PublicKey) != crypto.PubKeyLen {
+		return false
+	}
+	if len(vote.Signature) != crypto.SignatureLen {
+		return false
+	}
+	var (
+		sig    = crypto.SignatureFromBytes(vote.Signature)
+		pubKey = crypto.PublicKeyFromBytes(vote.PublicKey)
+	)
+	return sig.Verify(pubKey, signingMessage(domainVote, chainID, HashVote(vote)))
+}
+
+// returns SHA256 of the proposal without its signature, the block is covered
+// by its hash
+func HashProposal(p *proto.Proposal) []byte {
+	e := &encoder{}
+	e.proposal(p, false)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+func SignProposal(pk *crypto.PrivateKey, chainID string, p *proto.Proposal) *crypto.Signature {
+	p.PublicKey = pk.Public().Bytes()
+	sig := pk.Sign(signingMessage(domainProposal, chainID, HashProposal(p)))
+	p.Signature = sig.Bytes()
+	return sig
+}
+
+func VerifyProposal(chainID string, p *proto.Proposal) bool {
+	if p.Block == nil || p.Block.Header == nil {
+		return false
+	}
+	if len(p.PublicKey) != crypto.PubKeyLen {
+		return false
+	}
+	if len(p.Signature) != crypto.SignatureLen {
+		return false
+	}
+	var (
+		sig    = crypto.SignatureFromBytes(p.Signature)
+		pubKey = crypto.PublicKeyFromBytes(p.PublicKey)
+	)
+	return sig.Verify(pubKey, signingMessage(domainProposal, chainID, HashProposal(p)))
+}
@@ -0,0 +1,51 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/koshkaj/bloq/crypto"
+	"github.com/koshkaj/bloq/proto"
+	"github.com/koshkaj/bloq/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerifyVote(t *testing.T) {
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		vote    = &proto.Vote{
+			Type:      proto.VoteType_PRECOMMIT,
+			Height:    10,
+			Round:     1,
+			BlockHash: util.RandomHash(),
+		}
+	)
+	sig := SignVote(privKey, "devnet", vote)
+	assert.Equal(t, privKey.Public().Bytes(), vote.PublicKey)
+	assert.Equal(t, sig.Bytes(), vote.Signature)
+	assert.True(t, VerifyVote("devnet", vote))
+	assert.False(t, VerifyVote("testnet", vote))
+
+	vote.Round = 2
+	assert.False(t, VerifyVote("devnet", vote))
+}
+
+func TestSignVerifyProposal(t *testing.T) {
+	var (
+		sealer   = crypto.GeneratePrivateKey()
+		proposer = crypto.GeneratePrivateKey()
+		block    = &proto.Block{Header: &proto.Header{Height: 10}}
+		proposal = &proto.Proposal{Block: block, Round: 1}
+	)
+	SignBlock(sealer, block)
+	// a block sealed in an earlier round can be proposed by someone else
+	SignProposal(proposer, "devnet", proposal)
+	assert.Equal(t, proposer.Public().Bytes(), proposal.PublicKey)
+	assert.True(t, VerifyProposal("devnet", proposal))
+	assert.False(t, VerifyProposal("testnet", proposal))
+
+	proposal.Round = 2
+	assert.False(t, VerifyProposal("devnet", proposal))
+	proposal.Round = 1
+	block.Header.Height = 11
+	assert.False(t, VerifyProposal("devnet", proposal))
+}